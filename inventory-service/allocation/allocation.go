@@ -0,0 +1,97 @@
+package allocation
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
+)
+
+// Strategy names accepted by New (ALLOCATION_STRATEGY)
+const (
+	Nearest   = "nearest"
+	MostStock = "most_stock"
+	Priority  = "priority"
+)
+
+// Strategy decides which warehouses a reservation is taken from. Allocate
+// returns nil if the levels do not have quantity available between them.
+type Strategy interface {
+	Allocate(levels []models.StockLevel, quantity int, region string) []models.Allocation
+}
+
+// New returns the strategy with the given name
+func New(name string) (Strategy, error) {
+	switch name {
+	case Nearest:
+		return ranked(nearestFirst), nil
+	case MostStock:
+		return ranked(mostStockFirst), nil
+	case Priority:
+		return ranked(priorityFirst), nil
+	}
+	return nil, fmt.Errorf("unknown allocation strategy %q (want %s, %s or %s)", name, Nearest, MostStock, Priority)
+}
+
+// ranked allocates from warehouses in the order given by its less function.
+// The first warehouse that can take the whole quantity is used; if none can,
+// the quantity is split across warehouses in that order.
+type ranked func(a, b models.StockLevel, region string) bool
+
+func (less ranked) Allocate(levels []models.StockLevel, quantity int, region string) []models.Allocation {
+	candidates := make([]models.StockLevel, 0, len(levels))
+	for _, level := range levels {
+		if level.Available() > 0 {
+			candidates = append(candidates, level)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return less(candidates[i], candidates[j], region)
+	})
+
+	for _, level := range candidates {
+		if level.Available() >= quantity {
+			return []models.Allocation{{WarehouseID: level.WarehouseID, Quantity: quantity}}
+		}
+	}
+
+	allocations := []models.Allocation{}
+	remaining := quantity
+	for _, level := range candidates {
+		take := min(level.Available(), remaining)
+		allocations = append(allocations, models.Allocation{WarehouseID: level.WarehouseID, Quantity: take})
+		remaining -= take
+		if remaining == 0 {
+			return allocations
+		}
+	}
+
+	return nil
+}
+
+// nearestFirst prefers warehouses in the order's ship-to region, then by
+// priority
+func nearestFirst(a, b models.StockLevel, region string) bool {
+	if (a.Region == region) != (b.Region == region) {
+		return a.Region == region
+	}
+	return priorityFirst(a, b, region)
+}
+
+// mostStockFirst prefers the warehouses with the most available stock, so
+// orders ship from as few locations as possible
+func mostStockFirst(a, b models.StockLevel, region string) bool {
+	if a.Available() != b.Available() {
+		return a.Available() > b.Available()
+	}
+	return priorityFirst(a, b, region)
+}
+
+// priorityFirst prefers warehouses with a lower priority value
+func priorityFirst(a, b models.StockLevel, _ string) bool {
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+	return a.WarehouseID < b.WarehouseID
+}
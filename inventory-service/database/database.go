@@ -35,11 +35,116 @@ func createTables(db *sql.DB) error {
 		name VARCHAR(255) NOT NULL,
 		stock INTEGER NOT NULL DEFAULT 0,
 		reserved INTEGER NOT NULL DEFAULT 0,
+		price_minor BIGINT NOT NULL DEFAULT 0,
+		currency VARCHAR(3) NOT NULL DEFAULT 'USD',
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_products_id ON products(id);
+
+	ALTER TABLE products ADD COLUMN IF NOT EXISTS price_minor BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE products ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'USD';
+	ALTER TABLE products ADD COLUMN IF NOT EXISTS reorder_threshold INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE products ADD COLUMN IF NOT EXISTS stock_alert VARCHAR(20) NOT NULL DEFAULT 'OK';
+	ALTER TABLE products ADD COLUMN IF NOT EXISTS allow_backorder BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE products ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+	ALTER TABLE products ADD COLUMN IF NOT EXISTS parent_id VARCHAR(255) REFERENCES products(id);
+	ALTER TABLE products ADD COLUMN IF NOT EXISTS attributes JSONB NOT NULL DEFAULT '{}';
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_products_variant ON products(parent_id, attributes) WHERE parent_id IS NOT NULL;
+
+	CREATE TABLE IF NOT EXISTS reservations (
+		id BIGSERIAL PRIMARY KEY,
+		order_id VARCHAR(255) NOT NULL,
+		product_id VARCHAR(255) NOT NULL REFERENCES products(id),
+		quantity INTEGER NOT NULL,
+		state VARCHAR(20) NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (order_id, product_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_reservations_expiry ON reservations(state, expires_at);
+
+	CREATE TABLE IF NOT EXISTS cancelled_orders (
+		order_id VARCHAR(255) PRIMARY KEY,
+		reason TEXT NOT NULL DEFAULT '',
+		cancelled_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS backorders (
+		id BIGSERIAL PRIMARY KEY,
+		order_id VARCHAR(255) NOT NULL,
+		product_id VARCHAR(255) NOT NULL REFERENCES products(id),
+		quantity INTEGER NOT NULL,
+		user_email VARCHAR(255) NOT NULL DEFAULT '',
+		ship_to_region VARCHAR(50) NOT NULL DEFAULT '',
+		total_minor BIGINT NOT NULL DEFAULT 0,
+		currency VARCHAR(3) NOT NULL DEFAULT '',
+		saga_mode VARCHAR(20) NOT NULL,
+		saga_order VARCHAR(20) NOT NULL,
+		state VARCHAR(20) NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (order_id, product_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_backorders_queue ON backorders(product_id, state, id);
+	CREATE INDEX IF NOT EXISTS idx_backorders_expiry ON backorders(state, expires_at);
+
+	CREATE TABLE IF NOT EXISTS warehouses (
+		id VARCHAR(255) PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		region VARCHAR(50) NOT NULL,
+		priority INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	INSERT INTO warehouses (id, name, region, priority)
+	VALUES ('main', 'Main Warehouse', 'central', 0)
+	ON CONFLICT (id) DO NOTHING;
+
+	CREATE TABLE IF NOT EXISTS stock_levels (
+		product_id VARCHAR(255) NOT NULL REFERENCES products(id),
+		warehouse_id VARCHAR(255) NOT NULL REFERENCES warehouses(id),
+		stock INTEGER NOT NULL DEFAULT 0,
+		reserved INTEGER NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (product_id, warehouse_id)
+	);
+
+	-- Backstop for the conditional stock updates: reserved stock can never
+	-- exceed stock on hand
+	DO $$
+	BEGIN
+		ALTER TABLE stock_levels ADD CONSTRAINT stock_levels_reserved_check
+			CHECK (reserved >= 0 AND reserved <= stock) NOT VALID;
+	EXCEPTION WHEN duplicate_object THEN NULL;
+	END $$;
+
+	CREATE TABLE IF NOT EXISTS reservation_allocations (
+		reservation_id BIGINT NOT NULL REFERENCES reservations(id),
+		warehouse_id VARCHAR(255) NOT NULL REFERENCES warehouses(id),
+		quantity INTEGER NOT NULL,
+		PRIMARY KEY (reservation_id, warehouse_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS stock_movements (
+		id BIGSERIAL PRIMARY KEY,
+		product_id VARCHAR(255) NOT NULL REFERENCES products(id),
+		warehouse_id VARCHAR(255) NOT NULL REFERENCES warehouses(id),
+		type VARCHAR(20) NOT NULL,
+		quantity INTEGER NOT NULL,
+		order_id VARCHAR(255) NOT NULL DEFAULT '',
+		actor VARCHAR(255) NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_stock_movements_product ON stock_movements(product_id, id);
+	CREATE INDEX IF NOT EXISTS idx_stock_movements_order ON stock_movements(order_id) WHERE order_id <> '';
 	`
 
 	_, err := db.Exec(query)
@@ -50,18 +155,24 @@ func createTables(db *sql.DB) error {
 	// Insert sample products
 	insertSampleData(db)
 
+	if err := migrateStockLevels(db); err != nil {
+		return err
+	}
+
 	log.Println("Products table created successfully")
 	return nil
 }
 
 func insertSampleData(db *sql.DB) {
 	query := `
-	INSERT INTO products (id, name, stock, reserved)
+	INSERT INTO products (id, name, stock, reserved, price_minor, currency)
 	VALUES 
-		('product-001', 'Laptop', 100, 0),
-		('product-002', 'Mouse', 500, 0),
-		('product-003', 'Keyboard', 300, 0)
-	ON CONFLICT (id) DO NOTHING;
+		('product-001', 'Laptop', 100, 0, 99900, 'USD'),
+		('product-002', 'Mouse', 500, 0, 2500, 'USD'),
+		('product-003', 'Keyboard', 300, 0, 7500, 'USD')
+	ON CONFLICT (id) DO UPDATE
+		SET price_minor = EXCLUDED.price_minor, currency = EXCLUDED.currency
+		WHERE products.price_minor = 0;
 	`
 
 	_, err := db.Exec(query)
@@ -72,6 +183,48 @@ func insertSampleData(db *sql.DB) {
 	}
 }
 
+// migrateStockLevels moves stock recorded only on products (from before stock
+// was held per warehouse) into the main warehouse, along with the
+// reservations holding it
+func migrateStockLevels(db *sql.DB) error {
+	query := `
+	INSERT INTO stock_levels (product_id, warehouse_id, stock, reserved, updated_at)
+	SELECT p.id, 'main', p.stock, p.reserved, p.updated_at
+	FROM products p
+	WHERE NOT EXISTS (SELECT 1 FROM stock_levels l WHERE l.product_id = p.id);
+
+	INSERT INTO reservation_allocations (reservation_id, warehouse_id, quantity)
+	SELECT r.id, 'main', r.quantity
+	FROM reservations r
+	WHERE NOT EXISTS (SELECT 1 FROM reservation_allocations a WHERE a.reservation_id = r.id);
+	`
+
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+
+	return openLedger(db)
+}
+
+// openLedger records the stock levels that predate the stock movement ledger
+// as opening balances, so that the ledger accounts for all stock
+func openLedger(db *sql.DB) error {
+	query := `
+	INSERT INTO stock_movements (product_id, warehouse_id, type, quantity, actor, reason)
+	SELECT l.product_id, l.warehouse_id, m.type, m.quantity, 'migration', 'Opening balance'
+	FROM stock_levels l
+	CROSS JOIN LATERAL (VALUES ('receipt', l.stock), ('reserve', l.reserved)) AS m(type, quantity)
+	WHERE m.quantity <> 0
+		AND NOT EXISTS (
+			SELECT 1 FROM stock_movements s
+			WHERE s.product_id = l.product_id AND s.warehouse_id = l.warehouse_id
+		);
+	`
+
+	_, err := db.Exec(query)
+	return err
+}
+
 func CloseDB(db *sql.DB) {
 	if err := db.Close(); err != nil {
 		log.Printf("Error closing database: %v", err)
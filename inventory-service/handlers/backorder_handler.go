@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/repository"
+)
+
+type BackorderHandler struct {
+	repo *repository.BackorderRepository
+}
+
+func NewBackorderHandler(repo *repository.BackorderRepository) *BackorderHandler {
+	return &BackorderHandler{repo: repo}
+}
+
+// ListBackorders returns backorders in queue order, filtered by the
+// product_id and state query parameters
+func (h *BackorderHandler) ListBackorders(c *gin.Context) {
+	var filter models.BackorderFilter
+
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	backorders, err := h.repo.ListBackorders(filter)
+	if err != nil {
+		log.Printf("Failed to list backorders: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list backorders"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"backorders": backorders})
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/repository"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/services"
+)
+
+type ProductHandler struct {
+	repo             *repository.InventoryRepository
+	inventoryService *services.InventoryService
+}
+
+func NewProductHandler(repo *repository.InventoryRepository, inventoryService *services.InventoryService) *ProductHandler {
+	return &ProductHandler{
+		repo:             repo,
+		inventoryService: inventoryService,
+	}
+}
+
+func (h *ProductHandler) ListProducts(c *gin.Context) {
+	products, err := h.repo.ListProducts()
+	if err != nil {
+		log.Printf("Failed to list products: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list products"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"products": products})
+}
+
+func (h *ProductHandler) GetProduct(c *gin.Context) {
+	id := c.Param("id")
+
+	product, err := h.repo.GetProduct(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get product %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get product"})
+		return
+	}
+
+	c.JSON(http.StatusOK, product)
+}
+
+// ListVariants returns the SKUs of a product with variants
+func (h *ProductHandler) ListVariants(c *gin.Context) {
+	id := c.Param("id")
+
+	if _, err := h.repo.GetProduct(id); err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	} else if err != nil {
+		log.Printf("Failed to get product %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list variants"})
+		return
+	}
+
+	variants, err := h.repo.ListVariants(id)
+	if err != nil {
+		log.Printf("Failed to list variants of product %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list variants"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"product_id": id, "variants": variants})
+}
+
+func (h *ProductHandler) CreateProduct(c *gin.Context) {
+	var req models.CreateProductRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	product, err := h.inventoryService.CreateProduct(&req, actor(c))
+	switch {
+	case errors.Is(err, repository.ErrProductExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Product already exists"})
+		return
+	case errors.Is(err, repository.ErrWarehouseNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Warehouse not found"})
+		return
+	case errors.Is(err, repository.ErrParentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Parent product not found"})
+		return
+	case errors.Is(err, repository.ErrVariantExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "A variant with these attributes already exists"})
+		return
+	case errors.Is(err, repository.ErrInvalidVariant), errors.Is(err, repository.ErrInvalidParent):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("Failed to create product %s: %v", req.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create product"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, product)
+}
+
+func (h *ProductHandler) UpdateProduct(c *gin.Context) {
+	id := c.Param("id")
+
+	var req models.UpdateProductRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	product, err := h.inventoryService.UpdateProduct(id, &req)
+	if errors.Is(err, repository.ErrProductNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	if errors.Is(err, repository.ErrVersionConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Product was changed since it was read; fetch it again and retry"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to update product %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update product"})
+		return
+	}
+
+	c.JSON(http.StatusOK, product)
+}
+
+func (h *ProductHandler) AdjustStock(c *gin.Context) {
+	id := c.Param("id")
+
+	var req models.AdjustStockRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	product, err := h.inventoryService.AdjustStock(id, &req, actor(c))
+	switch {
+	case errors.Is(err, repository.ErrProductNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	case errors.Is(err, repository.ErrWarehouseNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Warehouse not found"})
+		return
+	case errors.Is(err, repository.ErrInsufficientStock):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Stock cannot drop below the quantity reserved for orders"})
+		return
+	case errors.Is(err, repository.ErrVariantRequired):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Product has variants; adjust the stock of one of its SKUs"})
+		return
+	case err != nil:
+		log.Printf("Failed to adjust stock of product %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to adjust stock"})
+		return
+	}
+
+	c.JSON(http.StatusOK, product)
+}
+
+// ImportProducts upserts products from a CSV request body. With
+// ?dry_run=true the result shows what would change without writing anything.
+func (h *ProductHandler) ImportProducts(c *gin.Context) {
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "dry_run must be true or false"})
+		return
+	}
+
+	result, err := h.inventoryService.ImportProductsCSV(c.Request.Body, dryRun, actor(c))
+	if errors.Is(err, services.ErrInvalidCSV) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to import products: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import products"})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// ExportProducts returns every product's stock levels as a CSV download
+func (h *ProductHandler) ExportProducts(c *gin.Context) {
+	var buf bytes.Buffer
+	if err := h.inventoryService.ExportProductsCSV(&buf); err != nil {
+		log.Printf("Failed to export products: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export products"})
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="products.csv"`)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
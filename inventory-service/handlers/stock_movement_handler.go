@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/repository"
+)
+
+type StockMovementHandler struct {
+	repo *repository.StockMovementRepository
+}
+
+func NewStockMovementHandler(repo *repository.StockMovementRepository) *StockMovementHandler {
+	return &StockMovementHandler{repo: repo}
+}
+
+// ListMovements returns ledger entries, newest first, filtered by the
+// product_id, warehouse_id, order_id and type query parameters. Pass the
+// last entry's ID as before_id to get the next page.
+func (h *StockMovementHandler) ListMovements(c *gin.Context) {
+	var filter models.StockMovementFilter
+
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	movements, err := h.repo.ListMovements(filter)
+	if err != nil {
+		log.Printf("Failed to list stock movements: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list stock movements"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"movements": movements})
+}
+
+// CheckLedger recomputes stock counters from the ledger and reports the ones
+// that differ
+func (h *StockMovementHandler) CheckLedger(c *gin.Context) {
+	check, err := h.repo.CheckLedger()
+	if err != nil {
+		log.Printf("Failed to check stock ledger: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check stock ledger"})
+		return
+	}
+
+	c.JSON(http.StatusOK, check)
+}
+
+// actor identifies who made a request for the stock ledger, taken from the
+// X-Actor header
+func actor(c *gin.Context) string {
+	actor := c.GetHeader("X-Actor")
+	if actor == "" {
+		return "api"
+	}
+	if len(actor) > 255 {
+		return actor[:255]
+	}
+	return actor
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/repository"
+)
+
+type WarehouseHandler struct {
+	repo *repository.WarehouseRepository
+}
+
+func NewWarehouseHandler(repo *repository.WarehouseRepository) *WarehouseHandler {
+	return &WarehouseHandler{repo: repo}
+}
+
+func (h *WarehouseHandler) ListWarehouses(c *gin.Context) {
+	warehouses, err := h.repo.ListWarehouses()
+	if err != nil {
+		log.Printf("Failed to list warehouses: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list warehouses"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"warehouses": warehouses})
+}
+
+func (h *WarehouseHandler) CreateWarehouse(c *gin.Context) {
+	var req models.CreateWarehouseRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	warehouse, err := h.repo.CreateWarehouse(&req)
+	if errors.Is(err, repository.ErrWarehouseExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Warehouse already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create warehouse %s: %v", req.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create warehouse"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, warehouse)
+}
+
+// ListStockLevels returns a product's stock in each warehouse
+func (h *WarehouseHandler) ListStockLevels(c *gin.Context) {
+	id := c.Param("id")
+
+	levels, err := h.repo.ListStockLevels(id)
+	if err != nil {
+		log.Printf("Failed to list stock levels of product %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list stock levels"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"stock_levels": levels})
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/gin-gonic/gin"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/allocation"
 	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/config"
 	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/database"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/handlers"
 	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/messaging"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
 	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/repository"
 	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/services"
 )
@@ -24,8 +34,18 @@ func main() {
 	}
 	defer database.CloseDB(db)
 
-	// Initialize repository
+	// Warehouse allocation strategy for reservations
+	strategy, err := allocation.New(cfg.AllocationStrategy)
+	if err != nil {
+		log.Fatalf("Invalid ALLOCATION_STRATEGY: %v", err)
+	}
+
+	// Initialize repositories
 	inventoryRepo := repository.NewInventoryRepository(db)
+	reservationRepo := repository.NewReservationRepository(db, strategy)
+	warehouseRepo := repository.NewWarehouseRepository(db)
+	movementRepo := repository.NewStockMovementRepository(db)
+	backorderRepo := repository.NewBackorderRepository(db)
 
 	// Initialize publisher
 	publisher, err := messaging.NewPublisher(cfg.RabbitMQURL)
@@ -35,7 +55,20 @@ func main() {
 	defer publisher.Close()
 
 	// Initialize service
-	inventoryService := services.NewInventoryService(inventoryRepo, publisher)
+	inventoryService := services.NewInventoryService(inventoryRepo, reservationRepo, warehouseRepo, backorderRepo, publisher, cfg.ReservationTTL, cfg.BackorderMaxWait)
+
+	// "import-products" and "export-products" load or dump products as CSV
+	// and "check-ledger" compares stock counters with the ledger; all exit
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import-products":
+			os.Exit(importProducts(inventoryService, os.Args[2:]))
+		case "export-products":
+			os.Exit(exportProducts(inventoryService, os.Args[2:]))
+		case "check-ledger":
+			os.Exit(checkLedger(movementRepo))
+		}
+	}
 
 	// Initialize and start consumer
 	consumer, err := messaging.NewConsumer(cfg.RabbitMQURL, inventoryService)
@@ -48,6 +81,58 @@ func main() {
 		log.Fatalf("Failed to start consumer: %v", err)
 	}
 
+	// Initialize and start command consumer (for orchestrated sagas)
+	commandConsumer, err := messaging.NewCommandConsumer(cfg.RabbitMQURL, inventoryService)
+	if err != nil {
+		log.Fatalf("Failed to initialize command consumer: %v", err)
+	}
+	defer commandConsumer.Close()
+
+	if err := commandConsumer.Start(); err != nil {
+		log.Fatalf("Failed to start command consumer: %v", err)
+	}
+
+	// Initialize and start compensation consumer (stock release on cancellation)
+	compensationConsumer, err := messaging.NewCompensationConsumer(cfg.RabbitMQURL, inventoryService)
+	if err != nil {
+		log.Fatalf("Failed to initialize compensation consumer: %v", err)
+	}
+	defer compensationConsumer.Close()
+
+	if err := compensationConsumer.Start(); err != nil {
+		log.Fatalf("Failed to start compensation consumer: %v", err)
+	}
+
+	// Start the sweeper for expired reservations and backorders
+	sweeperCtx, stopSweeper := context.WithCancel(context.Background())
+	defer stopSweeper()
+	sweeper := services.NewReservationSweeper(inventoryService, cfg.ReservationSweepInterval)
+	sweeper.Start(sweeperCtx)
+
+	// Setup Gin router for the product API
+	productHandler := handlers.NewProductHandler(inventoryRepo, inventoryService)
+	warehouseHandler := handlers.NewWarehouseHandler(warehouseRepo)
+	movementHandler := handlers.NewStockMovementHandler(movementRepo)
+	backorderHandler := handlers.NewBackorderHandler(backorderRepo)
+	router := setupRouter(productHandler, warehouseHandler, movementHandler, backorderHandler)
+
+	// Create HTTP server
+	srv := &http.Server{
+		Addr:         ":" + cfg.ServerPort,
+		Handler:      router,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	// Start server in goroutine
+	go func() {
+		log.Printf("Inventory API starting on port %s", cfg.ServerPort)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
 	log.Println("Inventory Service started successfully")
 
 	// Wait for interrupt signal
@@ -56,4 +141,137 @@ func main() {
 	<-quit
 
 	log.Println("Shutting down Inventory Service...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Server forced to shutdown: %v", err)
+	}
+}
+
+// importProducts runs "import-products [-dry-run] <file.csv>" and returns the
+// exit code: 1 if the file could not be imported or any row was rejected
+func importProducts(inventoryService *services.InventoryService, args []string) int {
+	flags := flag.NewFlagSet("import-products", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would change without writing anything")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: import-products [-dry-run] <file.csv>")
+		return 2
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Printf("Failed to open %s: %v", flags.Arg(0), err)
+		return 1
+	}
+	defer file.Close()
+
+	result, err := inventoryService.ImportProductsCSV(file, *dryRun, models.ActorCLI)
+	if err != nil {
+		log.Printf("Failed to import products: %v", err)
+		return 1
+	}
+
+	mode := "Imported"
+	if result.DryRun {
+		mode = "Dry run"
+	}
+	fmt.Printf("%s %d rows: %d created, %d updated, %d unchanged, %d failed\n",
+		mode, result.Rows, result.Created, result.Updated, result.Unchanged, result.Failed)
+	for _, rowErr := range result.Errors {
+		fmt.Printf("line %d %s: %s\n", rowErr.Line, rowErr.ProductID, rowErr.Error)
+	}
+
+	if result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// exportProducts runs "export-products [file.csv]", writing to stdout when no
+// file is given
+func exportProducts(inventoryService *services.InventoryService, args []string) int {
+	out := os.Stdout
+	if len(args) > 0 {
+		file, err := os.Create(args[0])
+		if err != nil {
+			log.Printf("Failed to create %s: %v", args[0], err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if err := inventoryService.ExportProductsCSV(out); err != nil {
+		log.Printf("Failed to export products: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// checkLedger runs "check-ledger" and returns the exit code: 1 if any stock
+// counter does not match the ledger
+func checkLedger(movementRepo *repository.StockMovementRepository) int {
+	check, err := movementRepo.CheckLedger()
+	if err != nil {
+		log.Printf("Failed to check stock ledger: %v", err)
+		return 1
+	}
+
+	if check.Consistent {
+		fmt.Println("Stock counters match the ledger")
+		return 0
+	}
+
+	for _, m := range check.Mismatches {
+		where := m.WarehouseID
+		if where == "" {
+			where = "total"
+		}
+		fmt.Printf("%s (%s): stock %d, reserved %d; ledger says stock %d, reserved %d\n",
+			m.ProductID, where, m.Stock, m.Reserved, m.LedgerStock, m.LedgerReserved)
+	}
+	return 1
+}
+
+func setupRouter(productHandler *handlers.ProductHandler, warehouseHandler *handlers.WarehouseHandler, movementHandler *handlers.StockMovementHandler, backorderHandler *handlers.BackorderHandler) *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(gin.Logger())
+	router.Use(gin.Recovery())
+
+	// Health check endpoint
+	router.GET("/health", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "healthy"})
+	})
+
+	// Metrics endpoint (expvar counters such as expired reservations)
+	router.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+
+	// Product endpoints
+	v1 := router.Group("/api/v1")
+	{
+		v1.GET("/products", productHandler.ListProducts)
+		v1.GET("/products/:id", productHandler.GetProduct)
+		v1.POST("/products", productHandler.CreateProduct)
+		v1.POST("/products/import", productHandler.ImportProducts)
+		v1.GET("/products/export", productHandler.ExportProducts)
+		v1.PUT("/products/:id", productHandler.UpdateProduct)
+		v1.POST("/products/:id/stock-adjustments", productHandler.AdjustStock)
+		v1.GET("/products/:id/stock-levels", warehouseHandler.ListStockLevels)
+		v1.GET("/products/:id/variants", productHandler.ListVariants)
+
+		v1.GET("/warehouses", warehouseHandler.ListWarehouses)
+		v1.POST("/warehouses", warehouseHandler.CreateWarehouse)
+
+		v1.GET("/stock-movements", movementHandler.ListMovements)
+		v1.GET("/stock-movements/check", movementHandler.CheckLedger)
+
+		v1.GET("/backorders", backorderHandler.ListBackorders)
+	}
+
+	return router
 }
@@ -0,0 +1,145 @@
+package messaging
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
+	"github.com/streadway/amqp"
+)
+
+// CommandConsumer executes inventory.reserve commands sent by the order
+// service's saga orchestrator. The outcome is published as the usual
+// inventory event, marked as orchestrated, which the orchestrator treats as
+// the reply.
+type CommandConsumer struct {
+	conn             *amqp.Connection
+	channel          *amqp.Channel
+	inventoryService OrderProcessor
+}
+
+type SagaCommand struct {
+	OrderID      string `json:"order_id"`
+	ItemID       string `json:"item_id"`
+	Quantity     int    `json:"quantity"`
+	UserEmail    string `json:"user_email"`
+	ShipToRegion string `json:"ship_to_region"`
+	// Items, when present, are the lines of a multi-line order
+	Items []models.OrderLine `json:"items"`
+}
+
+func NewCommandConsumer(rabbitMQURL string, inventoryService OrderProcessor) (*CommandConsumer, error) {
+	conn, err := amqp.Dial(rabbitMQURL)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare saga exchange
+	err = channel.ExchangeDeclare(
+		"saga",
+		"topic",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare queue for inventory commands
+	queue, err := channel.QueueDeclare(
+		"saga.commands.inventory.queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Bind queue to exchange
+	err = channel.QueueBind(
+		queue.Name,
+		"inventory.reserve",
+		"saga",
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	log.Println("RabbitMQ command consumer initialized successfully")
+
+	return &CommandConsumer{
+		conn:             conn,
+		channel:          channel,
+		inventoryService: inventoryService,
+	}, nil
+}
+
+func (c *CommandConsumer) Start() error {
+	msgs, err := c.channel.Consume(
+		"saga.commands.inventory.queue",
+		"",
+		false, // manual ack
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for msg := range msgs {
+			var cmd SagaCommand
+			if err := json.Unmarshal(msg.Body, &cmd); err != nil {
+				log.Printf("Failed to unmarshal command: %v", err)
+				msg.Nack(false, false) // Don't requeue
+				continue
+			}
+
+			log.Printf("Received %s command: %+v", msg.RoutingKey, cmd)
+
+			// Reserve inventory and reply through an orchestrated event
+			if len(cmd.Items) > 0 {
+				c.inventoryService.ProcessOrderLines(cmd.OrderID, cmd.Items, cmd.UserEmail, cmd.ShipToRegion, Orchestration)
+			} else {
+				c.inventoryService.ProcessOrder(cmd.OrderID, cmd.ItemID, cmd.Quantity, cmd.UserEmail, cmd.ShipToRegion, Orchestration)
+			}
+
+			// Acknowledge the message
+			msg.Ack(false)
+		}
+	}()
+
+	log.Println("Command consumer started, waiting for inventory commands...")
+	return nil
+}
+
+func (c *CommandConsumer) Close() {
+	if c.channel != nil {
+		c.channel.Close()
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,145 @@
+package messaging
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/streadway/amqp"
+)
+
+// OrderCompensator defines the interface for giving back stock for orders
+// that will not be fulfilled
+type OrderCompensator interface {
+	CompensateOrder(orderID, reason string) error
+}
+
+// CompensationConsumer restores stock for orders that were cancelled or timed
+// out, whichever saga flow they ran
+type CompensationConsumer struct {
+	conn             *amqp.Connection
+	channel          *amqp.Channel
+	inventoryService OrderCompensator
+}
+
+type OrderCancelledEvent struct {
+	OrderID string `json:"order_id"`
+	Reason  string `json:"reason"`
+}
+
+func NewCompensationConsumer(rabbitMQURL string, inventoryService OrderCompensator) (*CompensationConsumer, error) {
+	conn, err := amqp.Dial(rabbitMQURL)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare orders exchange
+	err = channel.ExchangeDeclare(
+		"orders",
+		"topic",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare queue for order.cancelled and order.timed_out events
+	queue, err := channel.QueueDeclare(
+		"order.cancelled.inventory.queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Bind queue to exchange
+	for _, routingKey := range []string{"order.cancelled", "order.timed_out"} {
+		err = channel.QueueBind(
+			queue.Name,
+			routingKey,
+			"orders",
+			false,
+			nil,
+		)
+		if err != nil {
+			channel.Close()
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	log.Println("RabbitMQ compensation consumer initialized successfully")
+
+	return &CompensationConsumer{
+		conn:             conn,
+		channel:          channel,
+		inventoryService: inventoryService,
+	}, nil
+}
+
+func (c *CompensationConsumer) Start() error {
+	msgs, err := c.channel.Consume(
+		"order.cancelled.inventory.queue",
+		"",
+		false, // manual ack
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for msg := range msgs {
+			var event OrderCancelledEvent
+			if err := json.Unmarshal(msg.Body, &event); err != nil {
+				log.Printf("Failed to unmarshal message: %v", err)
+				msg.Nack(false, false) // Don't requeue
+				continue
+			}
+
+			log.Printf("Received %s event: %+v", msg.RoutingKey, event)
+
+			// Give back stock for the order (compensation transaction)
+			if err := c.inventoryService.CompensateOrder(event.OrderID, msg.RoutingKey+": "+event.Reason); err != nil {
+				log.Printf("Failed to compensate order %s: %v", event.OrderID, err)
+				msg.Nack(false, true) // Requeue
+				continue
+			}
+
+			// Acknowledge the message
+			msg.Ack(false)
+		}
+	}()
+
+	log.Println("Compensation consumer started, waiting for order.cancelled and order.timed_out messages...")
+	return nil
+}
+
+func (c *CompensationConsumer) Close() {
+	if c.channel != nil {
+		c.channel.Close()
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
@@ -5,29 +5,67 @@ import (
 
 	"log"
 
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
 	"github.com/streadway/amqp"
 )
 
 // OrderProcessor defines the interface for processing orders
 type OrderProcessor interface {
-	ProcessOrder(orderID, itemID string, quantity int, userEmail string)
+	ProcessOrder(orderID, itemID string, quantity int, userEmail, shipToRegion string, saga SagaContext)
+	ProcessOrderLines(orderID string, lines []models.OrderLine, userEmail, shipToRegion string, saga SagaContext)
+}
+
+// ReservationProcessor defines the interface for the inventory-first saga,
+// where stock is held before payment and deducted or released afterwards
+type ReservationProcessor interface {
+	OrderProcessor
+	ReserveOrder(orderID, itemID string, quantity int, userEmail, shipToRegion string, totalMinor int64, currency string, saga SagaContext)
+	CommitOrder(orderID, itemID string, quantity int, userEmail string, saga SagaContext)
+	ReleaseOrder(orderID, itemID string, quantity int, reason string)
+	ReserveOrderLines(orderID string, lines []models.OrderLine, userEmail, shipToRegion string, totalMinor int64, currency string, saga SagaContext)
+	CommitOrderLines(orderID string, lines []models.OrderLine, userEmail string, saga SagaContext)
+	ReleaseOrderLines(orderID string, lines []models.OrderLine, reason string)
 }
 
 type Consumer struct {
 	conn             *amqp.Connection
 	channel          *amqp.Channel
-	inventoryService OrderProcessor
+	inventoryService ReservationProcessor
 }
 
 type PaymentProcessedEvent struct {
-	OrderID   string  `json:"order_id"`
-	ItemID    string  `json:"item_id"`
-	Quantity  int     `json:"quantity"`
-	UserEmail string  `json:"user_email"`
-	Amount    float64 `json:"amount"`
+	OrderID      string `json:"order_id"`
+	ItemID       string `json:"item_id"`
+	Quantity     int    `json:"quantity"`
+	UserEmail    string `json:"user_email"`
+	ShipToRegion string `json:"ship_to_region"`
+	AmountMinor  int64  `json:"amount_minor"`
+	Currency     string `json:"currency"`
+	// Items, when present, are the lines of a multi-line order and
+	// replace ItemID and Quantity
+	Items []models.OrderLine `json:"items"`
+}
+
+type OrderCreatedEvent struct {
+	OrderID      string             `json:"order_id"`
+	ItemID       string             `json:"item_id"`
+	Quantity     int                `json:"quantity"`
+	UserEmail    string             `json:"user_email"`
+	ShipToRegion string             `json:"ship_to_region"`
+	TotalMinor   int64              `json:"total_minor"`
+	Currency     string             `json:"currency"`
+	Items        []models.OrderLine `json:"items"`
 }
 
-func NewConsumer(rabbitMQURL string, inventoryService OrderProcessor) (*Consumer, error) {
+type PaymentFailedEvent struct {
+	OrderID  string             `json:"order_id"`
+	ItemID   string             `json:"item_id"`
+	Quantity int                `json:"quantity"`
+	Reason   string             `json:"reason"`
+	Items    []models.OrderLine `json:"items"`
+}
+
+func NewConsumer(rabbitMQURL string, inventoryService ReservationProcessor) (*Consumer, error) {
 	conn, err := amqp.Dial(rabbitMQURL)
 	if err != nil {
 		return nil, err
@@ -70,10 +108,42 @@ func NewConsumer(rabbitMQURL string, inventoryService OrderProcessor) (*Consumer
 		return nil, err
 	}
 
-	// Bind queue to exchange
+	// Bind queue to exchange: payment-first orders are deducted once their
+	// payment is authorized, inventory-first orders once it is taken
+	for _, routingKey := range []string{"payment.successful", "payment.authorized"} {
+		err = channel.QueueBind(
+			queue.Name,
+			routingKey,
+			"payments",
+			false,
+			nil,
+		)
+		if err != nil {
+			channel.Close()
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	// Declare queue for payment.failed events (inventory-first sagas)
+	paymentFailedQueue, err := channel.QueueDeclare(
+		"payment.failed.inventory.queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Bind payment failed queue to exchange
 	err = channel.QueueBind(
-		queue.Name,
-		"payment.successful",
+		paymentFailedQueue.Name,
+		"payment.failed",
 		"payments",
 		false,
 		nil,
@@ -84,6 +154,51 @@ func NewConsumer(rabbitMQURL string, inventoryService OrderProcessor) (*Consumer
 		return nil, err
 	}
 
+	// Declare orders exchange
+	err = channel.ExchangeDeclare(
+		"orders",
+		"topic",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare queue for order.created events (inventory-first sagas)
+	orderCreatedQueue, err := channel.QueueDeclare(
+		"order.created.inventory.queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Bind order created queue to exchange
+	err = channel.QueueBind(
+		orderCreatedQueue.Name,
+		"order.created",
+		"orders",
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
 	log.Println("RabbitMQ consumer initialized successfully")
 
 	return &Consumer{
@@ -107,6 +222,33 @@ func (c *Consumer) Start() error {
 		return err
 	}
 
+	orderCreatedMsgs, err := c.channel.Consume(
+		"order.created.inventory.queue",
+		"",
+		false, // manual ack
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	paymentFailedMsgs, err := c.channel.Consume(
+		"payment.failed.inventory.queue",
+		"",
+		false, // manual ack
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Handle payment.successful and payment.authorized events
 	go func() {
 		for msg := range msgs {
 			var event PaymentProcessedEvent
@@ -116,10 +258,88 @@ func (c *Consumer) Start() error {
 				continue
 			}
 
-			log.Printf("Received payment.successful event: %+v", event)
+			// Orchestrated orders reserve stock on an inventory.reserve command
+			saga := sagaContext(msg)
+			if saga.Orchestrated() {
+				msg.Ack(false)
+				continue
+			}
 
-			// Process the order (reserve inventory)
-			c.inventoryService.ProcessOrder(event.OrderID, event.ItemID, event.Quantity, event.UserEmail)
+			log.Printf("Received %s event: %+v", msg.RoutingKey, event)
+
+			switch {
+			case saga.InventoryFirst() && len(event.Items) > 0:
+				c.inventoryService.CommitOrderLines(event.OrderID, event.Items, event.UserEmail, saga)
+			case saga.InventoryFirst():
+				// Deduct the stock reserved before payment
+				c.inventoryService.CommitOrder(event.OrderID, event.ItemID, event.Quantity, event.UserEmail, saga)
+			case len(event.Items) > 0:
+				// Reserve all lines or none
+				c.inventoryService.ProcessOrderLines(event.OrderID, event.Items, event.UserEmail, event.ShipToRegion, saga)
+			default:
+				// Process the order (reserve inventory)
+				c.inventoryService.ProcessOrder(event.OrderID, event.ItemID, event.Quantity, event.UserEmail, event.ShipToRegion, saga)
+			}
+
+			// Acknowledge the message
+			msg.Ack(false)
+		}
+	}()
+
+	// Handle order.created events (reserve stock before payment)
+	go func() {
+		for msg := range orderCreatedMsgs {
+			var event OrderCreatedEvent
+			if err := json.Unmarshal(msg.Body, &event); err != nil {
+				log.Printf("Failed to unmarshal message: %v", err)
+				msg.Nack(false, false) // Don't requeue
+				continue
+			}
+
+			// Payment-first orders reach inventory through payment.authorized
+			saga := sagaContext(msg)
+			if saga.Orchestrated() || !saga.InventoryFirst() {
+				msg.Ack(false)
+				continue
+			}
+
+			log.Printf("Received order.created event: %+v", event)
+
+			if len(event.Items) > 0 {
+				c.inventoryService.ReserveOrderLines(event.OrderID, event.Items, event.UserEmail, event.ShipToRegion, event.TotalMinor, event.Currency, saga)
+			} else {
+				c.inventoryService.ReserveOrder(event.OrderID, event.ItemID, event.Quantity, event.UserEmail, event.ShipToRegion, event.TotalMinor, event.Currency, saga)
+			}
+
+			// Acknowledge the message
+			msg.Ack(false)
+		}
+	}()
+
+	// Handle payment.failed events (release stock reserved before payment)
+	go func() {
+		for msg := range paymentFailedMsgs {
+			var event PaymentFailedEvent
+			if err := json.Unmarshal(msg.Body, &event); err != nil {
+				log.Printf("Failed to unmarshal message: %v", err)
+				msg.Nack(false, false) // Don't requeue
+				continue
+			}
+
+			// Payment-first orders hold no stock when payment fails
+			saga := sagaContext(msg)
+			if saga.Orchestrated() || !saga.InventoryFirst() {
+				msg.Ack(false)
+				continue
+			}
+
+			log.Printf("Received payment.failed event: %+v", event)
+
+			if len(event.Items) > 0 {
+				c.inventoryService.ReleaseOrderLines(event.OrderID, event.Items, event.Reason)
+			} else {
+				c.inventoryService.ReleaseOrder(event.OrderID, event.ItemID, event.Quantity, event.Reason)
+			}
 
 			// Acknowledge the message
 			msg.Ack(false)
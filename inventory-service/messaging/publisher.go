@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 
+	"github.com/google/uuid"
 	"github.com/streadway/amqp"
 )
 
@@ -48,7 +49,7 @@ func NewPublisher(rabbitMQURL string) (*Publisher, error) {
 	}, nil
 }
 
-func (p *Publisher) PublishInventoryProcessed(event interface{}) error {
+func (p *Publisher) PublishInventoryProcessed(event interface{}, saga SagaContext) error {
 	body, err := json.Marshal(event)
 	if err != nil {
 		return err
@@ -63,6 +64,8 @@ func (p *Publisher) PublishInventoryProcessed(event interface{}) error {
 			ContentType:  "application/json",
 			Body:         body,
 			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      saga.headers(),
 		},
 	)
 
@@ -74,7 +77,7 @@ func (p *Publisher) PublishInventoryProcessed(event interface{}) error {
 	return nil
 }
 
-func (p *Publisher) PublishInventoryFailed(event interface{}) error {
+func (p *Publisher) PublishInventoryFailed(event interface{}, saga SagaContext) error {
 	body, err := json.Marshal(event)
 	if err != nil {
 		return err
@@ -89,6 +92,8 @@ func (p *Publisher) PublishInventoryFailed(event interface{}) error {
 			ContentType:  "application/json",
 			Body:         body,
 			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      saga.headers(),
 		},
 	)
 
@@ -100,7 +105,7 @@ func (p *Publisher) PublishInventoryFailed(event interface{}) error {
 	return nil
 }
 
-func (p *Publisher) PublishInventorySuccessful(event interface{}) error {
+func (p *Publisher) PublishInventorySuccessful(event interface{}, saga SagaContext) error {
 	body, err := json.Marshal(event)
 	if err != nil {
 		return err
@@ -115,6 +120,8 @@ func (p *Publisher) PublishInventorySuccessful(event interface{}) error {
 			ContentType:  "application/json",
 			Body:         body,
 			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      saga.headers(),
 		},
 	)
 
@@ -126,6 +133,156 @@ func (p *Publisher) PublishInventorySuccessful(event interface{}) error {
 	return nil
 }
 
+func (p *Publisher) PublishInventoryReserved(event interface{}, saga SagaContext) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = p.channel.Publish(
+		"inventory",
+		"inventory.reserved",
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      saga.headers(),
+		},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published inventory.reserved event: %s", string(body))
+	return nil
+}
+
+func (p *Publisher) PublishInventoryReleased(event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = p.channel.Publish(
+		"inventory",
+		"inventory.released",
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+		},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published inventory.released event: %s", string(body))
+	return nil
+}
+
+func (p *Publisher) PublishInventoryBackordered(event interface{}, saga SagaContext) error {
+	return p.publishSagaEvent("inventory.backordered", event, saga)
+}
+
+func (p *Publisher) PublishBackorderFilled(event interface{}, saga SagaContext) error {
+	return p.publishSagaEvent("inventory.backorder_filled", event, saga)
+}
+
+func (p *Publisher) PublishBackorderExpired(event interface{}, saga SagaContext) error {
+	return p.publishSagaEvent("inventory.backorder_expired", event, saga)
+}
+
+func (p *Publisher) PublishBackorderCancelled(event interface{}, saga SagaContext) error {
+	return p.publishSagaEvent("inventory.backorder_cancelled", event, saga)
+}
+
+func (p *Publisher) publishSagaEvent(routingKey string, event interface{}, saga SagaContext) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = p.channel.Publish(
+		"inventory",
+		routingKey,
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      saga.headers(),
+		},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published %s event: %s", routingKey, string(body))
+	return nil
+}
+
+func (p *Publisher) PublishProductCreated(event interface{}) error {
+	return p.publishProductEvent("product.created", event)
+}
+
+func (p *Publisher) PublishProductUpdated(event interface{}) error {
+	return p.publishProductEvent("product.updated", event)
+}
+
+func (p *Publisher) PublishProductStockChanged(event interface{}) error {
+	return p.publishProductEvent("product.stock_changed", event)
+}
+
+func (p *Publisher) PublishLowStock(event interface{}) error {
+	return p.publishProductEvent("inventory.low_stock", event)
+}
+
+func (p *Publisher) PublishOutOfStock(event interface{}) error {
+	return p.publishProductEvent("inventory.out_of_stock", event)
+}
+
+func (p *Publisher) PublishRestocked(event interface{}) error {
+	return p.publishProductEvent("inventory.restocked", event)
+}
+
+func (p *Publisher) publishProductEvent(routingKey string, event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = p.channel.Publish(
+		"inventory",
+		routingKey,
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+		},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published %s event: %s", routingKey, string(body))
+	return nil
+}
+
 func (p *Publisher) Close() {
 	if p.channel != nil {
 		p.channel.Close()
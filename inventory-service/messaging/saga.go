@@ -0,0 +1,71 @@
+package messaging
+
+import "github.com/streadway/amqp"
+
+// Every message of a saga carries how that saga is run in headers, so
+// consumers can tell which flow a message belongs to and services can run
+// several flows side by side (e.g. while switching configuration).
+const (
+	// Messages of orchestrated sagas are skipped by choreography consumers
+	SagaModeHeader        = "x-saga-mode"
+	SagaModeChoreography  = "choreography"
+	SagaModeOrchestration = "orchestration"
+
+	// Choreographed sagas either charge payment before reserving stock or
+	// reserve stock first and charge only once it is held
+	SagaOrderHeader         = "x-saga-order"
+	SagaOrderPaymentFirst   = "payment_first"
+	SagaOrderInventoryFirst = "inventory_first"
+)
+
+// SagaContext identifies the saga flow a message belongs to
+type SagaContext struct {
+	Mode  string
+	Order string
+}
+
+// Choreography is the context of the original payment-first flow, used for
+// messages without saga headers
+var Choreography = SagaContext{Mode: SagaModeChoreography, Order: SagaOrderPaymentFirst}
+
+// Orchestration is the context of sagas driven by the order service's
+// orchestrator
+var Orchestration = SagaContext{Mode: SagaModeOrchestration, Order: SagaOrderPaymentFirst}
+
+// sagaContext returns the saga context a delivery belongs to
+func sagaContext(msg amqp.Delivery) SagaContext {
+	saga := Choreography
+	if mode, ok := msg.Headers[SagaModeHeader].(string); ok && mode != "" {
+		saga.Mode = mode
+	}
+	if order, ok := msg.Headers[SagaOrderHeader].(string); ok && order != "" {
+		saga.Order = order
+	}
+	return saga
+}
+
+// Orchestrated reports whether the saga is driven by the orchestrator
+func (s SagaContext) Orchestrated() bool {
+	return s.Mode == SagaModeOrchestration
+}
+
+// InventoryFirst reports whether the saga reserves stock before charging
+func (s SagaContext) InventoryFirst() bool {
+	return s.Order == SagaOrderInventoryFirst
+}
+
+// headers returns the headers to publish a message of the saga with. The
+// default flow is sent without headers, as before sagas were configurable.
+func (s SagaContext) headers() amqp.Table {
+	headers := amqp.Table{}
+	if s.Mode != "" && s.Mode != SagaModeChoreography {
+		headers[SagaModeHeader] = s.Mode
+	}
+	if s.Order != "" && s.Order != SagaOrderPaymentFirst {
+		headers[SagaOrderHeader] = s.Order
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return headers
+}
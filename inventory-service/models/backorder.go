@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// Backorder states. WAITING orders are queued for stock in the order they
+// were placed; the other states are final.
+const (
+	BackorderWaiting   = "WAITING"
+	BackorderFilled    = "FILLED"
+	BackorderExpired   = "EXPIRED"
+	BackorderCancelled = "CANCELLED"
+)
+
+// Backorder is an order for a product that allows backorders, held because
+// there was not enough stock when it was placed. It keeps what is needed to
+// carry on with the order's saga once the stock arrives.
+type Backorder struct {
+	ID           int64     `json:"id" db:"id"`
+	OrderID      string    `json:"order_id" db:"order_id"`
+	ProductID    string    `json:"product_id" db:"product_id"`
+	Quantity     int       `json:"quantity" db:"quantity"`
+	UserEmail    string    `json:"user_email" db:"user_email"`
+	ShipToRegion string    `json:"ship_to_region,omitempty" db:"ship_to_region"`
+	TotalMinor   int64     `json:"total_minor,omitempty" db:"total_minor"`
+	Currency     string    `json:"currency,omitempty" db:"currency"`
+	SagaMode     string    `json:"saga_mode" db:"saga_mode"`
+	SagaOrder    string    `json:"saga_order" db:"saga_order"`
+	State        string    `json:"state" db:"state"`
+	ExpiresAt    time.Time `json:"expires_at" db:"expires_at"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// BackorderFilter narrows a backorder listing
+type BackorderFilter struct {
+	ProductID string `form:"product_id"`
+	State     string `form:"state" binding:"omitempty,oneof=WAITING FILLED EXPIRED CANCELLED"`
+}
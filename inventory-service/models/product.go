@@ -1,18 +1,198 @@
 package models
 
-import "time"
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
 
+// Product stock and reserved are totals over the product's stock levels in
+// all warehouses. StockAlert is the last stock alert level reported for the
+// product, compared with ReorderThreshold. Orders for a product that allows
+// backorders wait for stock instead of failing when it runs short. Version
+// goes up with every change to the product, so clients can tell whether it
+// changed since they read it.
+//
+// A variant is a product of its own, one SKU for a combination of
+// Attributes of its parent (e.g. size and colour), with its own stock and
+// price. A parent with variants holds no stock and cannot be ordered; orders
+// name the variant's ID.
 type Product struct {
-	ID        string    `json:"id" db:"id"`
-	Name      string    `json:"name" db:"name"`
-	Stock     int       `json:"stock" db:"stock"`
-	Reserved  int       `json:"reserved" db:"reserved"`
+	ID               string     `json:"id" db:"id"`
+	Name             string     `json:"name" db:"name"`
+	Stock            int        `json:"stock" db:"stock"`
+	Reserved         int        `json:"reserved" db:"reserved"`
+	PriceMinor       int64      `json:"price_minor" db:"price_minor"` // unit price in minor currency units (cents)
+	Currency         string     `json:"currency" db:"currency"`
+	ReorderThreshold int        `json:"reorder_threshold" db:"reorder_threshold"`
+	StockAlert       string     `json:"stock_alert" db:"stock_alert"`
+	AllowBackorder   bool       `json:"allow_backorder" db:"allow_backorder"`
+	Version          int64      `json:"version" db:"version"`
+	ParentID         string     `json:"parent_id,omitempty" db:"parent_id"`
+	Attributes       Attributes `json:"attributes,omitempty" db:"attributes"`
+	CreatedAt        time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// Attributes are the options that tell a product's variants apart, e.g.
+// {"size": "M", "colour": "red"}. They are stored as JSONB.
+type Attributes map[string]string
+
+func (a Attributes) Value() (driver.Value, error) {
+	if a == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(a)
+}
+
+func (a *Attributes) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*a = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, a)
+	case string:
+		return json.Unmarshal([]byte(v), a)
+	default:
+		return fmt.Errorf("cannot scan %T into Attributes", src)
+	}
+}
+
+// Stock alert levels. A product is LOW once its available stock (stock -
+// reserved) is at or below its reorder threshold, and OUT once nothing is
+// available.
+const (
+	StockAlertOK  = "OK"
+	StockAlertLow = "LOW"
+	StockAlertOut = "OUT"
+)
+
+// StockAlert is a change of a product's stock alert level
+type StockAlert struct {
+	ProductID        string
+	Name             string
+	From             string
+	To               string
+	Stock            int
+	Reserved         int
+	ReorderThreshold int
+}
+
+type CreateProductRequest struct {
+	ID         string `json:"id" binding:"required,max=255"`
+	Name       string `json:"name" binding:"required,max=255"`
+	Stock      int    `json:"stock" binding:"min=0"`
+	PriceMinor int64  `json:"price_minor" binding:"required,min=1"`
+	Currency   string `json:"currency" binding:"required,len=3,uppercase"`
+	// WarehouseID is where the initial stock is held (default: main)
+	WarehouseID      string `json:"warehouse_id" binding:"omitempty,max=255"`
+	ReorderThreshold int    `json:"reorder_threshold" binding:"min=0"`
+	AllowBackorder   bool   `json:"allow_backorder"`
+	// ParentID makes the product a variant of another product, told apart
+	// from its siblings by Attributes
+	ParentID   string     `json:"parent_id" binding:"omitempty,max=255"`
+	Attributes Attributes `json:"attributes" binding:"omitempty,max=10,dive,keys,required,max=50,endkeys,required,max=255"`
+}
+
+type UpdateProductRequest struct {
+	Name       string `json:"name" binding:"required,max=255"`
+	PriceMinor int64  `json:"price_minor" binding:"required,min=1"`
+	Currency   string `json:"currency" binding:"required,len=3,uppercase"`
+	// ReorderThreshold is left unchanged when omitted
+	ReorderThreshold *int `json:"reorder_threshold" binding:"omitempty,min=0"`
+	// AllowBackorder is left unchanged when omitted
+	AllowBackorder *bool `json:"allow_backorder"`
+	// Version, if given, must be the product's current version for the
+	// update to apply
+	Version *int64 `json:"version" binding:"omitempty,min=1"`
+}
+
+// AdjustStockRequest changes on-hand stock in a warehouse (default: main) by
+// Delta units (negative to remove stock, e.g. for damaged goods)
+type AdjustStockRequest struct {
+	Delta       int    `json:"delta" binding:"required"`
+	Reason      string `json:"reason" binding:"required,max=255"`
+	WarehouseID string `json:"warehouse_id" binding:"omitempty,max=255"`
+}
+
+// Reservation states. RESERVED holds stock in the reserved count of the
+// allocated warehouses; the other states are final and hold nothing.
+const (
+	ReservationReserved  = "RESERVED"
+	ReservationCommitted = "COMMITTED"
+	ReservationReleased  = "RELEASED"
+	ReservationExpired   = "EXPIRED"
+)
+
+// StockReservation is stock held for an order until it is committed (deducted
+// from stock), released, or expires. Allocations say which warehouses hold it.
+type StockReservation struct {
+	ID        int64     `json:"id" db:"id"`
+	OrderID   string    `json:"order_id" db:"order_id"`
+	ProductID string    `json:"product_id" db:"product_id"`
+	Quantity  int       `json:"quantity" db:"quantity"`
+	State     string    `json:"state" db:"state"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+
+	Allocations []Allocation `json:"allocations,omitempty"`
 }
 
-type StockReservation struct {
-	ProductID string
-	Quantity  int
-	OrderID   string
+// OrderLine is one item of a multi-line order
+type OrderLine struct {
+	ItemID   string `json:"item_id"`
+	Quantity int    `json:"quantity"`
+}
+
+// LineFailure says why one line of a multi-line order could not be reserved.
+// Line is the line's 1-based position in the order.
+type LineFailure struct {
+	Line     int    `json:"line"`
+	ItemID   string `json:"item_id"`
+	Quantity int    `json:"quantity"`
+	Reason   string `json:"reason"`
+}
+
+// ReleasedStock is stock given back for a cancelled order. Restocked is true
+// if the stock had already been deducted and was added back to stock, false
+// if a reservation was released from reserved.
+type ReleasedStock struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+	Restocked bool   `json:"restocked"`
+}
+
+// ProductEvent is a snapshot of a product published on product.* events so
+// other services can keep a local read model of the catalog
+type ProductEvent struct {
+	ProductID      string     `json:"product_id"`
+	Name           string     `json:"name"`
+	Stock          int        `json:"stock"`
+	Reserved       int        `json:"reserved"`
+	PriceMinor     int64      `json:"price_minor"`
+	Currency       string     `json:"currency"`
+	AllowBackorder bool       `json:"allow_backorder"`
+	Version        int64      `json:"version"`
+	ParentID       string     `json:"parent_id,omitempty"`
+	Attributes     Attributes `json:"attributes,omitempty"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	OccurredAt     time.Time  `json:"occurred_at"`
+}
+
+// StockAlertEvent is published as inventory.low_stock, inventory.out_of_stock
+// or inventory.restocked when a product's available stock crosses its reorder
+// threshold or runs out
+type StockAlertEvent struct {
+	ProductID        string    `json:"product_id"`
+	Name             string    `json:"name"`
+	Stock            int       `json:"stock"`
+	Reserved         int       `json:"reserved"`
+	Available        int       `json:"available"`
+	ReorderThreshold int       `json:"reorder_threshold"`
+	PreviousLevel    string    `json:"previous_level"`
+	Level            string    `json:"level"`
+	OccurredAt       time.Time `json:"occurred_at"`
 }
@@ -0,0 +1,37 @@
+package models
+
+// ProductImportRow is one parsed line of a product CSV import
+type ProductImportRow struct {
+	Line        int
+	ID          string
+	Name        string
+	WarehouseID string
+	Stock       int
+	PriceMinor  int64
+	Currency    string
+}
+
+// ImportRowError reports why one line of an import was rejected
+type ImportRowError struct {
+	Line      int    `json:"line"`
+	ProductID string `json:"product_id,omitempty"`
+	Error     string `json:"error"`
+}
+
+// ImportResult summarizes a product import. In a dry run nothing is written
+// and the counts show what the import would have done.
+type ImportResult struct {
+	DryRun    bool             `json:"dry_run"`
+	Rows      int              `json:"rows"`
+	Created   int              `json:"created"`
+	Updated   int              `json:"updated"`
+	Unchanged int              `json:"unchanged"`
+	Failed    int              `json:"failed"`
+	Errors    []ImportRowError `json:"errors"`
+}
+
+// AddError records a rejected line
+func (r *ImportResult) AddError(line int, productID, message string) {
+	r.Failed++
+	r.Errors = append(r.Errors, ImportRowError{Line: line, ProductID: productID, Error: message})
+}
@@ -0,0 +1,65 @@
+package models
+
+import "time"
+
+// Stock movement types. Receipts and adjustments change on-hand stock,
+// reserves and releases change reserved stock, and a deduct takes reserved
+// stock off both.
+const (
+	MovementReceipt = "receipt"
+	MovementReserve = "reserve"
+	MovementRelease = "release"
+	MovementDeduct  = "deduct"
+	MovementAdjust  = "adjust"
+)
+
+// Actors recorded on stock movements that are not made through the API
+const (
+	ActorSaga       = "saga"
+	ActorSweeper    = "reservation-sweeper"
+	ActorCompensate = "compensation"
+	ActorCLI        = "cli"
+)
+
+// StockMovement is one entry in the append-only ledger of stock changes.
+// Quantity is positive except for adjustments, which may remove stock.
+type StockMovement struct {
+	ID          int64     `json:"id" db:"id"`
+	ProductID   string    `json:"product_id" db:"product_id"`
+	WarehouseID string    `json:"warehouse_id" db:"warehouse_id"`
+	Type        string    `json:"type" db:"type"`
+	Quantity    int       `json:"quantity" db:"quantity"`
+	OrderID     string    `json:"order_id,omitempty" db:"order_id"`
+	Actor       string    `json:"actor" db:"actor"`
+	Reason      string    `json:"reason,omitempty" db:"reason"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+// StockMovementFilter selects ledger entries, newest first. Empty fields
+// match everything; BeforeID pages back from a previous result.
+type StockMovementFilter struct {
+	ProductID   string `form:"product_id"`
+	WarehouseID string `form:"warehouse_id"`
+	OrderID     string `form:"order_id"`
+	Type        string `form:"type" binding:"omitempty,oneof=receipt reserve release deduct adjust"`
+	BeforeID    int64  `form:"before_id" binding:"min=0"`
+	Limit       int    `form:"limit" binding:"min=0,max=1000"`
+}
+
+// LedgerMismatch is a stock counter that does not match the ledger. An empty
+// WarehouseID means the product's totals in products.
+type LedgerMismatch struct {
+	ProductID      string `json:"product_id"`
+	WarehouseID    string `json:"warehouse_id,omitempty"`
+	Stock          int    `json:"stock"`
+	Reserved       int    `json:"reserved"`
+	LedgerStock    int    `json:"ledger_stock"`
+	LedgerReserved int    `json:"ledger_reserved"`
+}
+
+// LedgerCheck is the result of recomputing stock counters from the ledger
+type LedgerCheck struct {
+	Consistent bool             `json:"consistent"`
+	Mismatches []LedgerMismatch `json:"mismatches"`
+	CheckedAt  time.Time        `json:"checked_at"`
+}
@@ -0,0 +1,47 @@
+package models
+
+import "time"
+
+// DefaultWarehouseID is the warehouse stock is put in when no warehouse is
+// given, e.g. for products created through the API
+const DefaultWarehouseID = "main"
+
+// Warehouse is a location stock is held and shipped from. Lower Priority
+// values are preferred by the priority allocation strategy.
+type Warehouse struct {
+	ID        string    `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	Region    string    `json:"region" db:"region"`
+	Priority  int       `json:"priority" db:"priority"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+type CreateWarehouseRequest struct {
+	ID       string `json:"id" binding:"required,max=255"`
+	Name     string `json:"name" binding:"required,max=255"`
+	Region   string `json:"region" binding:"required,max=50"`
+	Priority int    `json:"priority" binding:"min=0"`
+}
+
+// StockLevel is a product's stock in one warehouse. products.stock and
+// products.reserved are the totals over all of a product's stock levels.
+type StockLevel struct {
+	ProductID   string    `json:"product_id" db:"product_id"`
+	WarehouseID string    `json:"warehouse_id" db:"warehouse_id"`
+	Region      string    `json:"region" db:"region"`
+	Priority    int       `json:"priority" db:"priority"`
+	Stock       int       `json:"stock" db:"stock"`
+	Reserved    int       `json:"reserved" db:"reserved"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Available is the stock that can still be reserved
+func (l StockLevel) Available() int {
+	return l.Stock - l.Reserved
+}
+
+// Allocation is the part of a reservation held in one warehouse
+type Allocation struct {
+	WarehouseID string `json:"warehouse_id"`
+	Quantity    int    `json:"quantity"`
+}
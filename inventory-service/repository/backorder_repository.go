@@ -0,0 +1,244 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
+)
+
+// backorderColumns are the columns scanned by scanBackorders, in order
+const backorderColumns = `id, order_id, product_id, quantity, user_email, ship_to_region, total_minor, currency,
+	saga_mode, saga_order, state, expires_at, created_at, updated_at`
+
+// BackorderRepository queues orders for products that allow backorders when
+// there is not enough stock. Each product's queue is filled first come, first
+// served.
+type BackorderRepository struct {
+	db *sql.DB
+}
+
+func NewBackorderRepository(db *sql.DB) *BackorderRepository {
+	return &BackorderRepository{db: db}
+}
+
+// Queue reports whether a product allows backorders and whether orders are
+// already waiting for it
+func (r *BackorderRepository) Queue(productID string) (allowed, waiting bool, err error) {
+	query := `
+		SELECT p.allow_backorder,
+			EXISTS (SELECT 1 FROM backorders b WHERE b.product_id = p.id AND b.state = $2)
+		FROM products p
+		WHERE p.id = $1
+	`
+
+	err = r.db.QueryRow(query, productID, models.BackorderWaiting).Scan(&allowed, &waiting)
+	if err == sql.ErrNoRows {
+		return false, false, ErrProductNotFound
+	}
+	return allowed, waiting, err
+}
+
+// Hold puts an order at the back of its product's queue for at most wait. It
+// reports whether the order was queued; an order that is already queued is
+// left where it is. Orders that were cancelled or already have a reservation
+// for the product cannot be queued.
+func (r *BackorderRepository) Hold(backorder *models.Backorder, wait time.Duration) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	cancelled, err := lockOrder(tx, backorder.OrderID)
+	if err != nil {
+		return false, err
+	}
+	if cancelled {
+		return false, ErrOrderCancelled
+	}
+
+	var reserved bool
+	reservedQuery := `
+		SELECT EXISTS (SELECT 1 FROM reservations WHERE order_id = $1 AND product_id = $2)
+	`
+
+	if err := tx.QueryRow(reservedQuery, backorder.OrderID, backorder.ProductID).Scan(&reserved); err != nil {
+		return false, err
+	}
+	if reserved {
+		return false, ErrReservationExists
+	}
+
+	now := time.Now()
+	backorder.State = models.BackorderWaiting
+	backorder.ExpiresAt = now.Add(wait)
+	backorder.CreatedAt = now
+	backorder.UpdatedAt = now
+
+	insertQuery := `
+		INSERT INTO backorders (order_id, product_id, quantity, user_email, ship_to_region, total_minor, currency,
+			saga_mode, saga_order, state, expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $12)
+		ON CONFLICT (order_id, product_id) DO NOTHING
+		RETURNING id
+	`
+
+	err = tx.QueryRow(insertQuery,
+		backorder.OrderID,
+		backorder.ProductID,
+		backorder.Quantity,
+		backorder.UserEmail,
+		backorder.ShipToRegion,
+		backorder.TotalMinor,
+		backorder.Currency,
+		backorder.SagaMode,
+		backorder.SagaOrder,
+		backorder.State,
+		backorder.ExpiresAt,
+		now,
+	).Scan(&backorder.ID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// Next returns the oldest order waiting for a product, or nil if none is
+func (r *BackorderRepository) Next(productID string) (*models.Backorder, error) {
+	query := `
+		SELECT ` + backorderColumns + `
+		FROM backorders
+		WHERE product_id = $1 AND state = $2
+		ORDER BY id
+		LIMIT 1
+	`
+
+	rows, err := r.db.Query(query, productID, models.BackorderWaiting)
+	if err != nil {
+		return nil, err
+	}
+
+	backorders, err := scanBackorders(rows)
+	if err != nil || len(backorders) == 0 {
+		return nil, err
+	}
+
+	return &backorders[0], nil
+}
+
+// Resolve moves a waiting backorder to a final state. It reports whether it
+// did; a backorder that was filled, expired or cancelled in the meantime is
+// left alone.
+func (r *BackorderRepository) Resolve(id int64, state string) (bool, error) {
+	query := `
+		UPDATE backorders
+		SET state = $1, updated_at = $2
+		WHERE id = $3 AND state = $4
+	`
+
+	result, err := r.db.Exec(query, state, time.Now(), id, models.BackorderWaiting)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// CancelOrder cancels the backorders still waiting for an order and returns
+// them
+func (r *BackorderRepository) CancelOrder(orderID string) ([]models.Backorder, error) {
+	query := `
+		UPDATE backorders
+		SET state = $1, updated_at = $2
+		WHERE order_id = $3 AND state = $4
+		RETURNING ` + backorderColumns
+
+	rows, err := r.db.Query(query, models.BackorderCancelled, time.Now(), orderID, models.BackorderWaiting)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanBackorders(rows)
+}
+
+// ExpireOverdue expires up to limit backorders that waited past their
+// deadline before now and returns them
+func (r *BackorderRepository) ExpireOverdue(now time.Time, limit int) ([]models.Backorder, error) {
+	query := `
+		UPDATE backorders
+		SET state = $1, updated_at = $2
+		WHERE id IN (
+			SELECT id
+			FROM backorders
+			WHERE state = $3 AND expires_at < $2
+			ORDER BY expires_at
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + backorderColumns
+
+	rows, err := r.db.Query(query, models.BackorderExpired, now, models.BackorderWaiting, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanBackorders(rows)
+}
+
+// ListBackorders returns backorders matching filter in queue order
+func (r *BackorderRepository) ListBackorders(filter models.BackorderFilter) ([]models.Backorder, error) {
+	query := `
+		SELECT ` + backorderColumns + `
+		FROM backorders
+		WHERE ($1 = '' OR product_id = $1) AND ($2 = '' OR state = $2)
+		ORDER BY id
+	`
+
+	rows, err := r.db.Query(query, filter.ProductID, filter.State)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanBackorders(rows)
+}
+
+// scanBackorders reads and closes rows of backorderColumns
+func scanBackorders(rows *sql.Rows) ([]models.Backorder, error) {
+	defer rows.Close()
+
+	backorders := []models.Backorder{}
+	for rows.Next() {
+		var backorder models.Backorder
+		if err := rows.Scan(
+			&backorder.ID,
+			&backorder.OrderID,
+			&backorder.ProductID,
+			&backorder.Quantity,
+			&backorder.UserEmail,
+			&backorder.ShipToRegion,
+			&backorder.TotalMinor,
+			&backorder.Currency,
+			&backorder.SagaMode,
+			&backorder.SagaOrder,
+			&backorder.State,
+			&backorder.ExpiresAt,
+			&backorder.CreatedAt,
+			&backorder.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		backorders = append(backorders, backorder)
+	}
+
+	return backorders, rows.Err()
+}
@@ -3,12 +3,24 @@ package repository
 import (
 	"database/sql"
 	"errors"
-
+	"fmt"
 	"time"
 
 	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
 )
 
+var (
+	ErrProductNotFound   = errors.New("product not found")
+	ErrProductExists     = errors.New("product already exists")
+	ErrInsufficientStock = errors.New("insufficient stock")
+	ErrVersionConflict   = errors.New("product was changed by someone else")
+	ErrParentNotFound    = errors.New("parent product not found")
+	ErrInvalidParent     = errors.New("parent must be a product without stock that is not itself a variant")
+	ErrInvalidVariant    = errors.New("a variant needs both a parent and attributes")
+	ErrVariantExists     = errors.New("a variant with these attributes already exists")
+	ErrVariantRequired   = errors.New("product has variants; use one of its SKUs")
+)
+
 type InventoryRepository struct {
 	db *sql.DB
 }
@@ -21,7 +33,7 @@ func (r *InventoryRepository) GetProduct(productID string) (*models.Product, err
 	product := &models.Product{}
 
 	query := `
-		SELECT id, name, stock, reserved, created_at, updated_at
+		SELECT id, name, stock, reserved, price_minor, currency, reorder_threshold, stock_alert, allow_backorder, version, COALESCE(parent_id, ''), attributes, created_at, updated_at
 		FROM products
 		WHERE id = $1
 	`
@@ -31,6 +43,14 @@ func (r *InventoryRepository) GetProduct(productID string) (*models.Product, err
 		&product.Name,
 		&product.Stock,
 		&product.Reserved,
+		&product.PriceMinor,
+		&product.Currency,
+		&product.ReorderThreshold,
+		&product.StockAlert,
+		&product.AllowBackorder,
+		&product.Version,
+		&product.ParentID,
+		&product.Attributes,
 		&product.CreatedAt,
 		&product.UpdatedAt,
 	)
@@ -42,70 +62,476 @@ func (r *InventoryRepository) GetProduct(productID string) (*models.Product, err
 	return product, nil
 }
 
-func (r *InventoryRepository) ReserveStock(productID string, quantity int) error {
+// ListProducts returns every product ordered by ID
+func (r *InventoryRepository) ListProducts() ([]models.Product, error) {
+	query := `
+		SELECT id, name, stock, reserved, price_minor, currency, reorder_threshold, stock_alert, allow_backorder, version, COALESCE(parent_id, ''), attributes, created_at, updated_at
+		FROM products
+		ORDER BY id
+	`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := []models.Product{}
+	for rows.Next() {
+		var product models.Product
+		if err := rows.Scan(
+			&product.ID,
+			&product.Name,
+			&product.Stock,
+			&product.Reserved,
+			&product.PriceMinor,
+			&product.Currency,
+			&product.ReorderThreshold,
+			&product.StockAlert,
+			&product.AllowBackorder,
+			&product.Version,
+			&product.ParentID,
+			&product.Attributes,
+			&product.CreatedAt,
+			&product.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+
+	return products, rows.Err()
+}
+
+// ListVariants returns a product's variants ordered by ID
+func (r *InventoryRepository) ListVariants(parentID string) ([]models.Product, error) {
+	query := `
+		SELECT id, name, stock, reserved, price_minor, currency, reorder_threshold, stock_alert, allow_backorder, version, COALESCE(parent_id, ''), attributes, created_at, updated_at
+		FROM products
+		WHERE parent_id = $1
+		ORDER BY id
+	`
+
+	rows, err := r.db.Query(query, parentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := []models.Product{}
+	for rows.Next() {
+		var product models.Product
+		if err := rows.Scan(
+			&product.ID,
+			&product.Name,
+			&product.Stock,
+			&product.Reserved,
+			&product.PriceMinor,
+			&product.Currency,
+			&product.ReorderThreshold,
+			&product.StockAlert,
+			&product.AllowBackorder,
+			&product.Version,
+			&product.ParentID,
+			&product.Attributes,
+			&product.CreatedAt,
+			&product.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		variants = append(variants, product)
+	}
+
+	return variants, rows.Err()
+}
+
+// CreateProduct inserts a new product with its initial stock in
+// req.WarehouseID, or the default warehouse. The stock is recorded as a
+// receipt by actor. With req.ParentID the product is a variant of that
+// parent, which must hold no stock and have no other variant with the same
+// attributes.
+func (r *InventoryRepository) CreateProduct(req *models.CreateProductRequest, actor string) (*models.Product, error) {
+	warehouseID := req.WarehouseID
+	if warehouseID == "" {
+		warehouseID = models.DefaultWarehouseID
+	}
+
+	if (req.ParentID == "") != (len(req.Attributes) == 0) {
+		return nil, ErrInvalidVariant
+	}
+
+	now := time.Now()
+	product := &models.Product{
+		ID:               req.ID,
+		Name:             req.Name,
+		Stock:            req.Stock,
+		PriceMinor:       req.PriceMinor,
+		Currency:         req.Currency,
+		ReorderThreshold: req.ReorderThreshold,
+		StockAlert:       models.StockAlertOK,
+		AllowBackorder:   req.AllowBackorder,
+		Version:          1,
+		ParentID:         req.ParentID,
+		Attributes:       req.Attributes,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+
 	tx, err := r.db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback()
 
-	// Lock the row for update
-	var currentStock int
+	if product.ParentID != "" {
+		if err := lockParent(tx, product.ParentID, product.Attributes); err != nil {
+			return nil, err
+		}
+	}
+
+	query := `
+		INSERT INTO products (id, name, stock, reserved, price_minor, currency, reorder_threshold, allow_backorder, parent_id, attributes, created_at, updated_at)
+		VALUES ($1, $2, 0, 0, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, $9)
+		ON CONFLICT (id) DO NOTHING
+	`
+
+	result, err := tx.Exec(query, product.ID, product.Name, product.PriceMinor, product.Currency, product.ReorderThreshold, product.AllowBackorder, product.ParentID, product.Attributes, now)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if rowsAffected == 0 {
+		return nil, ErrProductExists
+	}
+
+	level, err := lockStockLevel(tx, product.ID, warehouseID)
+	if err != nil {
+		return nil, err
+	}
+
+	movement := models.StockMovement{Type: models.MovementReceipt, Actor: actor, Reason: "Product created"}
+	if err := setStock(tx, level, product.Stock, movement, now); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return product, nil
+}
+
+// lockParent locks the parent of a new variant until tx ends, so that it
+// cannot take stock or another variant with the same attributes meanwhile,
+// and checks that the variant can be added to it
+func lockParent(tx *sql.Tx, parentID string, attributes models.Attributes) error {
+	var grandparentID string
+	var stock, reserved int
 	query := `
-		SELECT stock - reserved
+		SELECT COALESCE(parent_id, ''), stock, reserved
 		FROM products
 		WHERE id = $1
 		FOR UPDATE
 	`
 
-	err = tx.QueryRow(query, productID).Scan(&currentStock)
+	err := tx.QueryRow(query, parentID).Scan(&grandparentID, &stock, &reserved)
+	if err == sql.ErrNoRows {
+		return ErrParentNotFound
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return errors.New("product not found")
-		}
 		return err
 	}
 
-	// Check if enough stock is available
-	if currentStock < quantity {
-		return errors.New("insufficient stock")
+	if grandparentID != "" || stock != 0 || reserved != 0 {
+		return ErrInvalidParent
 	}
 
-	// Update reserved stock
-	updateQuery := `
-		UPDATE products
-		SET reserved = reserved + $1, updated_at = $2
-		WHERE id = $3
+	var exists bool
+	query = `
+		SELECT EXISTS (SELECT 1 FROM products WHERE parent_id = $1 AND attributes = $2::JSONB)
 	`
 
-	_, err = tx.Exec(updateQuery, quantity, time.Now(), productID)
-	if err != nil {
+	if err := tx.QueryRow(query, parentID, attributes).Scan(&exists); err != nil {
 		return err
 	}
+	if exists {
+		return ErrVariantExists
+	}
 
-	return tx.Commit()
+	return nil
+}
+
+// hasVariants reports whether a product is the parent of any variants. Such
+// products hold no stock of their own.
+func hasVariants(tx *sql.Tx, productID string) (bool, error) {
+	var exists bool
+	err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM products WHERE parent_id = $1)`, productID).Scan(&exists)
+	return exists, err
 }
 
-func (r *InventoryRepository) DeductStock(productID string, quantity int) error {
+// UpdateProduct changes a product's name and price, and its reorder
+// threshold and backorder setting if they are given. With req.Version the
+// update is a compare-and-swap: it fails with ErrVersionConflict if the
+// product has changed since the caller read that version.
+func (r *InventoryRepository) UpdateProduct(productID string, req *models.UpdateProductRequest) (*models.Product, error) {
 	query := `
 		UPDATE products
-		SET stock = stock - $1, reserved = reserved - $1, updated_at = $2
-		WHERE id = $3 AND stock >= $1
+		SET name = $1, price_minor = $2, currency = $3, reorder_threshold = COALESCE($4, reorder_threshold),
+			allow_backorder = COALESCE($5, allow_backorder), version = version + 1, updated_at = $6
+		WHERE id = $7 AND ($8::BIGINT IS NULL OR version = $8)
+		RETURNING id, name, stock, reserved, price_minor, currency, reorder_threshold, stock_alert, allow_backorder, version, COALESCE(parent_id, ''), attributes, created_at, updated_at
+	`
+
+	product, err := r.scanProduct(r.db.QueryRow(query, req.Name, req.PriceMinor, req.Currency, req.ReorderThreshold, req.AllowBackorder, time.Now(), productID, req.Version))
+	if errors.Is(err, ErrProductNotFound) && req.Version != nil {
+		// Find out whether the product is missing or just at another version
+		if _, getErr := r.GetProduct(productID); getErr == nil {
+			return nil, ErrVersionConflict
+		}
+	}
+
+	return product, err
+}
+
+// UpdateStockAlert moves a product to the stock alert level matching its
+// available stock and reorder threshold. It returns the change, or nil if the
+// product was already at that level, so that each crossing is reported once
+// however many callers check concurrently.
+func (r *InventoryRepository) UpdateStockAlert(productID string) (*models.StockAlert, error) {
+	query := `
+		UPDATE products p
+		SET stock_alert = s.next, version = p.version + 1
+		FROM (
+			SELECT id, stock_alert AS prev,
+				CASE
+					WHEN stock - reserved <= 0 THEN 'OUT'
+					WHEN stock - reserved <= reorder_threshold THEN 'LOW'
+					ELSE 'OK'
+				END AS next
+			FROM products
+			WHERE id = $1
+			FOR UPDATE
+		) s
+		WHERE p.id = s.id AND s.prev <> s.next
+		RETURNING p.id, p.name, s.prev, s.next, p.stock, p.reserved, p.reorder_threshold
 	`
 
-	result, err := r.db.Exec(query, quantity, time.Now(), productID)
+	alert := &models.StockAlert{}
+	err := r.db.QueryRow(query, productID).Scan(
+		&alert.ProductID,
+		&alert.Name,
+		&alert.From,
+		&alert.To,
+		&alert.Stock,
+		&alert.Reserved,
+		&alert.ReorderThreshold,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	return alert, nil
+}
+
+// AdjustStock changes a product's on-hand stock in a warehouse by delta and
+// records it as an adjustment by actor. Stock cannot drop below what is
+// reserved for orders in that warehouse. Products with variants hold no
+// stock.
+func (r *InventoryRepository) AdjustStock(productID, warehouseID string, delta int, actor, reason string) (*models.Product, error) {
+	tx, err := r.db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer tx.Rollback()
 
-	if rowsAffected == 0 {
-		return errors.New("failed to deduct stock")
+	if err := lockProduct(tx, productID); err != nil {
+		return nil, err
 	}
 
-	return nil
+	variants, err := hasVariants(tx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if variants {
+		return nil, ErrVariantRequired
+	}
+
+	level, err := lockStockLevel(tx, productID, warehouseID)
+	if err != nil {
+		return nil, err
+	}
+
+	if level.Stock+delta < level.Reserved {
+		return nil, ErrInsufficientStock
+	}
+
+	movement := models.StockMovement{Type: models.MovementAdjust, Actor: actor, Reason: reason}
+	if err := setStock(tx, level, level.Stock+delta, movement, time.Now()); err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT id, name, stock, reserved, price_minor, currency, reorder_threshold, stock_alert, allow_backorder, version, COALESCE(parent_id, ''), attributes, created_at, updated_at
+		FROM products
+		WHERE id = $1
+	`
+
+	product, err := r.scanProduct(tx.QueryRow(query, productID))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return product, nil
+}
+
+func (r *InventoryRepository) scanProduct(row *sql.Row) (*models.Product, error) {
+	product := &models.Product{}
+
+	err := row.Scan(
+		&product.ID,
+		&product.Name,
+		&product.Stock,
+		&product.Reserved,
+		&product.PriceMinor,
+		&product.Currency,
+		&product.ReorderThreshold,
+		&product.StockAlert,
+		&product.AllowBackorder,
+		&product.Version,
+		&product.ParentID,
+		&product.Attributes,
+		&product.CreatedAt,
+		&product.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrProductNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return product, nil
+}
+
+// ImportProducts upserts rows in one transaction: new products are created,
+// and existing ones get the row's name and price. Each row sets the
+// product's on-hand stock in its warehouse. Rows naming an unknown warehouse
+// or leaving less stock than is reserved there are reported in result and
+// skipped, as are rows for products with variants. Stock changes are
+// recorded as adjustments by actor (receipts for new products). A dry run
+// rolls the transaction back. It returns the IDs of the products created and
+// updated.
+func (r *InventoryRepository) ImportProducts(rows []models.ProductImportRow, dryRun bool, actor string, result *models.ImportResult) (created, updated []string, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	selectQuery := `
+		SELECT name, price_minor, currency
+		FROM products
+		WHERE id = $1
+		FOR UPDATE
+	`
+
+	insertQuery := `
+		INSERT INTO products (id, name, stock, reserved, price_minor, currency, created_at, updated_at)
+		VALUES ($1, $2, 0, 0, $3, $4, $5, $5)
+	`
+
+	updateQuery := `
+		UPDATE products
+		SET name = $1, price_minor = $2, currency = $3, version = version + 1, updated_at = $4
+		WHERE id = $5
+	`
+
+	now := time.Now()
+	changed := make(map[string]bool)
+	for _, row := range rows {
+		var existing models.Product
+		err := tx.QueryRow(selectQuery, row.ID).Scan(&existing.Name, &existing.PriceMinor, &existing.Currency)
+		isNew := err == sql.ErrNoRows
+		if err != nil && !isNew {
+			return nil, nil, err
+		}
+
+		if !isNew {
+			variants, err := hasVariants(tx, row.ID)
+			if err != nil {
+				return nil, nil, err
+			}
+			if variants {
+				result.AddError(row.Line, row.ID, "product has variants; import stock for its SKUs instead")
+				continue
+			}
+		}
+
+		level, err := lockStockLevel(tx, row.ID, row.WarehouseID)
+		switch {
+		case errors.Is(err, ErrWarehouseNotFound):
+			result.AddError(row.Line, row.ID, fmt.Sprintf("unknown warehouse %q", row.WarehouseID))
+			continue
+		case err != nil:
+			return nil, nil, err
+		case row.Stock < level.Reserved:
+			result.AddError(row.Line, row.ID, fmt.Sprintf("stock %d is below the %d units reserved for orders in %s", row.Stock, level.Reserved, row.WarehouseID))
+			continue
+		}
+
+		details := existing.Name != row.Name || existing.PriceMinor != row.PriceMinor || existing.Currency != row.Currency
+		switch {
+		case isNew:
+			if _, err := tx.Exec(insertQuery, row.ID, row.Name, row.PriceMinor, row.Currency, now); err != nil {
+				return nil, nil, err
+			}
+			result.Created++
+			created = append(created, row.ID)
+		case details:
+			if _, err := tx.Exec(updateQuery, row.Name, row.PriceMinor, row.Currency, now, row.ID); err != nil {
+				return nil, nil, err
+			}
+		case level.Stock == row.Stock:
+			result.Unchanged++
+			continue
+		}
+
+		movement := models.StockMovement{Type: models.MovementAdjust, Actor: actor, Reason: "CSV import"}
+		if isNew {
+			movement.Type = models.MovementReceipt
+		}
+		if err := setStock(tx, level, row.Stock, movement, now); err != nil {
+			return nil, nil, err
+		}
+
+		if !isNew {
+			result.Updated++
+			if !changed[row.ID] {
+				changed[row.ID] = true
+				updated = append(updated, row.ID)
+			}
+		}
+	}
+
+	if dryRun {
+		return created, updated, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return created, updated, nil
 }
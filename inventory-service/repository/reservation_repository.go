@@ -0,0 +1,748 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/allocation"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
+)
+
+var (
+	ErrReservationNotFound  = errors.New("reservation not found")
+	ErrReservationNotActive = errors.New("reservation is no longer active")
+	ErrOrderCancelled       = errors.New("order was cancelled")
+	ErrReservationExists    = errors.New("order already has a reservation")
+)
+
+// ReservationRepository holds stock for orders. A reservation moves stock into
+// the reserved count of the warehouses it is allocated to until it is
+// committed (deducted from stock), released, or expires, so stock held for an
+// order that never finishes is not lost.
+//
+// Every stock change locks the product row first, so changes to one product
+// run one at a time, and each stock level update is a single conditional
+// statement that fails instead of overselling if its check no longer holds.
+type ReservationRepository struct {
+	db       *sql.DB
+	strategy allocation.Strategy
+}
+
+func NewReservationRepository(db *sql.DB, strategy allocation.Strategy) *ReservationRepository {
+	return &ReservationRepository{db: db, strategy: strategy}
+}
+
+// Reserve holds quantity of a product for an order until ttl elapses, taken
+// from the warehouses chosen by the allocation strategy for the order's
+// ship-to region. Reserving again for the same order and product returns the
+// existing reservation, so a redelivered message does not hold the stock
+// twice. Orders that were already cancelled cannot reserve, and neither can
+// orders for a product with variants rather than one of its SKUs.
+func (r *ReservationRepository) Reserve(orderID, productID string, quantity int, region string, ttl time.Duration) (*models.StockReservation, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	cancelled, err := lockOrder(tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if cancelled {
+		return nil, ErrOrderCancelled
+	}
+
+	reservation, err := r.reserveLocked(tx, orderID, productID, quantity, region, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return reservation, nil
+}
+
+// ReserveBatch reserves every line of a multi-line order in one transaction:
+// either all lines get their stock or none do. Products are locked in ID
+// order, so batches sharing products cannot deadlock. If any line cannot be
+// reserved nothing is held and failures gives the reason for each such
+// line; the error is only for failures of the store itself. Lines for the
+// same order and product are reserved once, as with Reserve. Batches do not
+// backorder.
+func (r *ReservationRepository) ReserveBatch(orderID string, lines []models.OrderLine, region string, ttl time.Duration) ([]models.StockReservation, []models.LineFailure, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	cancelled, err := lockOrder(tx, orderID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cancelled {
+		return nil, nil, ErrOrderCancelled
+	}
+
+	var failures []models.LineFailure
+	fail := func(i int, line models.OrderLine, reason string) {
+		failures = append(failures, models.LineFailure{Line: i + 1, ItemID: line.ItemID, Quantity: line.Quantity, Reason: reason})
+	}
+
+	// Lock every product up front, in a fixed order
+	productIDs := make([]string, 0, len(lines))
+	first := make(map[string]int, len(lines))
+	for i, line := range lines {
+		if j, ok := first[line.ItemID]; ok {
+			fail(i, line, fmt.Sprintf("same item as line %d", j+1))
+			continue
+		}
+		first[line.ItemID] = i
+		productIDs = append(productIDs, line.ItemID)
+	}
+	sort.Strings(productIDs)
+
+	missing := make(map[string]bool)
+	for _, productID := range productIDs {
+		err := lockProduct(tx, productID)
+		if errors.Is(err, ErrProductNotFound) {
+			missing[productID] = true
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	reservations := make([]models.StockReservation, 0, len(lines))
+	for i, line := range lines {
+		if first[line.ItemID] != i {
+			continue
+		}
+		if missing[line.ItemID] {
+			fail(i, line, "unknown item")
+			continue
+		}
+
+		reservation, err := r.reserveLocked(tx, orderID, line.ItemID, line.Quantity, region, ttl)
+		switch {
+		case errors.Is(err, ErrInsufficientStock):
+			available, err := availableStock(tx, line.ItemID)
+			if err != nil {
+				return nil, nil, err
+			}
+			fail(i, line, fmt.Sprintf("insufficient stock: requested %d, available %d", line.Quantity, available))
+		case errors.Is(err, ErrVariantRequired), errors.Is(err, ErrReservationNotActive):
+			fail(i, line, err.Error())
+		case err != nil:
+			return nil, nil, err
+		default:
+			reservations = append(reservations, *reservation)
+		}
+	}
+
+	if len(failures) > 0 {
+		sort.Slice(failures, func(i, j int) bool { return failures[i].Line < failures[j].Line })
+		return nil, failures, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return reservations, nil, nil
+}
+
+// reserveLocked reserves stock for one product of an order locked by tx, or
+// returns the order's existing reservation for it
+func (r *ReservationRepository) reserveLocked(tx *sql.Tx, orderID, productID string, quantity int, region string, ttl time.Duration) (*models.StockReservation, error) {
+	existing, err := r.getForUpdate(tx, orderID, productID)
+	switch {
+	case err == nil:
+		if existing.State != models.ReservationReserved && existing.State != models.ReservationCommitted {
+			return nil, ErrReservationNotActive
+		}
+		return existing, nil
+	case !errors.Is(err, ErrReservationNotFound):
+		return nil, err
+	}
+
+	if err := lockProduct(tx, productID); err != nil {
+		return nil, err
+	}
+
+	variants, err := hasVariants(tx, productID)
+	if err != nil {
+		return nil, err
+	}
+	if variants {
+		return nil, ErrVariantRequired
+	}
+
+	levels, err := lockStockLevels(tx, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pick the warehouses to take the stock from
+	allocations := r.strategy.Allocate(levels, quantity, region)
+	if allocations == nil {
+		return nil, ErrInsufficientStock
+	}
+
+	now := time.Now()
+
+	reservation := &models.StockReservation{
+		OrderID:     orderID,
+		ProductID:   productID,
+		Quantity:    quantity,
+		State:       models.ReservationReserved,
+		ExpiresAt:   now.Add(ttl),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Allocations: allocations,
+	}
+
+	reserveQuery := `
+		UPDATE stock_levels
+		SET reserved = reserved + $1, updated_at = $2
+		WHERE product_id = $3 AND warehouse_id = $4 AND stock - reserved >= $1
+	`
+
+	movement := models.StockMovement{Type: models.MovementReserve, Actor: models.ActorSaga}
+	if err := updateAllocatedStock(tx, reservation, reserveQuery, movement, now); err != nil {
+		return nil, err
+	}
+
+	insertQuery := `
+		INSERT INTO reservations (order_id, product_id, quantity, state, expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6)
+		RETURNING id
+	`
+
+	err = tx.QueryRow(insertQuery, orderID, productID, quantity, reservation.State, reservation.ExpiresAt, now).Scan(&reservation.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	allocationQuery := `
+		INSERT INTO reservation_allocations (reservation_id, warehouse_id, quantity)
+		VALUES ($1, $2, $3)
+	`
+
+	for _, allocation := range allocations {
+		if _, err := tx.Exec(allocationQuery, reservation.ID, allocation.WarehouseID, allocation.Quantity); err != nil {
+			return nil, err
+		}
+	}
+
+	return reservation, nil
+}
+
+// Commit deducts the stock held by an order's reservation. Committing an
+// already committed reservation is a no-op.
+func (r *ReservationRepository) Commit(orderID, productID string) (*models.StockReservation, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	reservation, err := r.getForUpdate(tx, orderID, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.commitLocked(tx, reservation, time.Now()); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return reservation, nil
+}
+
+// CommitBatch deducts the stock held by an order's reservations for all of
+// productIDs in one transaction, locking them in ID order like ReserveBatch.
+// If any of them cannot be deducted nothing is, and the reservations still
+// held are released, so the stock goes back on sale. The order is not
+// marked as cancelled, so it can be reserved again, e.g. by a saga retry.
+func (r *ReservationRepository) CommitBatch(orderID string, productIDs []string) ([]models.StockReservation, error) {
+	productIDs = append([]string(nil), productIDs...)
+	sort.Strings(productIDs)
+
+	committed, err := r.commitBatch(orderID, productIDs)
+	if err == nil {
+		return committed, nil
+	}
+
+	if releaseErr := r.releaseBatch(orderID, productIDs); releaseErr != nil {
+		return nil, fmt.Errorf("%w (and failed to release the reserved stock: %v)", err, releaseErr)
+	}
+	return nil, err
+}
+
+func (r *ReservationRepository) commitBatch(orderID string, productIDs []string) ([]models.StockReservation, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	committed := make([]models.StockReservation, 0, len(productIDs))
+	for _, productID := range productIDs {
+		reservation, err := r.getForUpdate(tx, orderID, productID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", productID, err)
+		}
+		if err := r.commitLocked(tx, reservation, now); err != nil {
+			return nil, fmt.Errorf("%s: %w", productID, err)
+		}
+		committed = append(committed, *reservation)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return committed, nil
+}
+
+// releaseBatch gives back the stock held by an order's reservations for
+// productIDs, in the given order, leaving reservations no longer held alone
+func (r *ReservationRepository) releaseBatch(orderID string, productIDs []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, productID := range productIDs {
+		reservation, err := r.getForUpdate(tx, orderID, productID)
+		if errors.Is(err, ErrReservationNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if reservation.State != models.ReservationReserved {
+			continue
+		}
+
+		movement := models.StockMovement{Type: models.MovementRelease, Actor: models.ActorSaga, Reason: "Deducting the order failed"}
+		if err := r.releaseStock(tx, reservation, movement, now); err != nil {
+			return err
+		}
+		if err := r.setState(tx, reservation, models.ReservationReleased, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// commitLocked deducts the stock held by a reservation locked by tx.
+// Committing an already committed reservation is a no-op.
+func (r *ReservationRepository) commitLocked(tx *sql.Tx, reservation *models.StockReservation, now time.Time) error {
+	switch reservation.State {
+	case models.ReservationCommitted:
+		return nil
+	case models.ReservationReserved:
+	default:
+		return ErrReservationNotActive
+	}
+
+	deductQuery := `
+		UPDATE stock_levels
+		SET stock = stock - $1, reserved = reserved - $1, updated_at = $2
+		WHERE product_id = $3 AND warehouse_id = $4 AND reserved >= $1 AND stock >= $1
+	`
+
+	movement := models.StockMovement{Type: models.MovementDeduct, Actor: models.ActorSaga}
+	if err := updateAllocatedStock(tx, reservation, deductQuery, movement, now); err != nil {
+		return fmt.Errorf("failed to deduct stock: %w", err)
+	}
+
+	return r.setState(tx, reservation, models.ReservationCommitted, now)
+}
+
+// Release gives back the stock held by an order's reservation. It reports
+// whether stock was released; a reservation that was already committed,
+// released or expired is left alone.
+func (r *ReservationRepository) Release(orderID, productID string) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	reservation, err := r.getForUpdate(tx, orderID, productID)
+	if err != nil {
+		return false, err
+	}
+
+	if reservation.State != models.ReservationReserved {
+		return false, nil
+	}
+
+	now := time.Now()
+
+	movement := models.StockMovement{Type: models.MovementRelease, Actor: models.ActorSaga}
+	if err := r.releaseStock(tx, reservation, movement, now); err != nil {
+		return false, err
+	}
+
+	if err := r.setState(tx, reservation, models.ReservationReleased, now); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// ReleaseExpired releases up to limit reservations whose TTL elapsed before
+// now and returns them. Rows locked by a concurrent commit or release are
+// skipped and picked up on a later run if still held.
+func (r *ReservationRepository) ReleaseExpired(now time.Time, limit int) ([]models.StockReservation, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT id, order_id, product_id, quantity, state, expires_at, created_at, updated_at
+		FROM reservations
+		WHERE state = $1 AND expires_at < $2
+		ORDER BY expires_at
+		LIMIT $3
+		FOR UPDATE SKIP LOCKED
+	`
+
+	rows, err := tx.Query(query, models.ReservationReserved, now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	expired, err := scanReservations(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock the products up front, in the same fixed order as ReserveBatch, so
+	// a sweep cannot deadlock with a batch sharing two of its products
+	productIDs := make([]string, 0, len(expired))
+	seen := make(map[string]bool, len(expired))
+	for _, reservation := range expired {
+		if !seen[reservation.ProductID] {
+			seen[reservation.ProductID] = true
+			productIDs = append(productIDs, reservation.ProductID)
+		}
+	}
+	sort.Strings(productIDs)
+
+	for _, productID := range productIDs {
+		if err := lockProduct(tx, productID); err != nil && !errors.Is(err, ErrProductNotFound) {
+			return nil, err
+		}
+	}
+
+	for i := range expired {
+		if err := loadAllocations(tx, &expired[i]); err != nil {
+			return nil, err
+		}
+		movement := models.StockMovement{Type: models.MovementRelease, Actor: models.ActorSweeper, Reason: "Reservation expired"}
+		if err := r.releaseStock(tx, &expired[i], movement, now); err != nil {
+			return nil, err
+		}
+		if err := r.setState(tx, &expired[i], models.ReservationExpired, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return expired, nil
+}
+
+// ReleaseOrder gives back all stock held or deducted for a cancelled order:
+// reserved stock is released and committed stock is added back to stock. The
+// order is remembered as cancelled, so it is compensated exactly once
+// (compensated is false on repeats) and cannot reserve stock afterwards.
+func (r *ReservationRepository) ReleaseOrder(orderID, reason string) ([]models.ReleasedStock, bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	cancelled, err := lockOrder(tx, orderID)
+	if err != nil {
+		return nil, false, err
+	}
+	if cancelled {
+		return nil, false, nil
+	}
+
+	insertQuery := `
+		INSERT INTO cancelled_orders (order_id, reason, cancelled_at)
+		VALUES ($1, $2, $3)
+	`
+
+	now := time.Now()
+	if _, err := tx.Exec(insertQuery, orderID, reason, now); err != nil {
+		return nil, false, err
+	}
+
+	query := `
+		SELECT id, order_id, product_id, quantity, state, expires_at, created_at, updated_at
+		FROM reservations
+		WHERE order_id = $1 AND state = ANY($2)
+		ORDER BY product_id
+		FOR UPDATE
+	`
+
+	rows, err := tx.Query(query, orderID, pq.Array([]string{models.ReservationReserved, models.ReservationCommitted}))
+	if err != nil {
+		return nil, false, err
+	}
+
+	held, err := scanReservations(rows)
+	if err != nil {
+		return nil, false, err
+	}
+
+	restockQuery := `
+		UPDATE stock_levels
+		SET stock = stock + $1, updated_at = $2
+		WHERE product_id = $3 AND warehouse_id = $4
+	`
+
+	released := []models.ReleasedStock{}
+	for i := range held {
+		reservation := &held[i]
+		restocked := reservation.State == models.ReservationCommitted
+
+		if err := loadAllocations(tx, reservation); err != nil {
+			return nil, false, err
+		}
+
+		// Deducted stock comes back as a receipt
+		movement := models.StockMovement{Type: models.MovementRelease, Actor: models.ActorCompensate, Reason: reason}
+		if restocked {
+			movement.Type = models.MovementReceipt
+			if err := updateAllocatedStock(tx, reservation, restockQuery, movement, now); err != nil {
+				return nil, false, err
+			}
+		} else if err := r.releaseStock(tx, reservation, movement, now); err != nil {
+			return nil, false, err
+		}
+
+		if err := r.setState(tx, reservation, models.ReservationReleased, now); err != nil {
+			return nil, false, err
+		}
+
+		released = append(released, models.ReleasedStock{
+			ProductID: reservation.ProductID,
+			Quantity:  reservation.Quantity,
+			Restocked: restocked,
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	return released, true, nil
+}
+
+// availableStock returns a product's stock that is not reserved, as seen by
+// tx
+func availableStock(tx *sql.Tx, productID string) (int, error) {
+	var available int
+	err := tx.QueryRow(`SELECT stock - reserved FROM products WHERE id = $1`, productID).Scan(&available)
+	return available, err
+}
+
+// lockOrder serializes reserving, backordering and cancelling for an order
+// until tx ends, and reports whether the order was cancelled
+func lockOrder(tx *sql.Tx, orderID string) (bool, error) {
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, orderID); err != nil {
+		return false, err
+	}
+
+	var cancelled bool
+	query := `
+		SELECT EXISTS (SELECT 1 FROM cancelled_orders WHERE order_id = $1)
+	`
+
+	if err := tx.QueryRow(query, orderID).Scan(&cancelled); err != nil {
+		return false, err
+	}
+
+	return cancelled, nil
+}
+
+func (r *ReservationRepository) getForUpdate(tx *sql.Tx, orderID, productID string) (*models.StockReservation, error) {
+	reservation := &models.StockReservation{}
+
+	query := `
+		SELECT id, order_id, product_id, quantity, state, expires_at, created_at, updated_at
+		FROM reservations
+		WHERE order_id = $1 AND product_id = $2
+		FOR UPDATE
+	`
+
+	err := tx.QueryRow(query, orderID, productID).Scan(
+		&reservation.ID,
+		&reservation.OrderID,
+		&reservation.ProductID,
+		&reservation.Quantity,
+		&reservation.State,
+		&reservation.ExpiresAt,
+		&reservation.CreatedAt,
+		&reservation.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrReservationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadAllocations(tx, reservation); err != nil {
+		return nil, err
+	}
+
+	return reservation, nil
+}
+
+// loadAllocations reads the warehouses a reservation is held in
+func loadAllocations(tx *sql.Tx, reservation *models.StockReservation) error {
+	query := `
+		SELECT warehouse_id, quantity
+		FROM reservation_allocations
+		WHERE reservation_id = $1
+		ORDER BY warehouse_id
+	`
+
+	rows, err := tx.Query(query, reservation.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	reservation.Allocations = []models.Allocation{}
+	for rows.Next() {
+		var allocation models.Allocation
+		if err := rows.Scan(&allocation.WarehouseID, &allocation.Quantity); err != nil {
+			return err
+		}
+		reservation.Allocations = append(reservation.Allocations, allocation)
+	}
+
+	return rows.Err()
+}
+
+// updateAllocatedStock runs query, an update of stock_levels taking the
+// quantity, time, product and warehouse, for each of a reservation's
+// allocations, records each as movement in the ledger and refreshes the
+// product's totals. It fails with ErrInsufficientStock if a stock level was
+// not updated. The product is locked first, like every other stock level
+// change.
+func updateAllocatedStock(tx *sql.Tx, reservation *models.StockReservation, query string, movement models.StockMovement, now time.Time) error {
+	if err := lockProduct(tx, reservation.ProductID); err != nil {
+		return err
+	}
+
+	for _, allocation := range reservation.Allocations {
+		result, err := tx.Exec(query, allocation.Quantity, now, reservation.ProductID, allocation.WarehouseID)
+		if err != nil {
+			return err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if rowsAffected == 0 {
+			return ErrInsufficientStock
+		}
+
+		movement.ProductID = reservation.ProductID
+		movement.WarehouseID = allocation.WarehouseID
+		movement.Quantity = allocation.Quantity
+		movement.OrderID = reservation.OrderID
+		if err := recordMovement(tx, movement, now); err != nil {
+			return err
+		}
+	}
+
+	return syncProductTotals(tx, reservation.ProductID, now)
+}
+
+// scanReservations reads and closes rows of reservations
+func scanReservations(rows *sql.Rows) ([]models.StockReservation, error) {
+	defer rows.Close()
+
+	reservations := []models.StockReservation{}
+	for rows.Next() {
+		var reservation models.StockReservation
+		if err := rows.Scan(
+			&reservation.ID,
+			&reservation.OrderID,
+			&reservation.ProductID,
+			&reservation.Quantity,
+			&reservation.State,
+			&reservation.ExpiresAt,
+			&reservation.CreatedAt,
+			&reservation.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	return reservations, rows.Err()
+}
+
+// releaseStock returns a reservation's quantity from the reserved count of
+// its warehouses
+func (r *ReservationRepository) releaseStock(tx *sql.Tx, reservation *models.StockReservation, movement models.StockMovement, now time.Time) error {
+	query := `
+		UPDATE stock_levels
+		SET reserved = GREATEST(reserved - $1, 0), updated_at = $2
+		WHERE product_id = $3 AND warehouse_id = $4
+	`
+
+	return updateAllocatedStock(tx, reservation, query, movement, now)
+}
+
+func (r *ReservationRepository) setState(tx *sql.Tx, reservation *models.StockReservation, state string, now time.Time) error {
+	query := `
+		UPDATE reservations
+		SET state = $1, updated_at = $2
+		WHERE id = $3
+	`
+
+	if _, err := tx.Exec(query, state, now, reservation.ID); err != nil {
+		return err
+	}
+
+	reservation.State = state
+	reservation.UpdatedAt = now
+	return nil
+}
@@ -0,0 +1,176 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
+)
+
+// defaultMovementLimit is how many ledger entries are listed when the filter
+// does not say
+const defaultMovementLimit = 100
+
+// ledgerQuery recomputes stock and reserved per product and warehouse from
+// the stock movement ledger
+const ledgerQuery = `
+	SELECT product_id, warehouse_id,
+		SUM(CASE type WHEN 'receipt' THEN quantity WHEN 'adjust' THEN quantity WHEN 'deduct' THEN -quantity ELSE 0 END) AS stock,
+		SUM(CASE type WHEN 'reserve' THEN quantity WHEN 'release' THEN -quantity WHEN 'deduct' THEN -quantity ELSE 0 END) AS reserved
+	FROM stock_movements
+	GROUP BY product_id, warehouse_id
+`
+
+// StockMovementRepository reads the stock movement ledger. Entries are
+// written by the other repositories in the same transaction as the counter
+// change they record, and are never updated or deleted.
+type StockMovementRepository struct {
+	db *sql.DB
+}
+
+func NewStockMovementRepository(db *sql.DB) *StockMovementRepository {
+	return &StockMovementRepository{db: db}
+}
+
+// ListMovements returns the ledger entries matching filter, newest first
+func (r *StockMovementRepository) ListMovements(filter models.StockMovementFilter) ([]models.StockMovement, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultMovementLimit
+	}
+
+	query := `
+		SELECT id, product_id, warehouse_id, type, quantity, order_id, actor, reason, created_at
+		FROM stock_movements
+		WHERE ($1 = '' OR product_id = $1)
+			AND ($2 = '' OR warehouse_id = $2)
+			AND ($3 = '' OR order_id = $3)
+			AND ($4 = '' OR type = $4)
+			AND ($5 = 0 OR id < $5)
+		ORDER BY id DESC
+		LIMIT $6
+	`
+
+	rows, err := r.db.Query(query, filter.ProductID, filter.WarehouseID, filter.OrderID, filter.Type, filter.BeforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movements := []models.StockMovement{}
+	for rows.Next() {
+		var movement models.StockMovement
+		if err := rows.Scan(
+			&movement.ID,
+			&movement.ProductID,
+			&movement.WarehouseID,
+			&movement.Type,
+			&movement.Quantity,
+			&movement.OrderID,
+			&movement.Actor,
+			&movement.Reason,
+			&movement.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		movements = append(movements, movement)
+	}
+
+	return movements, rows.Err()
+}
+
+// CheckLedger recomputes every stock level and product total from the ledger
+// and returns the counters that differ. It reads one snapshot, so changes
+// committed while it runs do not show up as mismatches.
+func (r *StockMovementRepository) CheckLedger() (*models.LedgerCheck, error) {
+	tx, err := r.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	levelsQuery := `
+		WITH ledger AS (` + ledgerQuery + `)
+		SELECT COALESCE(l.product_id, g.product_id), COALESCE(l.warehouse_id, g.warehouse_id),
+			COALESCE(l.stock, 0), COALESCE(l.reserved, 0), COALESCE(g.stock, 0), COALESCE(g.reserved, 0)
+		FROM stock_levels l
+		FULL OUTER JOIN ledger g ON g.product_id = l.product_id AND g.warehouse_id = l.warehouse_id
+		WHERE COALESCE(l.stock, 0) <> COALESCE(g.stock, 0) OR COALESCE(l.reserved, 0) <> COALESCE(g.reserved, 0)
+		ORDER BY 1, 2
+	`
+
+	mismatches, err := scanMismatches(tx, levelsQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	productsQuery := `
+		WITH ledger AS (` + ledgerQuery + `)
+		SELECT p.id, '', p.stock, p.reserved, COALESCE(SUM(g.stock), 0), COALESCE(SUM(g.reserved), 0)
+		FROM products p
+		LEFT JOIN ledger g ON g.product_id = p.id
+		GROUP BY p.id, p.stock, p.reserved
+		HAVING p.stock <> COALESCE(SUM(g.stock), 0) OR p.reserved <> COALESCE(SUM(g.reserved), 0)
+		ORDER BY 1
+	`
+
+	totals, err := scanMismatches(tx, productsQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	mismatches = append(mismatches, totals...)
+	return &models.LedgerCheck{
+		Consistent: len(mismatches) == 0,
+		Mismatches: mismatches,
+		CheckedAt:  time.Now(),
+	}, nil
+}
+
+func scanMismatches(tx *sql.Tx, query string) ([]models.LedgerMismatch, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mismatches := []models.LedgerMismatch{}
+	for rows.Next() {
+		var mismatch models.LedgerMismatch
+		if err := rows.Scan(
+			&mismatch.ProductID,
+			&mismatch.WarehouseID,
+			&mismatch.Stock,
+			&mismatch.Reserved,
+			&mismatch.LedgerStock,
+			&mismatch.LedgerReserved,
+		); err != nil {
+			return nil, err
+		}
+		mismatches = append(mismatches, mismatch)
+	}
+
+	return mismatches, rows.Err()
+}
+
+// recordMovement appends an entry to the ledger. It must run in the
+// transaction that changes the counters it records.
+func recordMovement(tx *sql.Tx, movement models.StockMovement, now time.Time) error {
+	query := `
+		INSERT INTO stock_movements (product_id, warehouse_id, type, quantity, order_id, actor, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+
+	_, err := tx.Exec(query,
+		movement.ProductID,
+		movement.WarehouseID,
+		movement.Type,
+		movement.Quantity,
+		movement.OrderID,
+		movement.Actor,
+		movement.Reason,
+		now,
+	)
+	return err
+}
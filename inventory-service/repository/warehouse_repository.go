@@ -0,0 +1,252 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
+)
+
+var (
+	ErrWarehouseNotFound = errors.New("warehouse not found")
+	ErrWarehouseExists   = errors.New("warehouse already exists")
+)
+
+type WarehouseRepository struct {
+	db *sql.DB
+}
+
+func NewWarehouseRepository(db *sql.DB) *WarehouseRepository {
+	return &WarehouseRepository{db: db}
+}
+
+// ListWarehouses returns every warehouse ordered by priority
+func (r *WarehouseRepository) ListWarehouses() ([]models.Warehouse, error) {
+	query := `
+		SELECT id, name, region, priority, created_at
+		FROM warehouses
+		ORDER BY priority, id
+	`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	warehouses := []models.Warehouse{}
+	for rows.Next() {
+		var warehouse models.Warehouse
+		if err := rows.Scan(
+			&warehouse.ID,
+			&warehouse.Name,
+			&warehouse.Region,
+			&warehouse.Priority,
+			&warehouse.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		warehouses = append(warehouses, warehouse)
+	}
+
+	return warehouses, rows.Err()
+}
+
+// CreateWarehouse inserts a new warehouse. It holds no stock until stock is
+// adjusted or imported into it.
+func (r *WarehouseRepository) CreateWarehouse(req *models.CreateWarehouseRequest) (*models.Warehouse, error) {
+	warehouse := &models.Warehouse{
+		ID:        req.ID,
+		Name:      req.Name,
+		Region:    req.Region,
+		Priority:  req.Priority,
+		CreatedAt: time.Now(),
+	}
+
+	query := `
+		INSERT INTO warehouses (id, name, region, priority, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO NOTHING
+	`
+
+	result, err := r.db.Exec(query, warehouse.ID, warehouse.Name, warehouse.Region, warehouse.Priority, warehouse.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if rowsAffected == 0 {
+		return nil, ErrWarehouseExists
+	}
+
+	return warehouse, nil
+}
+
+const stockLevelColumns = `
+	l.product_id, l.warehouse_id, w.region, w.priority, l.stock, l.reserved, l.updated_at
+`
+
+// ListStockLevels returns a product's stock in each warehouse that has held
+// it, or every product's if productID is empty
+func (r *WarehouseRepository) ListStockLevels(productID string) ([]models.StockLevel, error) {
+	query := `
+		SELECT ` + stockLevelColumns + `
+		FROM stock_levels l
+		JOIN warehouses w ON w.id = l.warehouse_id
+		WHERE $1 = '' OR l.product_id = $1
+		ORDER BY l.product_id, w.priority, l.warehouse_id
+	`
+
+	rows, err := r.db.Query(query, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanStockLevels(rows)
+}
+
+// lockProduct locks a product's row until tx ends. Stock level changes lock
+// the product first so that they cannot interleave.
+func lockProduct(tx *sql.Tx, productID string) error {
+	var id string
+	err := tx.QueryRow(`SELECT id FROM products WHERE id = $1 FOR UPDATE`, productID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrProductNotFound
+	}
+	return err
+}
+
+// lockStockLevels returns a product's stock levels, locked until tx ends
+func lockStockLevels(tx *sql.Tx, productID string) ([]models.StockLevel, error) {
+	query := `
+		SELECT ` + stockLevelColumns + `
+		FROM stock_levels l
+		JOIN warehouses w ON w.id = l.warehouse_id
+		WHERE l.product_id = $1
+		ORDER BY l.warehouse_id
+		FOR UPDATE OF l
+	`
+
+	rows, err := tx.Query(query, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanStockLevels(rows)
+}
+
+// lockStockLevel returns a product's stock level in a warehouse, locked until
+// tx ends. A warehouse that never held the product has a zero stock level.
+func lockStockLevel(tx *sql.Tx, productID, warehouseID string) (models.StockLevel, error) {
+	level := models.StockLevel{ProductID: productID, WarehouseID: warehouseID}
+
+	err := tx.QueryRow(`SELECT region, priority FROM warehouses WHERE id = $1`, warehouseID).Scan(&level.Region, &level.Priority)
+	if err == sql.ErrNoRows {
+		return level, ErrWarehouseNotFound
+	}
+	if err != nil {
+		return level, err
+	}
+
+	query := `
+		SELECT stock, reserved, updated_at
+		FROM stock_levels
+		WHERE product_id = $1 AND warehouse_id = $2
+		FOR UPDATE
+	`
+
+	err = tx.QueryRow(query, productID, warehouseID).Scan(&level.Stock, &level.Reserved, &level.UpdatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return level, err
+	}
+
+	return level, nil
+}
+
+// setStock sets the on-hand stock of a locked stock level, records the
+// difference in the ledger as movement (a receipt or adjustment) and
+// refreshes the product's totals
+func setStock(tx *sql.Tx, level models.StockLevel, stock int, movement models.StockMovement, now time.Time) error {
+	if stock == level.Stock {
+		return nil
+	}
+
+	query := `
+		INSERT INTO stock_levels (product_id, warehouse_id, stock, reserved, updated_at)
+		VALUES ($1, $2, $3, 0, $4)
+		ON CONFLICT (product_id, warehouse_id) DO UPDATE
+			SET stock = EXCLUDED.stock, updated_at = EXCLUDED.updated_at
+			WHERE stock_levels.reserved <= EXCLUDED.stock
+	`
+
+	result, err := tx.Exec(query, level.ProductID, level.WarehouseID, stock, now)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// Stock cannot drop below what is reserved
+	if rowsAffected == 0 {
+		return ErrInsufficientStock
+	}
+
+	movement.ProductID = level.ProductID
+	movement.WarehouseID = level.WarehouseID
+	movement.Quantity = stock - level.Stock
+	if err := recordMovement(tx, movement, now); err != nil {
+		return err
+	}
+
+	return syncProductTotals(tx, level.ProductID, now)
+}
+
+// syncProductTotals sets products.stock and products.reserved to the sum of
+// the product's stock levels
+func syncProductTotals(tx *sql.Tx, productID string, now time.Time) error {
+	query := `
+		UPDATE products
+		SET stock = totals.stock, reserved = totals.reserved, version = version + 1, updated_at = $2
+		FROM (
+			SELECT COALESCE(SUM(stock), 0) AS stock, COALESCE(SUM(reserved), 0) AS reserved
+			FROM stock_levels
+			WHERE product_id = $1
+		) AS totals
+		WHERE id = $1
+	`
+
+	_, err := tx.Exec(query, productID, now)
+	return err
+}
+
+// scanStockLevels reads and closes rows of stockLevelColumns
+func scanStockLevels(rows *sql.Rows) ([]models.StockLevel, error) {
+	defer rows.Close()
+
+	levels := []models.StockLevel{}
+	for rows.Next() {
+		var level models.StockLevel
+		if err := rows.Scan(
+			&level.ProductID,
+			&level.WarehouseID,
+			&level.Region,
+			&level.Priority,
+			&level.Stock,
+			&level.Reserved,
+			&level.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		levels = append(levels, level)
+	}
+
+	return levels, rows.Err()
+}
@@ -0,0 +1,240 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/messaging"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/repository"
+)
+
+// reserveOrBackorder reserves stock for an order, or queues the order if its
+// product allows backorders and either there is not enough stock or other
+// orders are already waiting, so that stock goes to the oldest order first.
+// It reports whether the order was backordered.
+func (s *InventoryService) reserveOrBackorder(backorder *models.Backorder) (*models.StockReservation, bool, error) {
+	allowed, waiting, err := s.backorders.Queue(backorder.ProductID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !allowed || !waiting {
+		reservation, err := s.reservations.Reserve(backorder.OrderID, backorder.ProductID, backorder.Quantity, backorder.ShipToRegion, s.reservationTTL)
+		if !allowed || !errors.Is(err, repository.ErrInsufficientStock) {
+			return reservation, false, err
+		}
+	}
+
+	held, err := s.backorders.Hold(backorder, s.backorderWait)
+	if errors.Is(err, repository.ErrReservationExists) {
+		// A redelivered message for an order that already got its stock
+		reservation, err := s.reservations.Reserve(backorder.OrderID, backorder.ProductID, backorder.Quantity, backorder.ShipToRegion, s.reservationTTL)
+		return reservation, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if held {
+		log.Printf("Backordered %d x %s for order %s until %s", backorder.Quantity, backorder.ProductID, backorder.OrderID, backorder.ExpiresAt.Format(time.RFC3339))
+
+		event := map[string]interface{}{
+			"order_id":       backorder.OrderID,
+			"item_id":        backorder.ProductID,
+			"quantity":       backorder.Quantity,
+			"user_email":     backorder.UserEmail,
+			"message":        "Waiting for stock",
+			"expires_at":     backorder.ExpiresAt,
+			"backordered_at": backorder.CreatedAt,
+		}
+
+		if err := s.publisher.PublishInventoryBackordered(event, sagaOf(backorder)); err != nil {
+			log.Printf("Failed to publish inventory.backordered event: %v", err)
+		}
+	}
+
+	// Stock may have come in since the reservation was turned down
+	s.FillBackorders(backorder.ProductID)
+	return nil, true, nil
+}
+
+// FillBackorders hands a product's stock to the orders waiting for it, oldest
+// first, and carries on with each order's saga. It stops at the first order
+// there is not enough stock for, so later, smaller orders do not jump the
+// queue. Filling publishes stock changes, which ask for another fill; while
+// a product is being filled such requests only make the fill run once more.
+func (s *InventoryService) FillBackorders(productID string) {
+	s.fillMu.Lock()
+	if _, running := s.filling[productID]; running {
+		s.filling[productID] = true
+		s.fillMu.Unlock()
+		return
+	}
+	s.filling[productID] = false
+	s.fillMu.Unlock()
+
+	for {
+		s.fillBackorders(productID)
+
+		s.fillMu.Lock()
+		if !s.filling[productID] {
+			delete(s.filling, productID)
+			s.fillMu.Unlock()
+			return
+		}
+		s.filling[productID] = false
+		s.fillMu.Unlock()
+	}
+}
+
+func (s *InventoryService) fillBackorders(productID string) {
+	filled := 0
+	defer func() {
+		if filled > 0 {
+			s.PublishProductEvent("product.stock_changed", productID)
+		}
+	}()
+
+	for {
+		backorder, err := s.backorders.Next(productID)
+		if err != nil {
+			log.Printf("Failed to load backorders for product %s: %v", productID, err)
+			return
+		}
+		if backorder == nil {
+			return
+		}
+
+		reservation, err := s.reservations.Reserve(backorder.OrderID, productID, backorder.Quantity, backorder.ShipToRegion, s.reservationTTL)
+		switch {
+		case errors.Is(err, repository.ErrInsufficientStock):
+			return
+		case errors.Is(err, repository.ErrOrderCancelled):
+			if err := s.cancelBackorders(backorder.OrderID, "Order was cancelled"); err != nil {
+				log.Printf("Failed to cancel backorders for order %s: %v", backorder.OrderID, err)
+				return
+			}
+			continue
+		case err != nil:
+			log.Printf("Failed to reserve stock for backorder of order %s: %v", backorder.OrderID, err)
+			return
+		}
+
+		resolved, err := s.backorders.Resolve(backorder.ID, models.BackorderFilled)
+		if err != nil {
+			log.Printf("Failed to mark backorder of order %s as filled: %v", backorder.OrderID, err)
+			return
+		}
+		if !resolved {
+			// Filled, expired or cancelled in the meantime; an unneeded
+			// reservation is given back when the order is compensated or
+			// its TTL elapses
+			continue
+		}
+
+		filled++
+		s.fillBackorder(backorder, reservation)
+	}
+}
+
+// fillBackorder carries on with the saga of an order whose stock arrived: a
+// paid order has its stock deducted, and an order of an inventory-first saga
+// is sent on to payment
+func (s *InventoryService) fillBackorder(backorder *models.Backorder, reservation *models.StockReservation) {
+	saga := sagaOf(backorder)
+	waited := time.Since(backorder.CreatedAt).Round(time.Second)
+	log.Printf("Filled backorder of %d x %s for order %s after %s", backorder.Quantity, backorder.ProductID, backorder.OrderID, waited)
+
+	event := map[string]interface{}{
+		"order_id":    backorder.OrderID,
+		"item_id":     backorder.ProductID,
+		"quantity":    backorder.Quantity,
+		"user_email":  backorder.UserEmail,
+		"allocations": reservation.Allocations,
+		"filled_at":   time.Now(),
+	}
+
+	if err := s.publisher.PublishBackorderFilled(event, saga); err != nil {
+		log.Printf("Failed to publish inventory.backorder_filled event: %v", err)
+	}
+
+	if saga.InventoryFirst() {
+		s.publishInventoryReservedEvent(backorder.OrderID, backorder.ProductID, backorder.Quantity, backorder.UserEmail, backorder.TotalMinor, backorder.Currency, reservation.Allocations, saga)
+		return
+	}
+
+	message := fmt.Sprintf("Backordered stock arrived after %s and was deducted", waited)
+	s.deductReserved(backorder.OrderID, backorder.ProductID, backorder.Quantity, backorder.UserEmail, message, saga)
+}
+
+// ExpireBackorders gives up on orders that waited longer than the backorder
+// wait and publishes inventory.failed for each, so the order is cancelled and
+// its payment refunded as for any other stock failure. It returns how many
+// were expired.
+func (s *InventoryService) ExpireBackorders(limit int) (int, error) {
+	expired, err := s.backorders.ExpireOverdue(time.Now(), limit)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range expired {
+		backorder := &expired[i]
+		saga := sagaOf(backorder)
+		reason := fmt.Sprintf("Backorder not filled within %s", s.backorderWait)
+		log.Printf("Expired backorder of %d x %s for order %s: %s", backorder.Quantity, backorder.ProductID, backorder.OrderID, reason)
+
+		event := map[string]interface{}{
+			"order_id":   backorder.OrderID,
+			"item_id":    backorder.ProductID,
+			"quantity":   backorder.Quantity,
+			"user_email": backorder.UserEmail,
+			"reason":     reason,
+			"expired_at": backorder.UpdatedAt,
+		}
+
+		if err := s.publisher.PublishBackorderExpired(event, saga); err != nil {
+			log.Printf("Failed to publish inventory.backorder_expired event: %v", err)
+		}
+
+		s.publishInventoryFailedEvent(backorder.OrderID, backorder.ProductID, backorder.Quantity, backorder.UserEmail, reason, saga)
+	}
+
+	return len(expired), nil
+}
+
+// cancelBackorders takes an order that was cancelled out of the queues it was
+// waiting in
+func (s *InventoryService) cancelBackorders(orderID, reason string) error {
+	cancelled, err := s.backorders.CancelOrder(orderID)
+	if err != nil {
+		return err
+	}
+
+	for i := range cancelled {
+		backorder := &cancelled[i]
+		log.Printf("Cancelled backorder of %d x %s for order %s (reason: %s)", backorder.Quantity, backorder.ProductID, orderID, reason)
+
+		event := map[string]interface{}{
+			"order_id":     backorder.OrderID,
+			"item_id":      backorder.ProductID,
+			"quantity":     backorder.Quantity,
+			"user_email":   backorder.UserEmail,
+			"reason":       reason,
+			"cancelled_at": backorder.UpdatedAt,
+		}
+
+		if err := s.publisher.PublishBackorderCancelled(event, sagaOf(backorder)); err != nil {
+			log.Printf("Failed to publish inventory.backorder_cancelled event: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// sagaOf returns the saga context a backorder was placed in
+func sagaOf(backorder *models.Backorder) messaging.SagaContext {
+	return messaging.SagaContext{Mode: backorder.SagaMode, Order: backorder.SagaOrder}
+}
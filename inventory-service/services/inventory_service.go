@@ -2,50 +2,353 @@ package services
 
 import (
 	"log"
+	"sync"
 	"time"
 
 	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/messaging"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
 	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/repository"
 )
 
 type InventoryService struct {
-	repo      *repository.InventoryRepository
-	publisher *messaging.Publisher
+	repo           *repository.InventoryRepository
+	reservations   *repository.ReservationRepository
+	warehouses     *repository.WarehouseRepository
+	backorders     *repository.BackorderRepository
+	publisher      *messaging.Publisher
+	reservationTTL time.Duration
+	backorderWait  time.Duration
+
+	// filling maps the products whose backorders are being filled to
+	// whether another fill was asked for meanwhile
+	fillMu  sync.Mutex
+	filling map[string]bool
 }
 
-func NewInventoryService(repo *repository.InventoryRepository, publisher *messaging.Publisher) *InventoryService {
+func NewInventoryService(repo *repository.InventoryRepository, reservations *repository.ReservationRepository, warehouses *repository.WarehouseRepository, backorders *repository.BackorderRepository, publisher *messaging.Publisher, reservationTTL, backorderWait time.Duration) *InventoryService {
 	return &InventoryService{
-		repo:      repo,
-		publisher: publisher,
+		repo:           repo,
+		reservations:   reservations,
+		warehouses:     warehouses,
+		backorders:     backorders,
+		publisher:      publisher,
+		reservationTTL: reservationTTL,
+		backorderWait:  backorderWait,
+		filling:        make(map[string]bool),
 	}
 }
 
-func (s *InventoryService) ProcessOrder(orderID, itemID string, quantity int, userEmail string) {
+// ProcessOrder reserves and deducts stock for an order that has already been
+// paid for, from warehouses picked for its ship-to region. Orders for a
+// product that allows backorders wait for stock if there is not enough. The
+// saga context is carried over to the resulting event so the saga that asked
+// for it gets the reply.
+func (s *InventoryService) ProcessOrder(orderID, itemID string, quantity int, userEmail, shipToRegion string, saga messaging.SagaContext) {
 	log.Printf("Processing order: %s for item: %s, quantity: %d", orderID, itemID, quantity)
 
 	// Check and reserve stock
-	err := s.repo.ReserveStock(itemID, quantity)
+	backorder := &models.Backorder{
+		OrderID:      orderID,
+		ProductID:    itemID,
+		Quantity:     quantity,
+		UserEmail:    userEmail,
+		ShipToRegion: shipToRegion,
+		SagaMode:     saga.Mode,
+		SagaOrder:    saga.Order,
+	}
+	_, backordered, err := s.reserveOrBackorder(backorder)
 	if err != nil {
 		log.Printf("Failed to reserve stock: %v", err)
 		// Publish inventory.failed event for out of stock
-		s.publishInventoryFailedEvent(orderID, itemID, quantity, userEmail, err.Error())
+		s.publishInventoryFailedEvent(orderID, itemID, quantity, userEmail, err.Error(), saga)
+		return
+	}
+	if backordered {
 		return
 	}
 
+	s.deductReserved(orderID, itemID, quantity, userEmail, "Stock reserved and deducted successfully", saga)
+}
+
+// deductReserved deducts the stock reserved for a paid order and publishes
+// inventory.successful, or releases it and publishes inventory.failed
+func (s *InventoryService) deductReserved(orderID, itemID string, quantity int, userEmail, message string, saga messaging.SagaContext) {
 	// Deduct stock
-	err = s.repo.DeductStock(itemID, quantity)
+	reservation, err := s.reservations.Commit(orderID, itemID)
 	if err != nil {
 		log.Printf("Failed to deduct stock: %v", err)
+		// Give the stock back now rather than when the reservation expires
+		if _, releaseErr := s.reservations.Release(orderID, itemID); releaseErr != nil {
+			log.Printf("Failed to release reservation for order %s: %v", orderID, releaseErr)
+		}
+		s.PublishProductEvent("product.stock_changed", itemID)
 		// Publish inventory.failed event
-		s.publishInventoryFailedEvent(orderID, itemID, quantity, userEmail, err.Error())
+		s.publishInventoryFailedEvent(orderID, itemID, quantity, userEmail, err.Error(), saga)
 		return
 	}
 
+	s.PublishProductEvent("product.stock_changed", itemID)
+
 	log.Printf("Successfully processed inventory for order: %s", orderID)
-	s.publishInventorySuccessfulEvent(orderID, itemID, quantity, userEmail, "Stock reserved and deducted successfully")
+	s.publishInventorySuccessfulEvent(orderID, itemID, quantity, userEmail, reservation.Allocations, message, saga)
+}
+
+// ReserveOrder holds stock for an order of an inventory-first saga before it
+// is paid for. Payment is charged on the resulting inventory.reserved event.
+// Orders for a product that allows backorders wait for stock if there is not
+// enough.
+func (s *InventoryService) ReserveOrder(orderID, itemID string, quantity int, userEmail, shipToRegion string, totalMinor int64, currency string, saga messaging.SagaContext) {
+	log.Printf("Reserving stock for order: %s, item: %s, quantity: %d", orderID, itemID, quantity)
+
+	backorder := &models.Backorder{
+		OrderID:      orderID,
+		ProductID:    itemID,
+		Quantity:     quantity,
+		UserEmail:    userEmail,
+		ShipToRegion: shipToRegion,
+		TotalMinor:   totalMinor,
+		Currency:     currency,
+		SagaMode:     saga.Mode,
+		SagaOrder:    saga.Order,
+	}
+	reservation, backordered, err := s.reserveOrBackorder(backorder)
+	if err != nil {
+		log.Printf("Failed to reserve stock: %v", err)
+		s.publishInventoryFailedEvent(orderID, itemID, quantity, userEmail, err.Error(), saga)
+		return
+	}
+	if backordered {
+		return
+	}
+
+	s.PublishProductEvent("product.stock_changed", itemID)
+	s.publishInventoryReservedEvent(orderID, itemID, quantity, userEmail, totalMinor, currency, reservation.Allocations, saga)
+}
+
+// CommitOrder deducts the stock held for a paid order of an inventory-first
+// saga
+func (s *InventoryService) CommitOrder(orderID, itemID string, quantity int, userEmail string, saga messaging.SagaContext) {
+	log.Printf("Committing reserved stock for order: %s, item: %s, quantity: %d", orderID, itemID, quantity)
+
+	reservation, err := s.reservations.Commit(orderID, itemID)
+	if err != nil {
+		log.Printf("Failed to commit reservation: %v", err)
+		s.PublishProductEvent("product.stock_changed", itemID)
+		// The payment service refunds on inventory.failed
+		s.publishInventoryFailedEvent(orderID, itemID, quantity, userEmail, err.Error(), saga)
+		return
+	}
+
+	s.PublishProductEvent("product.stock_changed", itemID)
+
+	log.Printf("Successfully committed inventory for order: %s", orderID)
+	s.publishInventorySuccessfulEvent(orderID, itemID, quantity, userEmail, reservation.Allocations, "Reserved stock deducted successfully", saga)
 }
 
-func (s *InventoryService) publishInventoryEvent(orderID, itemID string, quantity int, userEmail, status, message string) {
+// ReleaseOrder gives back the stock held for an order of an inventory-first
+// saga whose payment failed
+func (s *InventoryService) ReleaseOrder(orderID, itemID string, quantity int, reason string) {
+	log.Printf("Releasing reserved stock for order: %s, item: %s, quantity: %d (reason: %s)", orderID, itemID, quantity, reason)
+
+	released, err := s.reservations.Release(orderID, itemID)
+	if err != nil {
+		log.Printf("Failed to release reserved stock for order %s: %v", orderID, err)
+		return
+	}
+	if !released {
+		log.Printf("Reservation for order %s is no longer held", orderID)
+		return
+	}
+
+	s.PublishProductEvent("product.stock_changed", itemID)
+}
+
+// CompensateOrder gives back the stock held or already deducted for an order
+// that was cancelled or timed out, and publishes inventory.released. An order
+// is compensated once; repeated events for it are ignored.
+func (s *InventoryService) CompensateOrder(orderID, reason string) error {
+	released, compensated, err := s.reservations.ReleaseOrder(orderID, reason)
+	if err != nil {
+		return err
+	}
+	if !compensated {
+		log.Printf("Order %s was already compensated", orderID)
+		return nil
+	}
+
+	// The order can no longer wait for stock either
+	if err := s.cancelBackorders(orderID, reason); err != nil {
+		log.Printf("Failed to cancel backorders for order %s: %v", orderID, err)
+	}
+
+	for _, stock := range released {
+		log.Printf("Gave back %d x %s for order %s (restocked: %t)", stock.Quantity, stock.ProductID, orderID, stock.Restocked)
+		s.PublishProductEvent("product.stock_changed", stock.ProductID)
+	}
+
+	event := map[string]interface{}{
+		"order_id":    orderID,
+		"items":       released,
+		"reason":      reason,
+		"released_at": time.Now(),
+	}
+
+	if err := s.publisher.PublishInventoryReleased(event); err != nil {
+		log.Printf("Failed to publish inventory.released event: %v", err)
+	}
+
+	return nil
+}
+
+// ReleaseExpiredReservations gives back stock held by reservations whose TTL
+// elapsed, e.g. because the service crashed between reserving and deducting
+// or payment never answered. It returns how many were released.
+func (s *InventoryService) ReleaseExpiredReservations(limit int) (int, error) {
+	expired, err := s.reservations.ReleaseExpired(time.Now(), limit)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := make(map[string]bool)
+	for _, reservation := range expired {
+		log.Printf("Released expired reservation of %d x %s for order %s", reservation.Quantity, reservation.ProductID, reservation.OrderID)
+		changed[reservation.ProductID] = true
+	}
+
+	for productID := range changed {
+		s.PublishProductEvent("product.stock_changed", productID)
+	}
+
+	return len(expired), nil
+}
+
+// CreateProduct adds a product to the catalog and publishes product.created.
+// actor is recorded in the stock ledger.
+func (s *InventoryService) CreateProduct(req *models.CreateProductRequest, actor string) (*models.Product, error) {
+	product, err := s.repo.CreateProduct(req, actor)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Created product %s (%s)", product.ID, product.Name)
+	s.PublishProductEvent("product.created", product.ID)
+	return product, nil
+}
+
+// UpdateProduct changes a product's name and price and publishes
+// product.updated
+func (s *InventoryService) UpdateProduct(productID string, req *models.UpdateProductRequest) (*models.Product, error) {
+	product, err := s.repo.UpdateProduct(productID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Updated product %s", product.ID)
+	s.PublishProductEvent("product.updated", product.ID)
+	return product, nil
+}
+
+// AdjustStock changes a product's on-hand stock in a warehouse, e.g. after a
+// delivery or a stock count, and publishes product.stock_changed. actor is
+// recorded in the stock ledger.
+func (s *InventoryService) AdjustStock(productID string, req *models.AdjustStockRequest, actor string) (*models.Product, error) {
+	warehouseID := req.WarehouseID
+	if warehouseID == "" {
+		warehouseID = models.DefaultWarehouseID
+	}
+
+	product, err := s.repo.AdjustStock(productID, warehouseID, req.Delta, actor, req.Reason)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("%s adjusted stock of product %s in %s by %d to %d in total (reason: %s)", actor, product.ID, warehouseID, req.Delta, product.Stock, req.Reason)
+	s.PublishProductEvent("product.stock_changed", product.ID)
+	return product, nil
+}
+
+// PublishProductEvent publishes the current state of a product so that
+// read models such as the order service's catalog projection stay in sync.
+// Since every stock change ends up here, it also reports the product's
+// available stock crossing its reorder threshold and fills backorders waiting
+// for it.
+func (s *InventoryService) PublishProductEvent(eventType, productID string) {
+	product, err := s.repo.GetProduct(productID)
+	if err != nil {
+		log.Printf("Failed to load product %s for %s event: %v", productID, eventType, err)
+		return
+	}
+
+	event := models.ProductEvent{
+		ProductID:      product.ID,
+		Name:           product.Name,
+		Stock:          product.Stock,
+		Reserved:       product.Reserved,
+		PriceMinor:     product.PriceMinor,
+		Currency:       product.Currency,
+		AllowBackorder: product.AllowBackorder,
+		Version:        product.Version,
+		ParentID:       product.ParentID,
+		Attributes:     product.Attributes,
+		UpdatedAt:      product.UpdatedAt,
+		OccurredAt:     time.Now(),
+	}
+
+	switch eventType {
+	case "product.created":
+		err = s.publisher.PublishProductCreated(event)
+	case "product.updated":
+		err = s.publisher.PublishProductUpdated(event)
+	default:
+		err = s.publisher.PublishProductStockChanged(event)
+	}
+	if err != nil {
+		log.Printf("Failed to publish %s event: %v", eventType, err)
+	}
+
+	s.publishStockAlert(productID)
+	s.FillBackorders(productID)
+}
+
+// publishStockAlert publishes inventory.out_of_stock when nothing of a product
+// is available any more, inventory.low_stock when its available stock drops
+// to its reorder threshold, and inventory.restocked when it is back above it
+func (s *InventoryService) publishStockAlert(productID string) {
+	alert, err := s.repo.UpdateStockAlert(productID)
+	if err != nil {
+		log.Printf("Failed to check stock alert level of product %s: %v", productID, err)
+		return
+	}
+	if alert == nil {
+		return
+	}
+
+	event := models.StockAlertEvent{
+		ProductID:        alert.ProductID,
+		Name:             alert.Name,
+		Stock:            alert.Stock,
+		Reserved:         alert.Reserved,
+		Available:        alert.Stock - alert.Reserved,
+		ReorderThreshold: alert.ReorderThreshold,
+		PreviousLevel:    alert.From,
+		Level:            alert.To,
+		OccurredAt:       time.Now(),
+	}
+
+	switch alert.To {
+	case models.StockAlertOut:
+		err = s.publisher.PublishOutOfStock(event)
+	case models.StockAlertLow:
+		err = s.publisher.PublishLowStock(event)
+	default:
+		err = s.publisher.PublishRestocked(event)
+	}
+	if err != nil {
+		log.Printf("Failed to publish stock alert for product %s: %v", productID, err)
+	}
+}
+
+func (s *InventoryService) publishInventoryEvent(orderID, itemID string, quantity int, userEmail, status, message string, saga messaging.SagaContext) {
 	event := map[string]interface{}{
 		"order_id":     orderID,
 		"item_id":      itemID,
@@ -56,27 +359,58 @@ func (s *InventoryService) publishInventoryEvent(orderID, itemID string, quantit
 		"processed_at": time.Now(),
 	}
 
-	if err := s.publisher.PublishInventoryProcessed(event); err != nil {
+	if err := s.publisher.PublishInventoryProcessed(event, saga); err != nil {
 		log.Printf("Failed to publish inventory.processed event: %v", err)
 	}
 }
 
-func (s *InventoryService) publishInventorySuccessfulEvent(orderID, itemID string, quantity int, userEmail, message string) {
+// publishInventorySuccessfulEvent tells fulfilment where to ship from:
+// warehouse_id is the warehouse holding most of the order (the only one
+// unless the stock had to be split) and allocations has every warehouse
+func (s *InventoryService) publishInventorySuccessfulEvent(orderID, itemID string, quantity int, userEmail string, allocations []models.Allocation, message string, saga messaging.SagaContext) {
+	warehouseID := ""
+	largest := 0
+	for _, allocation := range allocations {
+		if allocation.Quantity > largest {
+			warehouseID = allocation.WarehouseID
+			largest = allocation.Quantity
+		}
+	}
+
 	event := map[string]interface{}{
 		"order_id":     orderID,
 		"item_id":      itemID,
 		"quantity":     quantity,
 		"user_email":   userEmail,
+		"warehouse_id": warehouseID,
+		"allocations":  allocations,
 		"message":      message,
 		"processed_at": time.Now(),
 	}
 
-	if err := s.publisher.PublishInventorySuccessful(event); err != nil {
+	if err := s.publisher.PublishInventorySuccessful(event, saga); err != nil {
 		log.Printf("Failed to publish inventory.successful event: %v", err)
 	}
 }
 
-func (s *InventoryService) publishInventoryFailedEvent(orderID, itemID string, quantity int, userEmail, reason string) {
+func (s *InventoryService) publishInventoryReservedEvent(orderID, itemID string, quantity int, userEmail string, totalMinor int64, currency string, allocations []models.Allocation, saga messaging.SagaContext) {
+	event := map[string]interface{}{
+		"order_id":    orderID,
+		"item_id":     itemID,
+		"quantity":    quantity,
+		"user_email":  userEmail,
+		"total_minor": totalMinor,
+		"currency":    currency,
+		"allocations": allocations,
+		"reserved_at": time.Now(),
+	}
+
+	if err := s.publisher.PublishInventoryReserved(event, saga); err != nil {
+		log.Printf("Failed to publish inventory.reserved event: %v", err)
+	}
+}
+
+func (s *InventoryService) publishInventoryFailedEvent(orderID, itemID string, quantity int, userEmail, reason string, saga messaging.SagaContext) {
 	event := map[string]interface{}{
 		"order_id":   orderID,
 		"item_id":    itemID,
@@ -86,7 +420,7 @@ func (s *InventoryService) publishInventoryFailedEvent(orderID, itemID string, q
 		"failed_at":  time.Now(),
 	}
 
-	if err := s.publisher.PublishInventoryFailed(event); err != nil {
+	if err := s.publisher.PublishInventoryFailed(event, saga); err != nil {
 		log.Printf("Failed to publish inventory.failed event: %v", err)
 	}
 }
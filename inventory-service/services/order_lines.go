@@ -0,0 +1,198 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/messaging"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
+)
+
+// ProcessOrderLines is ProcessOrder for an order of several lines: all lines
+// are reserved in one transaction, or none are and inventory.failed gives the
+// reason for each line that could not be, and then deducted.
+func (s *InventoryService) ProcessOrderLines(orderID string, lines []models.OrderLine, userEmail, shipToRegion string, saga messaging.SagaContext) {
+	log.Printf("Processing order: %s with %d lines", orderID, len(lines))
+
+	reservations, ok := s.reserveLines(orderID, lines, userEmail, shipToRegion, saga)
+	if !ok {
+		return
+	}
+
+	s.commitLines(orderID, lines, reservations, userEmail, "Stock reserved and deducted successfully", saga)
+}
+
+// ReserveOrderLines is ReserveOrder for an order of several lines: all lines
+// are reserved in one transaction before payment, or none are
+func (s *InventoryService) ReserveOrderLines(orderID string, lines []models.OrderLine, userEmail, shipToRegion string, totalMinor int64, currency string, saga messaging.SagaContext) {
+	log.Printf("Reserving stock for order: %s with %d lines", orderID, len(lines))
+
+	reservations, ok := s.reserveLines(orderID, lines, userEmail, shipToRegion, saga)
+	if !ok {
+		return
+	}
+
+	event := map[string]interface{}{
+		"order_id":    orderID,
+		"item_id":     lines[0].ItemID,
+		"quantity":    totalQuantity(lines),
+		"items":       lineItems(reservations),
+		"user_email":  userEmail,
+		"total_minor": totalMinor,
+		"currency":    currency,
+		"reserved_at": time.Now(),
+	}
+
+	if err := s.publisher.PublishInventoryReserved(event, saga); err != nil {
+		log.Printf("Failed to publish inventory.reserved event: %v", err)
+	}
+}
+
+// CommitOrderLines deducts the stock held for every line of a paid order of
+// an inventory-first saga
+func (s *InventoryService) CommitOrderLines(orderID string, lines []models.OrderLine, userEmail string, saga messaging.SagaContext) {
+	log.Printf("Committing reserved stock for order: %s with %d lines", orderID, len(lines))
+
+	reservations := make([]models.StockReservation, 0, len(lines))
+	for _, line := range lines {
+		reservations = append(reservations, models.StockReservation{OrderID: orderID, ProductID: line.ItemID, Quantity: line.Quantity})
+	}
+
+	s.commitLines(orderID, lines, reservations, userEmail, "Reserved stock deducted successfully", saga)
+}
+
+// ReleaseOrderLines gives back the stock held for every line of an order of
+// an inventory-first saga whose payment failed
+func (s *InventoryService) ReleaseOrderLines(orderID string, lines []models.OrderLine, reason string) {
+	for _, line := range lines {
+		s.ReleaseOrder(orderID, line.ItemID, line.Quantity, reason)
+	}
+}
+
+// reserveLines reserves all lines of an order at once. If that fails it
+// publishes inventory.failed and reports false.
+func (s *InventoryService) reserveLines(orderID string, lines []models.OrderLine, userEmail, shipToRegion string, saga messaging.SagaContext) ([]models.StockReservation, bool) {
+	reservations, failures, err := s.reservations.ReserveBatch(orderID, lines, shipToRegion, s.reservationTTL)
+	if err != nil {
+		log.Printf("Failed to reserve stock for order %s: %v", orderID, err)
+		s.publishLinesFailedEvent(orderID, lines, userEmail, err.Error(), nil, saga)
+		return nil, false
+	}
+
+	if len(failures) > 0 {
+		reason := describeFailures(failures)
+		log.Printf("Cannot reserve stock for order %s: %s", orderID, reason)
+		s.publishLinesFailedEvent(orderID, lines, userEmail, reason, failures, saga)
+		return nil, false
+	}
+
+	for _, reservation := range reservations {
+		s.PublishProductEvent("product.stock_changed", reservation.ProductID)
+	}
+
+	return reservations, true
+}
+
+// commitLines deducts the stock reserved for all lines at once and publishes
+// inventory.successful. If a line cannot be deducted nothing is, the stock
+// held for the order is released and inventory.failed is published.
+func (s *InventoryService) commitLines(orderID string, lines []models.OrderLine, reservations []models.StockReservation, userEmail, message string, saga messaging.SagaContext) {
+	productIDs := make([]string, 0, len(reservations))
+	for _, reservation := range reservations {
+		productIDs = append(productIDs, reservation.ProductID)
+	}
+
+	deducted, err := s.reservations.CommitBatch(orderID, productIDs)
+	if err != nil {
+		log.Printf("Failed to deduct stock for order %s: %v", orderID, err)
+		for _, productID := range productIDs {
+			s.PublishProductEvent("product.stock_changed", productID)
+		}
+		s.publishLinesFailedEvent(orderID, lines, userEmail, fmt.Sprintf("failed to deduct stock: %v", err), nil, saga)
+		return
+	}
+
+	// Report the lines in order; they were deducted in product ID order
+	byProduct := make(map[string]models.StockReservation, len(deducted))
+	for _, reservation := range deducted {
+		byProduct[reservation.ProductID] = reservation
+	}
+	committed := make([]models.StockReservation, 0, len(productIDs))
+	for _, productID := range productIDs {
+		committed = append(committed, byProduct[productID])
+	}
+
+	for _, reservation := range committed {
+		s.PublishProductEvent("product.stock_changed", reservation.ProductID)
+	}
+
+	log.Printf("Successfully processed inventory for order: %s", orderID)
+
+	event := map[string]interface{}{
+		"order_id":     orderID,
+		"item_id":      lines[0].ItemID,
+		"quantity":     totalQuantity(lines),
+		"items":        lineItems(committed),
+		"user_email":   userEmail,
+		"message":      message,
+		"processed_at": time.Now(),
+	}
+
+	if err := s.publisher.PublishInventorySuccessful(event, saga); err != nil {
+		log.Printf("Failed to publish inventory.successful event: %v", err)
+	}
+}
+
+func (s *InventoryService) publishLinesFailedEvent(orderID string, lines []models.OrderLine, userEmail, reason string, failures []models.LineFailure, saga messaging.SagaContext) {
+	if failures == nil {
+		failures = []models.LineFailure{}
+	}
+
+	event := map[string]interface{}{
+		"order_id":   orderID,
+		"item_id":    lines[0].ItemID,
+		"quantity":   totalQuantity(lines),
+		"items":      lines,
+		"failures":   failures,
+		"user_email": userEmail,
+		"reason":     reason,
+		"failed_at":  time.Now(),
+	}
+
+	if err := s.publisher.PublishInventoryFailed(event, saga); err != nil {
+		log.Printf("Failed to publish inventory.failed event: %v", err)
+	}
+}
+
+// describeFailures sums up line failures in one reason, e.g. "line 2
+// (product-002): insufficient stock: requested 5, available 3"
+func describeFailures(failures []models.LineFailure) string {
+	reasons := make([]string, 0, len(failures))
+	for _, failure := range failures {
+		reasons = append(reasons, fmt.Sprintf("line %d (%s): %s", failure.Line, failure.ItemID, failure.Reason))
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// lineItems lists what each line of an order holds, and where
+func lineItems(reservations []models.StockReservation) []map[string]interface{} {
+	items := make([]map[string]interface{}, 0, len(reservations))
+	for _, reservation := range reservations {
+		items = append(items, map[string]interface{}{
+			"item_id":     reservation.ProductID,
+			"quantity":    reservation.Quantity,
+			"allocations": reservation.Allocations,
+		})
+	}
+	return items
+}
+
+func totalQuantity(lines []models.OrderLine) int {
+	total := 0
+	for _, line := range lines {
+		total += line.Quantity
+	}
+	return total
+}
@@ -0,0 +1,207 @@
+package services
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
+)
+
+// ErrInvalidCSV is returned for an import file that cannot be read at all,
+// e.g. one missing a required column. Problems with single rows are reported
+// in the import result instead.
+var ErrInvalidCSV = errors.New("invalid CSV")
+
+// importColumns are the columns a product import must have, in any order. An
+// optional warehouse_id column says where the stock is held (default: main).
+var importColumns = []string{"id", "name", "stock", "price_minor", "currency"}
+
+// exportColumns are the columns of a product export, one row per product and
+// warehouse
+var exportColumns = []string{"id", "name", "warehouse_id", "stock", "reserved", "available", "price_minor", "currency"}
+
+// ImportProductsCSV creates or updates products from CSV with the columns in
+// importColumns. Each valid row is upserted; invalid rows are reported with
+// their line number and skipped. With dryRun nothing is written or published.
+// actor is recorded in the stock ledger.
+func (s *InventoryService) ImportProductsCSV(r io.Reader, dryRun bool, actor string) (*models.ImportResult, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading header: %v", ErrInvalidCSV, err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range importColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("%w: missing column %q", ErrInvalidCSV, name)
+		}
+	}
+
+	result := &models.ImportResult{DryRun: dryRun, Errors: []models.ImportRowError{}}
+	rows := []models.ProductImportRow{}
+	seen := make(map[string]int)
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		result.Rows++
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			result.AddError(parseErr.StartLine, "", parseErr.Err.Error())
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCSV, err)
+		}
+
+		line, _ := reader.FieldPos(0)
+
+		row, err := parseImportRow(record, columns)
+		row.Line = line
+		if err != nil {
+			result.AddError(line, row.ID, err.Error())
+			continue
+		}
+
+		key := row.ID + "/" + row.WarehouseID
+		if first, ok := seen[key]; ok {
+			result.AddError(line, row.ID, fmt.Sprintf("duplicate of line %d", first))
+			continue
+		}
+		seen[key] = line
+
+		rows = append(rows, row)
+	}
+
+	created, updated, err := s.repo.ImportProducts(rows, dryRun, actor, result)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(result.Errors, func(i, j int) bool {
+		return result.Errors[i].Line < result.Errors[j].Line
+	})
+
+	if dryRun {
+		return result, nil
+	}
+
+	log.Printf("Imported products: %d rows, %d created, %d updated, %d unchanged, %d failed",
+		result.Rows, result.Created, result.Updated, result.Unchanged, result.Failed)
+
+	for _, productID := range created {
+		s.PublishProductEvent("product.created", productID)
+	}
+	for _, productID := range updated {
+		s.PublishProductEvent("product.updated", productID)
+	}
+
+	return result, nil
+}
+
+// parseImportRow validates one CSV record with the same rules as the product
+// API
+func parseImportRow(record []string, columns map[string]int) (models.ProductImportRow, error) {
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	row := models.ProductImportRow{
+		ID:          field("id"),
+		Name:        field("name"),
+		WarehouseID: field("warehouse_id"),
+		Currency:    field("currency"),
+	}
+	if row.WarehouseID == "" {
+		row.WarehouseID = models.DefaultWarehouseID
+	}
+
+	if row.ID == "" || len(row.ID) > 255 {
+		return row, errors.New("id must be 1-255 characters")
+	}
+	if row.Name == "" || len(row.Name) > 255 {
+		return row, errors.New("name must be 1-255 characters")
+	}
+
+	stock, err := strconv.Atoi(field("stock"))
+	if err != nil || stock < 0 {
+		return row, fmt.Errorf("stock %q must be a whole number of at least 0", field("stock"))
+	}
+	row.Stock = stock
+
+	price, err := strconv.ParseInt(field("price_minor"), 10, 64)
+	if err != nil || price < 1 {
+		return row, fmt.Errorf("price_minor %q must be a whole number of at least 1", field("price_minor"))
+	}
+	row.PriceMinor = price
+
+	if len(row.Currency) != 3 || strings.ToUpper(row.Currency) != row.Currency {
+		return row, fmt.Errorf("currency %q must be a 3-letter upper-case code", row.Currency)
+	}
+
+	return row, nil
+}
+
+// ExportProductsCSV writes every product's stock levels and price as CSV with
+// the columns in exportColumns
+func (s *InventoryService) ExportProductsCSV(w io.Writer) error {
+	products, err := s.repo.ListProducts()
+	if err != nil {
+		return err
+	}
+
+	levels, err := s.warehouses.ListStockLevels("")
+	if err != nil {
+		return err
+	}
+
+	byProduct := make(map[string][]models.StockLevel)
+	for _, level := range levels {
+		byProduct[level.ProductID] = append(byProduct[level.ProductID], level)
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(exportColumns); err != nil {
+		return err
+	}
+
+	for _, product := range products {
+		for _, level := range byProduct[product.ID] {
+			record := []string{
+				product.ID,
+				product.Name,
+				level.WarehouseID,
+				strconv.Itoa(level.Stock),
+				strconv.Itoa(level.Reserved),
+				strconv.Itoa(level.Available()),
+				strconv.FormatInt(product.PriceMinor, 10),
+				product.Currency,
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"time"
+)
+
+// sweeperBatchSize caps how many expired reservations are released per run
+const sweeperBatchSize = 100
+
+// Sweeper outcomes, exposed on /debug/vars
+var (
+	reservationsExpired = expvar.NewInt("inventory_reservations_expired")
+	backordersExpired   = expvar.NewInt("inventory_backorders_expired")
+)
+
+// ReservationSweeper periodically releases reservations whose TTL elapsed so
+// that stock held for orders that never finished goes back on sale, and
+// gives up on backorders that waited too long for stock.
+type ReservationSweeper struct {
+	inventoryService *InventoryService
+	interval         time.Duration
+}
+
+func NewReservationSweeper(inventoryService *InventoryService, interval time.Duration) *ReservationSweeper {
+	return &ReservationSweeper{
+		inventoryService: inventoryService,
+		interval:         interval,
+	}
+}
+
+// Start runs the sweeper until ctx is cancelled
+func (w *ReservationSweeper) Start(ctx context.Context) {
+	log.Printf("Reservation sweeper started (interval %s)", w.interval)
+
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Println("Reservation sweeper stopped")
+				return
+			case <-ticker.C:
+				w.sweep()
+			}
+		}
+	}()
+}
+
+func (w *ReservationSweeper) sweep() {
+	// Keep going while full batches come back
+	for {
+		released, err := w.inventoryService.ReleaseExpiredReservations(sweeperBatchSize)
+		if err != nil {
+			log.Printf("Reservation sweeper failed to release expired reservations: %v", err)
+			break
+		}
+
+		reservationsExpired.Add(int64(released))
+		if released < sweeperBatchSize {
+			break
+		}
+	}
+
+	for {
+		expired, err := w.inventoryService.ExpireBackorders(sweeperBatchSize)
+		if err != nil {
+			log.Printf("Reservation sweeper failed to expire backorders: %v", err)
+			return
+		}
+
+		backordersExpired.Add(int64(expired))
+		if expired < sweeperBatchSize {
+			return
+		}
+	}
+}
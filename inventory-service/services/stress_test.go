@@ -0,0 +1,178 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/allocation"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/database"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/models"
+	"github.com/spksupakorn/ecommerce-event-driven/inventory-service/repository"
+)
+
+// TestConcurrentReservationsDoNotOversell has workers reserve stock of one
+// product for orders in parallel, the way concurrent consumers do. Every
+// fourth reserved order is released and the rest are committed. No more may
+// be sold than was in stock, and the product's counters must add up and
+// match the ledger.
+//
+// It needs a PostgreSQL database it may write to, named by
+// TEST_DATABASE_URL, and is skipped without one. The product it creates is
+// removed afterwards.
+func TestConcurrentReservationsDoNotOversell(t *testing.T) {
+	const (
+		stock    = 100
+		orders   = 500
+		quantity = 1
+		workers  = 20
+	)
+
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := database.InitDB(databaseURL)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %v", err)
+	}
+	t.Cleanup(func() { database.CloseDB(db) })
+
+	strategy, err := allocation.New("priority")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := repository.NewInventoryRepository(db)
+	reservations := repository.NewReservationRepository(db, strategy)
+	movements := repository.NewStockMovementRepository(db)
+
+	productID := fmt.Sprintf("stress-%d", time.Now().UnixNano())
+	t.Cleanup(func() { deleteProduct(t, db, productID) })
+
+	_, err = repo.CreateProduct(&models.CreateProductRequest{
+		ID:         productID,
+		Name:       "Stress test product",
+		Stock:      stock,
+		PriceMinor: 1,
+		Currency:   "USD",
+	}, models.ActorCLI)
+	if err != nil {
+		t.Fatalf("Failed to create product: %v", err)
+	}
+
+	jobs := make(chan int)
+	var mu sync.Mutex
+	var committed, released int
+	var failures []error
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				outcome, err := stressOrder(reservations, productID, i, quantity)
+
+				mu.Lock()
+				switch {
+				case err != nil:
+					failures = append(failures, err)
+				case outcome == models.ReservationCommitted:
+					committed++
+				case outcome == models.ReservationReleased:
+					released++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := 0; i < orders; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if len(failures) > 0 {
+		t.Fatalf("%d of %d orders failed, first: %v", len(failures), orders, failures[0])
+	}
+
+	product, err := repo.GetProduct(productID)
+	if err != nil {
+		t.Fatalf("Failed to get product: %v", err)
+	}
+
+	sold := committed * quantity
+	if sold > stock {
+		t.Errorf("oversold: %d units sold from %d in stock", sold, stock)
+	}
+	if product.Stock != stock-sold {
+		t.Errorf("stock is %d, expected %d", product.Stock, stock-sold)
+	}
+	if product.Reserved != 0 {
+		t.Errorf("%d units are still reserved", product.Reserved)
+	}
+
+	check, err := movements.CheckLedger()
+	if err != nil {
+		t.Fatalf("Failed to check stock ledger: %v", err)
+	}
+	for _, m := range check.Mismatches {
+		if m.ProductID == productID {
+			t.Errorf("ledger says stock %d, reserved %d in %q", m.LedgerStock, m.LedgerReserved, m.WarehouseID)
+		}
+	}
+
+	t.Logf("%d committed, %d released, %d rejected; stock %d", committed, released, orders-committed-released, product.Stock)
+}
+
+// stressOrder reserves quantity for the i-th stress test order and then
+// releases or commits it. It returns the reservation's final state, or "" if
+// there was not enough stock to reserve.
+func stressOrder(reservations *repository.ReservationRepository, productID string, i, quantity int) (string, error) {
+	orderID := fmt.Sprintf("%s-order-%d", productID, i)
+
+	if _, err := reservations.Reserve(orderID, productID, quantity, "", 15*time.Minute); err != nil {
+		if errors.Is(err, repository.ErrInsufficientStock) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	if i%4 == 3 {
+		if _, err := reservations.Release(orderID, productID); err != nil {
+			return "", err
+		}
+		return models.ReservationReleased, nil
+	}
+
+	if _, err := reservations.Commit(orderID, productID); err != nil {
+		return "", err
+	}
+	return models.ReservationCommitted, nil
+}
+
+// deleteProduct removes a test product and everything recorded for it
+func deleteProduct(t *testing.T, db *sql.DB, productID string) {
+	queries := []string{
+		`DELETE FROM reservation_allocations WHERE reservation_id IN (SELECT id FROM reservations WHERE product_id = $1)`,
+		`DELETE FROM reservations WHERE product_id = $1`,
+		`DELETE FROM backorders WHERE product_id = $1`,
+		`DELETE FROM stock_movements WHERE product_id = $1`,
+		`DELETE FROM stock_levels WHERE product_id = $1`,
+		`DELETE FROM products WHERE id = $1`,
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(query, productID); err != nil {
+			t.Errorf("Failed to clean up product %s: %v", productID, err)
+			return
+		}
+	}
+}
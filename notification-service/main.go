@@ -17,7 +17,7 @@ func main() {
 	cfg := config.LoadConfig()
 
 	// Initialize notification service
-	notificationService := services.NewNotificationService()
+	notificationService := services.NewNotificationService(cfg.OpsAlertEmail)
 
 	// Initialize consumer
 	consumer, err := messaging.NewConsumer(cfg.RabbitMQURL, notificationService)
@@ -3,6 +3,7 @@ package messaging
 import (
 	"encoding/json"
 	"log"
+	"time"
 
 	"github.com/spksupakorn/ecommerce-event-driven/notification-service/services"
 	"github.com/streadway/amqp"
@@ -40,12 +41,13 @@ type PaymentFailedEvent struct {
 }
 
 type PaymentRefundedEvent struct {
-	OrderID   string  `json:"order_id"`
-	ItemID    string  `json:"item_id"`
-	Quantity  int     `json:"quantity"`
-	UserEmail string  `json:"user_email"`
-	Amount    float64 `json:"amount"`
-	Reason    string  `json:"reason"`
+	OrderID     string `json:"order_id"`
+	ItemID      string `json:"item_id"`
+	Quantity    int    `json:"quantity"`
+	UserEmail   string `json:"user_email"`
+	AmountMinor int64  `json:"amount_minor"`
+	Currency    string `json:"currency"`
+	Reason      string `json:"reason"`
 }
 
 type InventorySuccessfulEvent struct {
@@ -56,6 +58,29 @@ type InventorySuccessfulEvent struct {
 	Message   string `json:"message"`
 }
 
+type InventoryBackorderedEvent struct {
+	OrderID   string    `json:"order_id"`
+	ItemID    string    `json:"item_id"`
+	Quantity  int       `json:"quantity"`
+	UserEmail string    `json:"user_email"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// StockAlertEvent is published as inventory.low_stock, inventory.out_of_stock
+// or inventory.restocked
+type StockAlertEvent struct {
+	ProductID        string `json:"product_id"`
+	Name             string `json:"name"`
+	Stock            int    `json:"stock"`
+	Reserved         int    `json:"reserved"`
+	Available        int    `json:"available"`
+	ReorderThreshold int    `json:"reorder_threshold"`
+	Level            string `json:"level"`
+}
+
+// stockAlertRoutingKeys are bound to the stock alert queue
+var stockAlertRoutingKeys = []string{"inventory.low_stock", "inventory.out_of_stock", "inventory.restocked"}
+
 func NewConsumer(rabbitMQURL string, notificationService *services.NotificationService) (*Consumer, error) {
 	conn, err := amqp.Dial(rabbitMQURL)
 	if err != nil {
@@ -245,6 +270,66 @@ func NewConsumer(rabbitMQURL string, notificationService *services.NotificationS
 		return nil, err
 	}
 
+	// Declare queue for inventory.backordered events
+	backorderedQueue, err := channel.QueueDeclare(
+		"inventory.backordered.notification.queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Bind backordered queue to exchange
+	err = channel.QueueBind(
+		backorderedQueue.Name,
+		"inventory.backordered",
+		"inventory",
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare queue for stock alerts to the operations team
+	stockAlertQueue, err := channel.QueueDeclare(
+		"inventory.stock_alert.notification.queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Bind stock alert queue to exchange
+	for _, routingKey := range stockAlertRoutingKeys {
+		err = channel.QueueBind(
+			stockAlertQueue.Name,
+			routingKey,
+			"inventory",
+			false,
+			nil,
+		)
+		if err != nil {
+			channel.Close()
+			conn.Close()
+			return nil, err
+		}
+	}
+
 	log.Println("Notification consumer initialized successfully")
 
 	return &Consumer{
@@ -325,6 +410,34 @@ func (c *Consumer) Start() error {
 		return err
 	}
 
+	// Start consumer for inventory.backordered events
+	backorderedMsgs, err := c.channel.Consume(
+		"inventory.backordered.notification.queue",
+		"",
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Start consumer for stock alert events
+	stockAlertMsgs, err := c.channel.Consume(
+		"inventory.stock_alert.notification.queue",
+		"",
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
 	// Handle inventory.processed events
 	go func() {
 		for msg := range processedMsgs {
@@ -422,7 +535,8 @@ func (c *Consumer) Start() error {
 				event.ItemID,
 				event.Quantity,
 				event.UserEmail,
-				event.Amount,
+				event.AmountMinor,
+				event.Currency,
 				event.Reason,
 			)
 
@@ -457,6 +571,61 @@ func (c *Consumer) Start() error {
 		}
 	}()
 
+	// Handle inventory.backordered events
+	go func() {
+		for msg := range backorderedMsgs {
+			var event InventoryBackorderedEvent
+			if err := json.Unmarshal(msg.Body, &event); err != nil {
+				log.Printf("Failed to unmarshal message: %v", err)
+				msg.Nack(false, false)
+				continue
+			}
+
+			log.Printf("Received inventory.backordered event: %+v", event)
+
+			// Tell the customer their order is waiting for stock
+			c.notificationService.SendBackorderNotification(
+				event.OrderID,
+				event.ItemID,
+				event.Quantity,
+				event.UserEmail,
+				event.ExpiresAt,
+			)
+
+			// Acknowledge the message
+			msg.Ack(false)
+		}
+	}()
+
+	// Handle inventory.low_stock, inventory.out_of_stock and
+	// inventory.restocked events
+	go func() {
+		for msg := range stockAlertMsgs {
+			var event StockAlertEvent
+			if err := json.Unmarshal(msg.Body, &event); err != nil {
+				log.Printf("Failed to unmarshal message: %v", err)
+				msg.Nack(false, false)
+				continue
+			}
+
+			log.Printf("Received %s event: %+v", msg.RoutingKey, event)
+
+			// Send stock alert to the operations team
+			c.notificationService.SendStockAlert(
+				event.ProductID,
+				event.Name,
+				event.Level,
+				event.Stock,
+				event.Reserved,
+				event.Available,
+				event.ReorderThreshold,
+			)
+
+			// Acknowledge the message
+			msg.Ack(false)
+		}
+	}()
+
 	log.Println("Notification consumer started, waiting for messages...")
 	return nil
 }
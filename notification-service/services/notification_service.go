@@ -6,10 +6,12 @@ import (
 	"time"
 )
 
-type NotificationService struct{}
+type NotificationService struct {
+	opsEmail string
+}
 
-func NewNotificationService() *NotificationService {
-	return &NotificationService{}
+func NewNotificationService(opsEmail string) *NotificationService {
+	return &NotificationService{opsEmail: opsEmail}
 }
 
 func (s *NotificationService) SendOrderConfirmation(orderID, itemID string, quantity int, userEmail, status, message string) {
@@ -126,7 +128,7 @@ func (s *NotificationService) SendPaymentFailedNotification(orderID, itemID stri
 	fmt.Println() // Add spacing for readability
 }
 
-func (s *NotificationService) SendRefundNotification(orderID, itemID string, quantity int, userEmail string, amount float64, reason string) {
+func (s *NotificationService) SendRefundNotification(orderID, itemID string, quantity int, userEmail string, amountMinor int64, currency, reason string) {
 	timestamp := time.Now().Format("2006-01-02 15:04:05")
 
 	log.Printf("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
@@ -143,7 +145,7 @@ func (s *NotificationService) SendRefundNotification(orderID, itemID string, qua
 	log.Printf("  • Order ID: %s", orderID)
 	log.Printf("  • Item ID: %s", itemID)
 	log.Printf("  • Quantity: %d", quantity)
-	log.Printf("  • Refund Amount: $%.2f", amount)
+	log.Printf("  • Refund Amount: %s", formatAmount(amountMinor, currency))
 	log.Printf("  • Reason: %s", reason)
 	log.Printf("  • Status: REFUNDED")
 	log.Printf("  • Timestamp: %s", timestamp)
@@ -188,3 +190,87 @@ func (s *NotificationService) SendOrderCompletionNotification(orderID, itemID st
 
 	fmt.Println() // Add spacing for readability
 }
+
+func (s *NotificationService) SendBackorderNotification(orderID, itemID string, quantity int, userEmail string, expiresAt time.Time) {
+	timestamp := time.Now().Format("2006-01-02 15:04:05")
+
+	log.Printf("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+	log.Printf("📧 EMAIL NOTIFICATION")
+	log.Printf("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+	log.Printf("To: %s", userEmail)
+	log.Printf("Subject: ⏳ Backordered - Order #%s", orderID)
+	log.Printf("")
+	log.Printf("Dear Customer,")
+	log.Printf("")
+	log.Printf("The item you ordered is out of stock right now, so your order is waiting for new stock.")
+	log.Printf("")
+	log.Printf("Order Details:")
+	log.Printf("  • Order ID: %s", orderID)
+	log.Printf("  • Item ID: %s", itemID)
+	log.Printf("  • Quantity: %d", quantity)
+	log.Printf("  • Status: BACKORDERED")
+	log.Printf("  • Waiting Until: %s", expiresAt.Format("2006-01-02 15:04:05"))
+	log.Printf("  • Timestamp: %s", timestamp)
+	log.Printf("")
+	log.Printf("We will complete your order as soon as the stock arrives.")
+	log.Printf("If it does not arrive in time, your order will be cancelled and refunded.")
+	log.Printf("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+
+	// Simulate email sending delay
+	time.Sleep(100 * time.Millisecond)
+
+	fmt.Println() // Add spacing for readability
+}
+
+// SendStockAlert tells the operations team that a product is running low, has
+// run out or has been restocked. level is the product's new stock alert level
+// (LOW, OUT or OK).
+func (s *NotificationService) SendStockAlert(productID, name, level string, stock, reserved, available, reorderThreshold int) {
+	timestamp := time.Now().Format("2006-01-02 15:04:05")
+
+	var subject, summary string
+	switch level {
+	case "OUT":
+		subject = fmt.Sprintf("🚨 Out of Stock - %s", productID)
+		summary = "This product has no stock available for new orders."
+	case "LOW":
+		subject = fmt.Sprintf("⚠️  Low Stock - %s", productID)
+		summary = "This product's available stock is at or below its reorder threshold."
+	default:
+		subject = fmt.Sprintf("📦 Restocked - %s", productID)
+		summary = "This product's available stock is back above its reorder threshold."
+	}
+
+	log.Printf("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+	log.Printf("📧 OPS ALERT")
+	log.Printf("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+	log.Printf("To: %s", s.opsEmail)
+	log.Printf("Subject: %s", subject)
+	log.Printf("")
+	log.Printf("%s", summary)
+	log.Printf("")
+	log.Printf("Stock Details:")
+	log.Printf("  • Product ID: %s", productID)
+	log.Printf("  • Name: %s", name)
+	log.Printf("  • On Hand: %d", stock)
+	log.Printf("  • Reserved: %d", reserved)
+	log.Printf("  • Available: %d", available)
+	log.Printf("  • Reorder Threshold: %d", reorderThreshold)
+	log.Printf("  • Timestamp: %s", timestamp)
+	log.Printf("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+
+	// Simulate email sending delay
+	time.Sleep(100 * time.Millisecond)
+
+	fmt.Println() // Add spacing for readability
+}
+
+// formatAmount renders an amount in minor units (e.g. cents) for humans
+func formatAmount(amountMinor int64, currency string) string {
+	sign := ""
+	if amountMinor < 0 {
+		sign = "-"
+		amountMinor = -amountMinor
+	}
+	return fmt.Sprintf("%s%d.%02d %s", sign, amountMinor/100, amountMinor%100, currency)
+}
@@ -0,0 +1,47 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
+)
+
+// Client reads products from the inventory service's HTTP API. It is only
+// used to rebuild the local projection; orders are validated against
+// products_view without a synchronous call.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+func NewClient(baseURL string) *Client {
+	return &Client{
+		baseURL:    baseURL,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// ListProducts fetches the full catalog
+func (c *Client) ListProducts() ([]models.Product, error) {
+	resp, err := c.httpClient.Get(c.baseURL + "/api/v1/products")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("inventory service returned %d listing products", resp.StatusCode)
+	}
+
+	var body struct {
+		Products []models.Product `json:"products"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	return body.Products, nil
+}
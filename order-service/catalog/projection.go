@@ -0,0 +1,88 @@
+package catalog
+
+import (
+	"database/sql"
+	"errors"
+	"expvar"
+	"log"
+	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/repository"
+)
+
+var ErrProductNotFound = errors.New("product not found")
+
+// Projection lag metrics, exposed on /debug/vars
+var (
+	projectionEvents    = expvar.NewMap("catalog_projection_events")        // applied/stale counts by event type
+	projectionLag       = expvar.NewFloat("catalog_projection_lag_seconds") // occurred_at -> applied for the last event
+	projectionLastEvent = expvar.NewString("catalog_projection_last_event_at")
+)
+
+// Projection maintains products_view from inventory product events and
+// serves it as the catalog for order validation and pricing
+type Projection struct {
+	repo   *repository.ProductViewRepository
+	client *Client
+}
+
+func NewProjection(repo *repository.ProductViewRepository, client *Client) *Projection {
+	return &Projection{
+		repo:   repo,
+		client: client,
+	}
+}
+
+func (p *Projection) GetProduct(productID string) (*models.Product, error) {
+	product, err := p.repo.GetByID(productID)
+	if err == sql.ErrNoRows {
+		return nil, ErrProductNotFound
+	}
+	return product, err
+}
+
+// ApplyProductEvent upserts a product snapshot from a product.* event.
+// Snapshots older than what the view already holds are skipped.
+func (p *Projection) ApplyProductEvent(eventType string, product models.Product, occurredAt time.Time) error {
+	product.ProjectedAt = time.Now()
+
+	applied, err := p.repo.Upsert(&product)
+	if err != nil {
+		return err
+	}
+
+	if !applied {
+		projectionEvents.Add(eventType+".stale", 1)
+		log.Printf("Skipped stale %s for product %s", eventType, product.ID)
+		return nil
+	}
+
+	projectionEvents.Add(eventType+".applied", 1)
+	projectionLag.Set(product.ProjectedAt.Sub(occurredAt).Seconds())
+	projectionLastEvent.Set(occurredAt.Format(time.RFC3339Nano))
+
+	log.Printf("Projected %s for product %s (stock %d, reserved %d)", eventType, product.ID, product.Stock, product.Reserved)
+	return nil
+}
+
+// Rebuild replaces products_view with a fresh copy of the inventory catalog
+func (p *Projection) Rebuild() (int, error) {
+	products, err := p.client.ListProducts()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := p.repo.ReplaceAll(products); err != nil {
+		return 0, err
+	}
+
+	log.Printf("Rebuilt product catalog projection with %d products", len(products))
+	return len(products), nil
+}
+
+// IsEmpty reports whether the projection has never been populated
+func (p *Projection) IsEmpty() (bool, error) {
+	count, err := p.repo.Count()
+	return count == 0, err
+}
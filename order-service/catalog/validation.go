@@ -0,0 +1,127 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
+)
+
+// Source looks up catalog products, returning ErrProductNotFound for unknown IDs
+type Source interface {
+	GetProduct(productID string) (*models.Product, error)
+}
+
+// ValidationError explains why an order line cannot be accepted. Line is
+// the line's 1-based position in a multi-line order, and 0 otherwise.
+type ValidationError struct {
+	Line   int
+	ItemID string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d (%s): %s", e.Line, e.ItemID, e.Reason)
+	}
+	return fmt.Sprintf("item %s: %s", e.ItemID, e.Reason)
+}
+
+// Validator checks order lines against the catalog
+type Validator struct {
+	source Source
+}
+
+func NewValidator(source Source) *Validator {
+	return &Validator{
+		source: source,
+	}
+}
+
+// ValidateOrderLine checks that an item exists, is a SKU rather than a
+// product with variants, can be priced and currently has enough available
+// stock for quantity, unless it takes backorders. It returns the product on
+// success, a *ValidationError if the line must be rejected, or another error
+// if the catalog could not be consulted.
+//
+// The stock check is advisory: stock is only held once the inventory service
+// reserves it, and the projection may lag behind inventory, so a valid order
+// can still fail later.
+func (v *Validator) ValidateOrderLine(itemID string, quantity int) (*models.Product, error) {
+	product, err := v.source.GetProduct(itemID)
+	if errors.Is(err, ErrProductNotFound) {
+		return nil, &ValidationError{ItemID: itemID, Reason: "unknown item"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if product.HasVariants {
+		return nil, &ValidationError{ItemID: itemID, Reason: "item has variants; order one of its SKUs"}
+	}
+
+	if product.PriceMinor <= 0 || product.Currency == "" {
+		return nil, &ValidationError{ItemID: itemID, Reason: "item is not available for sale"}
+	}
+
+	// Backorderable products queue what cannot be filled yet in inventory
+	if !product.AllowBackorder && product.Available() < quantity {
+		return nil, &ValidationError{
+			ItemID: itemID,
+			Reason: fmt.Sprintf("insufficient stock: requested %d, available %d", quantity, product.Available()),
+		}
+	}
+
+	return product, nil
+}
+
+// ValidateOrderLines validates the lines of an order and returns their
+// products in line order. One line is validated by ValidateOrderLine. Lines
+// of a multi-line order must each pass ValidateOrderLine, name different
+// items and be priced in one currency; as multi-line orders cannot wait for
+// stock as backorders, each line also needs enough available stock.
+func (v *Validator) ValidateOrderLines(lines []models.OrderLineRequest) ([]*models.Product, error) {
+	if len(lines) == 1 {
+		product, err := v.ValidateOrderLine(lines[0].ItemID, lines[0].Quantity)
+		if err != nil {
+			return nil, err
+		}
+		return []*models.Product{product}, nil
+	}
+
+	products := make([]*models.Product, 0, len(lines))
+	seen := make(map[string]bool, len(lines))
+	for i, line := range lines {
+		lineErr := &ValidationError{Line: i + 1, ItemID: line.ItemID}
+
+		if seen[line.ItemID] {
+			lineErr.Reason = "item is already on another line"
+			return nil, lineErr
+		}
+		seen[line.ItemID] = true
+
+		product, err := v.ValidateOrderLine(line.ItemID, line.Quantity)
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			lineErr.Reason = validationErr.Reason
+			return nil, lineErr
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if product.Available() < line.Quantity {
+			lineErr.Reason = fmt.Sprintf("insufficient stock: requested %d, available %d", line.Quantity, product.Available())
+			return nil, lineErr
+		}
+
+		if len(products) > 0 && product.Currency != products[0].Currency {
+			lineErr.Reason = fmt.Sprintf("item is priced in %s, not %s like the rest of the order", product.Currency, products[0].Currency)
+			return nil, lineErr
+		}
+
+		products = append(products, product)
+	}
+
+	return products, nil
+}
@@ -38,13 +38,88 @@ func createTables(db *sql.DB) error {
 		item_id VARCHAR(255) NOT NULL,
 		quantity INTEGER NOT NULL,
 		user_email VARCHAR(255) NOT NULL,
+		ship_to_region VARCHAR(50) NOT NULL DEFAULT '',
 		status VARCHAR(50) NOT NULL DEFAULT 'PENDING',
+		unit_price_minor BIGINT NOT NULL DEFAULT 0,
+		currency VARCHAR(3) NOT NULL DEFAULT 'USD',
+		total_minor BIGINT NOT NULL DEFAULT 0,
+		reaper_attempts INTEGER NOT NULL DEFAULT 0,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
 
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS unit_price_minor BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'USD';
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS total_minor BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS reaper_attempts INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS ship_to_region VARCHAR(50) NOT NULL DEFAULT '';
+
 	CREATE INDEX IF NOT EXISTS idx_orders_status ON orders(status);
 	CREATE INDEX IF NOT EXISTS idx_orders_created_at ON orders(created_at);
+
+	CREATE TABLE IF NOT EXISTS order_lines (
+		order_id VARCHAR(255) NOT NULL REFERENCES orders(id),
+		line INTEGER NOT NULL,
+		item_id VARCHAR(255) NOT NULL,
+		quantity INTEGER NOT NULL,
+		unit_price_minor BIGINT NOT NULL,
+		PRIMARY KEY (order_id, line)
+	);
+
+	CREATE TABLE IF NOT EXISTS order_status_history (
+		id BIGSERIAL PRIMARY KEY,
+		order_id VARCHAR(255) NOT NULL REFERENCES orders(id),
+		from_status VARCHAR(50),
+		to_status VARCHAR(50) NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		event_type VARCHAR(100) NOT NULL DEFAULT '',
+		event_id VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_order_status_history_order_id ON order_status_history(order_id, created_at);
+
+	CREATE TABLE IF NOT EXISTS order_outbox (
+		id BIGSERIAL PRIMARY KEY,
+		order_id VARCHAR(255) NOT NULL REFERENCES orders(id),
+		routing_key VARCHAR(100) NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS products_view (
+		id VARCHAR(255) PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		stock INTEGER NOT NULL,
+		reserved INTEGER NOT NULL,
+		price_minor BIGINT NOT NULL,
+		currency VARCHAR(3) NOT NULL,
+		source_updated_at TIMESTAMP NOT NULL,
+		projected_at TIMESTAMP NOT NULL
+	);
+
+	ALTER TABLE products_view ADD COLUMN IF NOT EXISTS parent_id VARCHAR(255) NOT NULL DEFAULT '';
+	ALTER TABLE products_view ADD COLUMN IF NOT EXISTS allow_backorder BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE products_view ADD COLUMN IF NOT EXISTS source_version BIGINT NOT NULL DEFAULT 0;
+	CREATE INDEX IF NOT EXISTS idx_products_view_parent ON products_view(parent_id) WHERE parent_id <> '';
+
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key VARCHAR(255) PRIMARY KEY,
+		request_hash VARCHAR(64) NOT NULL,
+		response_status INTEGER,
+		response_body TEXT,
+		order_id VARCHAR(255),
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		completed_at TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS sagas (
+		order_id VARCHAR(255) PRIMARY KEY REFERENCES orders(id),
+		state VARCHAR(50) NOT NULL,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
 	`
 
 	_, err := db.Exec(query)
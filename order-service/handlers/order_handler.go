@@ -1,24 +1,55 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/catalog"
 	"github.com/spksupakorn/ecommerce-event-driven/order-service/messaging"
 	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
 	"github.com/spksupakorn/ecommerce-event-driven/order-service/repository"
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/services"
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/stream"
 )
 
+// IdempotencyKeyHeader lets clients safely retry order creation
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const maxIdempotencyKeyLength = 255
+
+// streamHeartbeatInterval is how often an idle event stream sends a ping and
+// re-reads the order, which catches transitions applied by other instances
+const streamHeartbeatInterval = 15 * time.Second
+
 type OrderHandler struct {
-	repo      *repository.OrderRepository
-	publisher *messaging.Publisher
+	repo        *repository.OrderRepository
+	idempotency *repository.IdempotencyRepository
+	publisher   *messaging.Publisher
+	broker      *stream.Broker
+	catalog     *catalog.Validator
+	// Set when new orders run as orchestrated sagas
+	orchestrator *services.Orchestrator
+	// Saga flow of new choreographed orders
+	choreography messaging.SagaContext
 }
 
-func NewOrderHandler(repo *repository.OrderRepository, publisher *messaging.Publisher) *OrderHandler {
+func NewOrderHandler(repo *repository.OrderRepository, idempotency *repository.IdempotencyRepository, publisher *messaging.Publisher, broker *stream.Broker, catalogValidator *catalog.Validator, orchestrator *services.Orchestrator, choreography messaging.SagaContext) *OrderHandler {
 	return &OrderHandler{
-		repo:      repo,
-		publisher: publisher,
+		repo:         repo,
+		idempotency:  idempotency,
+		publisher:    publisher,
+		broker:       broker,
+		catalog:      catalogValidator,
+		orchestrator: orchestrator,
+		choreography: choreography,
 	}
 }
 
@@ -30,35 +61,158 @@ func (h *OrderHandler) CreateOrder(c *gin.Context) {
 		return
 	}
 
-	// Save order to database
-	order, err := h.repo.Create(&req)
+	// Honour Idempotency-Key: a repeat of a finished request gets the original
+	// response instead of creating a second order
+	key := c.GetHeader(IdempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+		return
+	}
+
+	if key != "" {
+		requestHash := hashRequest(&req)
+		record, reserved, err := h.idempotency.Reserve(key, requestHash)
+		if err != nil {
+			log.Printf("Failed to reserve idempotency key %s: %v", key, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
+			return
+		}
+
+		if !reserved {
+			h.replayIdempotentResponse(c, record, requestHash)
+			return
+		}
+	}
+
+	// Validate the items against the catalog and price the order at creation
+	// time, so unknown items are rejected up front rather than failing later
+	requested := req.Lines()
+	products, err := h.catalog.ValidateOrderLines(requested)
+	if err != nil {
+		h.releaseIdempotencyKey(key)
+
+		var validationErr *catalog.ValidationError
+		if errors.As(err, &validationErr) {
+			response := gin.H{
+				"error":   "Order cannot be accepted",
+				"item_id": validationErr.ItemID,
+				"reason":  validationErr.Reason,
+			}
+			if validationErr.Line > 0 {
+				response["line"] = validationErr.Line
+			}
+			c.JSON(http.StatusUnprocessableEntity, response)
+			return
+		}
+
+		log.Printf("Failed to validate order lines: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate order"})
+		return
+	}
+
+	lines := make([]models.OrderLine, len(requested))
+	for i, line := range requested {
+		lines[i] = models.OrderLine{
+			ItemID:         line.ItemID,
+			Quantity:       line.Quantity,
+			UnitPriceMinor: products[i].PriceMinor,
+		}
+	}
+
+	// Save order to database, completing the idempotency key with it
+	var idempotent *repository.IdempotentResponse
+	if key != "" {
+		idempotent = &repository.IdempotentResponse{
+			Key:    key,
+			Status: http.StatusAccepted,
+			Body: func(order *models.Order) ([]byte, error) {
+				return json.Marshal(acceptedResponse(order))
+			},
+		}
+	}
+
+	order, err := h.repo.Create(&req, lines, products[0].Currency, idempotent)
+	if errors.Is(err, repository.ErrIdempotencyKeyUsed) {
+		// A retry that took the key over finished first
+		record, err := h.idempotency.Get(key)
+		if err != nil {
+			log.Printf("Failed to look up idempotency key %s: %v", key, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
+			return
+		}
+		h.replayIdempotentResponse(c, record, hashRequest(&req))
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to create order: %v", err)
+		h.releaseIdempotencyKey(key)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
 		return
 	}
 
-	// Publish order.created event
-	event := map[string]interface{}{
-		"order_id":   order.ID,
-		"item_id":    order.ItemID,
-		"quantity":   order.Quantity,
-		"user_email": order.UserEmail,
-		"status":     order.Status,
-		"created_at": order.CreatedAt,
-	}
+	if h.orchestrator != nil {
+		// Start the orchestrated saga
+		if err := h.orchestrator.Start(order); err != nil {
+			log.Printf("Failed to start saga for order %s: %v", order.ID, err)
+			// Note: We still return success to the user as the order is saved
+		}
+	} else {
+		// Publish order.created event
+		event := messaging.NewOrderCreatedEvent(order)
 
-	if err := h.publisher.PublishOrderCreated(event); err != nil {
-		log.Printf("Failed to publish order.created event: %v", err)
-		// Note: We still return success to the user as the order is saved
+		if err := h.publisher.PublishOrderCreated(event, h.choreography); err != nil {
+			log.Printf("Failed to publish order.created event: %v", err)
+			// Note: We still return success to the user as the order is saved
+		}
 	}
 
 	// Return 202 Accepted
-	c.JSON(http.StatusAccepted, gin.H{
-		"message":  "Order accepted for processing",
-		"order_id": order.ID,
-		"status":   order.Status,
-	})
+	c.JSON(http.StatusAccepted, acceptedResponse(order))
+}
+
+// acceptedResponse is the body of the 202 response to a new order
+func acceptedResponse(order *models.Order) gin.H {
+	return gin.H{
+		"message":     "Order accepted for processing",
+		"order_id":    order.ID,
+		"status":      order.Status,
+		"currency":    order.Currency,
+		"total_minor": order.TotalMinor,
+	}
+}
+
+// releaseIdempotencyKey frees key after a failed request so the client can
+// retry it
+func (h *OrderHandler) releaseIdempotencyKey(key string) {
+	if key == "" {
+		return
+	}
+	if err := h.idempotency.Release(key); err != nil {
+		log.Printf("Failed to release idempotency key %s: %v", key, err)
+	}
+}
+
+// replayIdempotentResponse answers a request whose Idempotency-Key was
+// already used
+func (h *OrderHandler) replayIdempotentResponse(c *gin.Context, record *models.IdempotencyRecord, requestHash string) {
+	switch {
+	case record.RequestHash != requestHash:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used with a different request body"})
+	case !record.Completed():
+		c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still being processed"})
+	default:
+		log.Printf("Replaying response for idempotency key %s (order %s)", record.Key, record.OrderID)
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(record.ResponseStatus, binding.MIMEJSON+"; charset=utf-8", record.ResponseBody)
+	}
+}
+
+// hashRequest fingerprints the decoded request so that formatting-only
+// differences in a retried body are not treated as a different request
+func hashRequest(req *models.CreateOrderRequest) string {
+	body, _ := json.Marshal(req)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
 }
 
 func (h *OrderHandler) GetOrder(c *gin.Context) {
@@ -72,3 +226,106 @@ func (h *OrderHandler) GetOrder(c *gin.Context) {
 
 	c.JSON(http.StatusOK, order)
 }
+
+func (h *OrderHandler) GetOrderHistory(c *gin.Context) {
+	id := c.Param("id")
+
+	if _, err := h.repo.GetByID(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	history, err := h.repo.GetStatusHistory(id)
+	if err != nil {
+		log.Printf("Failed to load history for order %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load order history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"order_id": id,
+		"history":  history,
+	})
+}
+
+// StreamOrderEvents streams an order's status transitions as Server-Sent
+// Events. The first "status" event is the current status; an "end" event is
+// sent and the stream closed once the order reaches a terminal status.
+func (h *OrderHandler) StreamOrderEvents(c *gin.Context) {
+	id := c.Param("id")
+
+	// Subscribe before reading the order so no transition is missed in between
+	updates, unsubscribe := h.broker.Subscribe(id)
+	defer unsubscribe()
+
+	order, err := h.repo.GetByID(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	// The stream outlives the server's WriteTimeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to clear write deadline for order %s stream: %v", id, err)
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	current := stream.StatusUpdate{
+		OrderID:  order.ID,
+		Status:   order.Status,
+		Terminal: models.IsTerminalStatus(order.Status),
+		At:       order.UpdatedAt,
+	}
+	c.SSEvent("status", current)
+	if current.Terminal {
+		c.SSEvent("end", current)
+		return
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+
+		case update := <-updates:
+			current = update
+			c.SSEvent("status", update)
+			if update.Terminal {
+				c.SSEvent("end", update)
+				return false
+			}
+			return true
+
+		case <-heartbeat.C:
+			// Fallback for updates this instance did not apply or dropped
+			order, err := h.repo.GetByID(id)
+			if err == nil && order.Status != current.Status {
+				current = stream.StatusUpdate{
+					OrderID:    order.ID,
+					FromStatus: current.Status,
+					Status:     order.Status,
+					Terminal:   models.IsTerminalStatus(order.Status),
+					At:         order.UpdatedAt,
+				}
+				c.SSEvent("status", current)
+				if current.Terminal {
+					c.SSEvent("end", current)
+					return false
+				}
+				return true
+			}
+
+			c.SSEvent("ping", gin.H{"at": time.Now()})
+			return true
+		}
+	})
+
+	log.Printf("Closed event stream for order %s", id)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"log"
 	"net/http"
 	"os"
@@ -10,12 +11,14 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/catalog"
 	"github.com/spksupakorn/ecommerce-event-driven/order-service/config"
 	"github.com/spksupakorn/ecommerce-event-driven/order-service/database"
 	"github.com/spksupakorn/ecommerce-event-driven/order-service/handlers"
 	"github.com/spksupakorn/ecommerce-event-driven/order-service/messaging"
 	"github.com/spksupakorn/ecommerce-event-driven/order-service/repository"
 	"github.com/spksupakorn/ecommerce-event-driven/order-service/services"
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/stream"
 )
 
 func main() {
@@ -29,6 +32,25 @@ func main() {
 	}
 	defer database.CloseDB(db)
 
+	// Product catalog projection (products_view), fed by inventory events
+	catalogClient := catalog.NewClient(cfg.InventoryURL)
+	projection := catalog.NewProjection(repository.NewProductViewRepository(db), catalogClient)
+
+	// "rebuild-catalog" rebuilds the projection from scratch and exits
+	if len(os.Args) > 1 && os.Args[1] == "rebuild-catalog" {
+		if _, err := projection.Rebuild(); err != nil {
+			log.Fatalf("Failed to rebuild product catalog: %v", err)
+		}
+		return
+	}
+
+	// Populate an empty projection so orders can be validated on first start
+	if empty, err := projection.IsEmpty(); err == nil && empty {
+		if _, err := projection.Rebuild(); err != nil {
+			log.Printf("Product catalog projection is empty and could not be rebuilt: %v", err)
+		}
+	}
+
 	// Initialize RabbitMQ publisher
 	publisher, err := messaging.NewPublisher(cfg.RabbitMQURL)
 	if err != nil {
@@ -36,12 +58,42 @@ func main() {
 	}
 	defer publisher.Close()
 
-	// Initialize repository and handler
+	// Broker for streaming status changes to connected clients
+	broker := stream.NewBroker()
+
+	// Initialize repositories
 	orderRepo := repository.NewOrderRepository(db)
-	orderHandler := handlers.NewOrderHandler(orderRepo, publisher)
+	idempotencyRepo := repository.NewIdempotencyRepository(db)
+	sagaRepo := repository.NewSagaRepository(db)
+
+	// Initialize order service and saga orchestrator
+	orderService := services.NewOrderService(orderRepo, broker, publisher)
+	orchestrator := services.NewOrchestrator(sagaRepo, orderRepo, orderService, publisher)
+
+	// Only new orders depend on the saga configuration; sagas already in
+	// flight finish the way they started
+	var sagaStarter *services.Orchestrator
+	switch cfg.SagaMode {
+	case messaging.SagaModeOrchestration:
+		sagaStarter = orchestrator
+	case messaging.SagaModeChoreography:
+	default:
+		log.Fatalf("Unknown SAGA_MODE %q (expected %q or %q)", cfg.SagaMode, messaging.SagaModeChoreography, messaging.SagaModeOrchestration)
+	}
+	switch cfg.SagaOrder {
+	case messaging.SagaOrderPaymentFirst, messaging.SagaOrderInventoryFirst:
+	default:
+		log.Fatalf("Unknown SAGA_ORDER %q (expected %q or %q)", cfg.SagaOrder, messaging.SagaOrderPaymentFirst, messaging.SagaOrderInventoryFirst)
+	}
+	// The orchestrator always takes payment first
+	if cfg.SagaMode == messaging.SagaModeOrchestration && cfg.SagaOrder == messaging.SagaOrderInventoryFirst {
+		log.Fatalf("SAGA_ORDER %q is not supported with SAGA_MODE %q", cfg.SagaOrder, cfg.SagaMode)
+	}
+	choreography := messaging.SagaContext{Mode: messaging.SagaModeChoreography, Order: cfg.SagaOrder}
+	log.Printf("New orders run as %s sagas (choreography order: %s)", cfg.SagaMode, cfg.SagaOrder)
 
-	// Initialize order service
-	orderService := services.NewOrderService(orderRepo)
+	// Initialize handler
+	orderHandler := handlers.NewOrderHandler(orderRepo, idempotencyRepo, publisher, broker, catalog.NewValidator(projection), sagaStarter, choreography)
 
 	// Initialize and start consumer for inventory.failed events
 	consumer, err := messaging.NewConsumer(cfg.RabbitMQURL, orderService)
@@ -54,6 +106,34 @@ func main() {
 		log.Fatalf("Failed to start consumer: %v", err)
 	}
 
+	// Initialize and start consumer for orchestrated saga replies
+	sagaConsumer, err := messaging.NewSagaReplyConsumer(cfg.RabbitMQURL, orchestrator)
+	if err != nil {
+		log.Fatalf("Failed to initialize saga reply consumer: %v", err)
+	}
+	defer sagaConsumer.Close()
+
+	if err := sagaConsumer.Start(); err != nil {
+		log.Fatalf("Failed to start saga reply consumer: %v", err)
+	}
+
+	// Initialize and start consumer for product.* events
+	productConsumer, err := messaging.NewProductConsumer(cfg.RabbitMQURL, projection)
+	if err != nil {
+		log.Fatalf("Failed to initialize product consumer: %v", err)
+	}
+	defer productConsumer.Close()
+
+	if err := productConsumer.Start(); err != nil {
+		log.Fatalf("Failed to start product consumer: %v", err)
+	}
+
+	// Start the stuck-saga reaper
+	reaperCtx, stopReaper := context.WithCancel(context.Background())
+	defer stopReaper()
+	reaper := services.NewReaper(orderRepo, orderService, orchestrator, publisher, choreography, cfg.OrderTimeout, cfg.ReaperInterval, cfg.ReaperMaxRepublish)
+	reaper.Start(reaperCtx)
+
 	// Setup Gin router
 	router := setupRouter(orderHandler)
 
@@ -102,11 +182,16 @@ func setupRouter(orderHandler *handlers.OrderHandler) *gin.Engine {
 		c.JSON(http.StatusOK, gin.H{"status": "healthy"})
 	})
 
+	// Metrics endpoint (expvar counters such as rejected status transitions)
+	router.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+
 	// Order endpoints
 	v1 := router.Group("/api/v1")
 	{
 		v1.POST("/orders", orderHandler.CreateOrder)
 		v1.GET("/orders/:id", orderHandler.GetOrder)
+		v1.GET("/orders/:id/history", orderHandler.GetOrderHistory)
+		v1.GET("/orders/:id/events", orderHandler.StreamOrderEvents)
 	}
 
 	return router
@@ -3,13 +3,15 @@ package messaging
 import (
 	"encoding/json"
 	"log"
+	"time"
 
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
 	"github.com/streadway/amqp"
 )
 
 // OrderStatusUpdater defines the interface for updating order status
 type OrderStatusUpdater interface {
-	UpdateOrderStatus(orderID string, status string) error
+	UpdateOrderStatus(orderID string, status string, change models.StatusChange) error
 }
 
 type Consumer struct {
@@ -42,6 +44,25 @@ type InventorySuccessfulEvent struct {
 	Message   string `json:"message"`
 }
 
+type PaymentCapturedEvent struct {
+	OrderID     string `json:"order_id"`
+	ItemID      string `json:"item_id"`
+	Quantity    int    `json:"quantity"`
+	UserEmail   string `json:"user_email"`
+	AmountMinor int64  `json:"amount_minor"`
+	Currency    string `json:"currency"`
+	Message     string `json:"message"`
+}
+
+type InventoryBackorderedEvent struct {
+	OrderID   string    `json:"order_id"`
+	ItemID    string    `json:"item_id"`
+	Quantity  int       `json:"quantity"`
+	UserEmail string    `json:"user_email"`
+	Message   string    `json:"message"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
 func NewConsumer(rabbitMQURL string, orderService OrderStatusUpdater) (*Consumer, error) {
 	conn, err := amqp.Dial(rabbitMQURL)
 	if err != nil {
@@ -173,6 +194,64 @@ func NewConsumer(rabbitMQURL string, orderService OrderStatusUpdater) (*Consumer
 		return nil, err
 	}
 
+	// Declare queue for inventory.backordered events
+	backorderedQueue, err := channel.QueueDeclare(
+		"inventory.backordered.order.queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Bind backordered queue to exchange
+	err = channel.QueueBind(
+		backorderedQueue.Name,
+		"inventory.backordered",
+		"inventory",
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare queue for payment.captured events
+	paymentCapturedQueue, err := channel.QueueDeclare(
+		"payment.captured.order.queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Bind payment captured queue to exchange
+	err = channel.QueueBind(
+		paymentCapturedQueue.Name,
+		"payment.captured",
+		"payments",
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
 	log.Println("Order Service RabbitMQ consumer initialized successfully")
 
 	return &Consumer{
@@ -225,6 +304,34 @@ func (c *Consumer) Start() error {
 		return err
 	}
 
+	// Consume inventory.backordered events
+	backorderedMsgs, err := c.channel.Consume(
+		"inventory.backordered.order.queue",
+		"",
+		false, // manual ack
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Consume payment.captured events
+	paymentCapturedMsgs, err := c.channel.Consume(
+		"payment.captured.order.queue",
+		"",
+		false, // manual ack
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
 	// Handle inventory.failed events
 	go func() {
 		for msg := range inventoryMsgs {
@@ -235,10 +342,21 @@ func (c *Consumer) Start() error {
 				continue
 			}
 
+			// Orchestrated orders are driven by the saga orchestrator
+			if sagaContext(msg).Orchestrated() {
+				msg.Ack(false)
+				continue
+			}
+
 			log.Printf("Received inventory.failed event: %+v", event)
 
 			// Update order status to CANCELLED
-			if err := c.orderService.UpdateOrderStatus(event.OrderID, "CANCELLED"); err != nil {
+			change := models.StatusChange{
+				Reason:    event.Reason,
+				EventType: "inventory.failed",
+				EventID:   msg.MessageId,
+			}
+			if err := c.orderService.UpdateOrderStatus(event.OrderID, models.OrderStatusCancelled, change); err != nil {
 				log.Printf("Failed to update order status: %v", err)
 				msg.Nack(false, true) // Requeue on failure
 				continue
@@ -261,10 +379,21 @@ func (c *Consumer) Start() error {
 				continue
 			}
 
+			// Orchestrated orders are driven by the saga orchestrator
+			if sagaContext(msg).Orchestrated() {
+				msg.Ack(false)
+				continue
+			}
+
 			log.Printf("Received payment.failed event: %+v", event)
 
 			// Update order status to CANCELLED
-			if err := c.orderService.UpdateOrderStatus(event.OrderID, "CANCELLED"); err != nil {
+			change := models.StatusChange{
+				Reason:    event.Reason,
+				EventType: "payment.failed",
+				EventID:   msg.MessageId,
+			}
+			if err := c.orderService.UpdateOrderStatus(event.OrderID, models.OrderStatusCancelled, change); err != nil {
 				log.Printf("Failed to update order status: %v", err)
 				msg.Nack(false, true) // Requeue on failure
 				continue
@@ -277,7 +406,8 @@ func (c *Consumer) Start() error {
 		}
 	}()
 
-	// Handle inventory.successful events (mark order as COMPLETED)
+	// Handle inventory.successful events (mark inventory-first orders as
+	// COMPLETED; they were charged before their stock was deducted)
 	go func() {
 		for msg := range inventorySuccessMsgs {
 			var event InventorySuccessfulEvent
@@ -287,10 +417,67 @@ func (c *Consumer) Start() error {
 				continue
 			}
 
+			// Orchestrated orders are driven by the saga orchestrator
+			saga := sagaContext(msg)
+			if saga.Orchestrated() {
+				msg.Ack(false)
+				continue
+			}
+
+			// Payment-first orders complete once their authorized payment is
+			// captured (payment.captured)
+			if !saga.InventoryFirst() {
+				log.Printf("Stock deducted for order %s, waiting for payment capture", event.OrderID)
+				msg.Ack(false)
+				continue
+			}
+
 			log.Printf("Received inventory.successful event: %+v", event)
 
 			// Update order status to COMPLETED
-			if err := c.orderService.UpdateOrderStatus(event.OrderID, "COMPLETED"); err != nil {
+			change := models.StatusChange{
+				Reason:    event.Message,
+				EventType: "inventory.successful",
+				EventID:   msg.MessageId,
+			}
+			if err := c.orderService.UpdateOrderStatus(event.OrderID, models.OrderStatusCompleted, change); err != nil {
+				log.Printf("Failed to update order status: %v", err)
+				msg.Nack(false, true) // Requeue on failure
+				continue
+			}
+
+			log.Printf("Order %s completed successfully!", event.OrderID)
+
+			// Acknowledge the message
+			msg.Ack(false)
+		}
+	}()
+
+	// Handle payment.captured events (mark payment-first orders as COMPLETED)
+	go func() {
+		for msg := range paymentCapturedMsgs {
+			var event PaymentCapturedEvent
+			if err := json.Unmarshal(msg.Body, &event); err != nil {
+				log.Printf("Failed to unmarshal payment.captured message: %v", err)
+				msg.Nack(false, false) // Don't requeue
+				continue
+			}
+
+			// Orchestrated orders are driven by the saga orchestrator
+			if sagaContext(msg).Orchestrated() {
+				msg.Ack(false)
+				continue
+			}
+
+			log.Printf("Received payment.captured event: %+v", event)
+
+			// Update order status to COMPLETED
+			change := models.StatusChange{
+				Reason:    event.Message,
+				EventType: "payment.captured",
+				EventID:   msg.MessageId,
+			}
+			if err := c.orderService.UpdateOrderStatus(event.OrderID, models.OrderStatusCompleted, change); err != nil {
 				log.Printf("Failed to update order status: %v", err)
 				msg.Nack(false, true) // Requeue on failure
 				continue
@@ -303,7 +490,44 @@ func (c *Consumer) Start() error {
 		}
 	}()
 
-	log.Println("Order Service consumer started, waiting for inventory.failed, payment.failed, and inventory.successful messages...")
+	// Handle inventory.backordered events (mark order as BACKORDERED)
+	go func() {
+		for msg := range backorderedMsgs {
+			var event InventoryBackorderedEvent
+			if err := json.Unmarshal(msg.Body, &event); err != nil {
+				log.Printf("Failed to unmarshal inventory.backordered message: %v", err)
+				msg.Nack(false, false) // Don't requeue
+				continue
+			}
+
+			// Orchestrated orders are driven by the saga orchestrator
+			if sagaContext(msg).Orchestrated() {
+				msg.Ack(false)
+				continue
+			}
+
+			log.Printf("Received inventory.backordered event: %+v", event)
+
+			// Update order status to BACKORDERED
+			change := models.StatusChange{
+				Reason:    event.Message,
+				EventType: "inventory.backordered",
+				EventID:   msg.MessageId,
+			}
+			if err := c.orderService.UpdateOrderStatus(event.OrderID, models.OrderStatusBackordered, change); err != nil {
+				log.Printf("Failed to update order status: %v", err)
+				msg.Nack(false, true) // Requeue on failure
+				continue
+			}
+
+			log.Printf("Order %s is backordered until %s", event.OrderID, event.ExpiresAt.Format(time.RFC3339))
+
+			// Acknowledge the message
+			msg.Ack(false)
+		}
+	}()
+
+	log.Println("Order Service consumer started, waiting for inventory.failed, payment.failed, inventory.successful, payment.captured and inventory.backordered messages...")
 	return nil
 }
 
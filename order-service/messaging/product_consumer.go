@@ -0,0 +1,162 @@
+package messaging
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
+	"github.com/streadway/amqp"
+)
+
+// ProductProjector defines the interface for applying product events to the
+// local catalog projection
+type ProductProjector interface {
+	ApplyProductEvent(eventType string, product models.Product, occurredAt time.Time) error
+}
+
+type ProductConsumer struct {
+	conn      *amqp.Connection
+	channel   *amqp.Channel
+	projector ProductProjector
+}
+
+type ProductEvent struct {
+	ProductID      string    `json:"product_id"`
+	Name           string    `json:"name"`
+	Stock          int       `json:"stock"`
+	Reserved       int       `json:"reserved"`
+	PriceMinor     int64     `json:"price_minor"`
+	Currency       string    `json:"currency"`
+	AllowBackorder bool      `json:"allow_backorder"`
+	ParentID       string    `json:"parent_id"`
+	Version        int64     `json:"version"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	OccurredAt     time.Time `json:"occurred_at"`
+}
+
+func NewProductConsumer(rabbitMQURL string, projector ProductProjector) (*ProductConsumer, error) {
+	conn, err := amqp.Dial(rabbitMQURL)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare inventory exchange
+	err = channel.ExchangeDeclare(
+		"inventory",
+		"topic",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare queue for product.* events
+	queue, err := channel.QueueDeclare(
+		"product.events.order.queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Bind queue to product.created, product.updated and product.stock_changed
+	err = channel.QueueBind(
+		queue.Name,
+		"product.*",
+		"inventory",
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	log.Println("Order Service product consumer initialized successfully")
+
+	return &ProductConsumer{
+		conn:      conn,
+		channel:   channel,
+		projector: projector,
+	}, nil
+}
+
+func (c *ProductConsumer) Start() error {
+	msgs, err := c.channel.Consume(
+		"product.events.order.queue",
+		"",
+		false, // manual ack
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for msg := range msgs {
+			var event ProductEvent
+			if err := json.Unmarshal(msg.Body, &event); err != nil {
+				log.Printf("Failed to unmarshal %s message: %v", msg.RoutingKey, err)
+				msg.Nack(false, false) // Don't requeue
+				continue
+			}
+
+			product := models.Product{
+				ID:              event.ProductID,
+				Name:            event.Name,
+				Stock:           event.Stock,
+				Reserved:        event.Reserved,
+				PriceMinor:      event.PriceMinor,
+				Currency:        event.Currency,
+				AllowBackorder:  event.AllowBackorder,
+				ParentID:        event.ParentID,
+				Version:         event.Version,
+				SourceUpdatedAt: event.UpdatedAt,
+			}
+
+			if err := c.projector.ApplyProductEvent(msg.RoutingKey, product, event.OccurredAt); err != nil {
+				log.Printf("Failed to apply %s for product %s: %v", msg.RoutingKey, event.ProductID, err)
+				msg.Nack(false, true) // Requeue on failure
+				continue
+			}
+
+			// Acknowledge the message
+			msg.Ack(false)
+		}
+	}()
+
+	log.Println("Product consumer started, waiting for product.* messages...")
+	return nil
+}
+
+func (c *ProductConsumer) Close() {
+	if c.channel != nil {
+		c.channel.Close()
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
@@ -3,7 +3,10 @@ package messaging
 import (
 	"encoding/json"
 	"log"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
 	"github.com/streadway/amqp"
 )
 
@@ -40,6 +43,22 @@ func NewPublisher(rabbitMQURL string) (*Publisher, error) {
 		return nil, err
 	}
 
+	// Declare saga exchange for orchestrator commands
+	err = channel.ExchangeDeclare(
+		"saga",  // name
+		"topic", // type
+		true,    // durable
+		false,   // auto-deleted
+		false,   // internal
+		false,   // no-wait
+		nil,     // arguments
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
 	log.Println("RabbitMQ publisher initialized successfully")
 
 	return &Publisher{
@@ -48,7 +67,71 @@ func NewPublisher(rabbitMQURL string) (*Publisher, error) {
 	}, nil
 }
 
-func (p *Publisher) PublishOrderCreated(event interface{}) error {
+// NewOrderCreatedEvent builds the order.created payload for an order. A
+// multi-line order's lines go in items.
+func NewOrderCreatedEvent(order *models.Order) map[string]interface{} {
+	event := map[string]interface{}{
+		"order_id":         order.ID,
+		"item_id":          order.ItemID,
+		"quantity":         order.Quantity,
+		"user_email":       order.UserEmail,
+		"ship_to_region":   order.ShipToRegion,
+		"status":           order.Status,
+		"unit_price_minor": order.UnitPriceMinor,
+		"currency":         order.Currency,
+		"total_minor":      order.TotalMinor,
+		"created_at":       order.CreatedAt,
+	}
+	if len(order.Items) > 0 {
+		event["items"] = order.Items
+	}
+	return event
+}
+
+// NewOrderTimedOutEvent builds the order.timed_out payload for an order
+// abandoned by the reaper
+func NewOrderTimedOutEvent(order *models.Order, reason string) map[string]interface{} {
+	return map[string]interface{}{
+		"order_id":     order.ID,
+		"item_id":      order.ItemID,
+		"quantity":     order.Quantity,
+		"user_email":   order.UserEmail,
+		"status":       models.OrderStatusTimedOut,
+		"reason":       reason,
+		"timed_out_at": time.Now(),
+	}
+}
+
+// NewSagaCommand builds the payload of an orchestrator command for an order,
+// with a multi-line order's lines in items
+func NewSagaCommand(order *models.Order, reason string) map[string]interface{} {
+	command := map[string]interface{}{
+		"order_id":       order.ID,
+		"item_id":        order.ItemID,
+		"quantity":       order.Quantity,
+		"user_email":     order.UserEmail,
+		"ship_to_region": order.ShipToRegion,
+		"total_minor":    order.TotalMinor,
+		"currency":       order.Currency,
+		"reason":         reason,
+	}
+	if len(order.Items) > 0 {
+		command["items"] = order.Items
+	}
+	return command
+}
+
+// NewOrderCancelledEvent builds the order.cancelled payload for an order
+func NewOrderCancelledEvent(orderID, reason string) map[string]interface{} {
+	return map[string]interface{}{
+		"order_id":     orderID,
+		"status":       models.OrderStatusCancelled,
+		"reason":       reason,
+		"cancelled_at": time.Now(),
+	}
+}
+
+func (p *Publisher) PublishOrderCreated(event interface{}, saga SagaContext) error {
 	body, err := json.Marshal(event)
 	if err != nil {
 		return err
@@ -63,6 +146,8 @@ func (p *Publisher) PublishOrderCreated(event interface{}) error {
 			ContentType:  "application/json",
 			Body:         body,
 			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      saga.headers(),
 		},
 	)
 
@@ -74,6 +159,90 @@ func (p *Publisher) PublishOrderCreated(event interface{}) error {
 	return nil
 }
 
+func (p *Publisher) PublishOrderTimedOut(event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = p.channel.Publish(
+		"orders",          // exchange
+		"order.timed_out", // routing key
+		false,             // mandatory
+		false,             // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+		},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published order.timed_out event: %s", string(body))
+	return nil
+}
+
+func (p *Publisher) PublishOrderCancelled(event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = p.channel.Publish(
+		"orders",          // exchange
+		"order.cancelled", // routing key
+		false,             // mandatory
+		false,             // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+		},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published order.cancelled event: %s", string(body))
+	return nil
+}
+
+// PublishSagaCommand sends an orchestrator command (e.g. payment.authorize) to
+// the participant that handles it
+func (p *Publisher) PublishSagaCommand(command string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	err = p.channel.Publish(
+		"saga",  // exchange
+		command, // routing key
+		false,   // mandatory
+		false,   // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      Orchestration.headers(),
+		},
+	)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published %s command: %s", command, string(body))
+	return nil
+}
+
 func (p *Publisher) Close() {
 	if p.channel != nil {
 		p.channel.Close()
@@ -0,0 +1,167 @@
+package messaging
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/streadway/amqp"
+)
+
+// SagaReplyHandler defines the interface for advancing orchestrated sagas
+type SagaReplyHandler interface {
+	HandleSagaReply(eventType, orderID, detail, eventID string) error
+}
+
+// SagaReplyConsumer feeds participant events that belong to orchestrated
+// sagas back to the orchestrator. Events from choreographed orders are
+// acknowledged and skipped.
+type SagaReplyConsumer struct {
+	conn         *amqp.Connection
+	channel      *amqp.Channel
+	orchestrator SagaReplyHandler
+}
+
+// SagaReplyEvent holds the fields the orchestrator needs from any
+// participant event
+type SagaReplyEvent struct {
+	OrderID string `json:"order_id"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// sagaReplyBindings lists the participant events the orchestrator waits for,
+// by exchange
+var sagaReplyBindings = map[string][]string{
+	"payments":  {"payment.authorized", "payment.successful", "payment.captured", "payment.failed", "payment.voided", "payment.void_failed", "payment.refunded", "payment.refund_failed"},
+	"inventory": {"inventory.successful", "inventory.failed", "inventory.backordered"},
+}
+
+func NewSagaReplyConsumer(rabbitMQURL string, orchestrator SagaReplyHandler) (*SagaReplyConsumer, error) {
+	conn, err := amqp.Dial(rabbitMQURL)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare queue for saga replies
+	queue, err := channel.QueueDeclare(
+		"saga.replies.order.queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	for exchange, routingKeys := range sagaReplyBindings {
+		// Declare participant exchange
+		err = channel.ExchangeDeclare(
+			exchange,
+			"topic",
+			true,
+			false,
+			false,
+			false,
+			nil,
+		)
+		if err != nil {
+			channel.Close()
+			conn.Close()
+			return nil, err
+		}
+
+		// Bind queue to the participant's reply events
+		for _, routingKey := range routingKeys {
+			err = channel.QueueBind(
+				queue.Name,
+				routingKey,
+				exchange,
+				false,
+				nil,
+			)
+			if err != nil {
+				channel.Close()
+				conn.Close()
+				return nil, err
+			}
+		}
+	}
+
+	log.Println("Saga reply consumer initialized successfully")
+
+	return &SagaReplyConsumer{
+		conn:         conn,
+		channel:      channel,
+		orchestrator: orchestrator,
+	}, nil
+}
+
+func (c *SagaReplyConsumer) Start() error {
+	msgs, err := c.channel.Consume(
+		"saga.replies.order.queue",
+		"",
+		false, // manual ack
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for msg := range msgs {
+			// Choreographed orders are handled by the status consumer
+			if !sagaContext(msg).Orchestrated() {
+				msg.Ack(false)
+				continue
+			}
+
+			var event SagaReplyEvent
+			if err := json.Unmarshal(msg.Body, &event); err != nil {
+				log.Printf("Failed to unmarshal %s reply: %v", msg.RoutingKey, err)
+				msg.Nack(false, false) // Don't requeue
+				continue
+			}
+
+			log.Printf("Received %s reply for saga of order %s", msg.RoutingKey, event.OrderID)
+
+			detail := event.Reason
+			if detail == "" {
+				detail = event.Message
+			}
+
+			if err := c.orchestrator.HandleSagaReply(msg.RoutingKey, event.OrderID, detail, msg.MessageId); err != nil {
+				log.Printf("Failed to handle %s reply: %v", msg.RoutingKey, err)
+				msg.Nack(false, true) // Requeue on failure
+				continue
+			}
+
+			// Acknowledge the message
+			msg.Ack(false)
+		}
+	}()
+
+	log.Println("Saga reply consumer started, waiting for orchestrated participant events...")
+	return nil
+}
+
+func (c *SagaReplyConsumer) Close() {
+	if c.channel != nil {
+		c.channel.Close()
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
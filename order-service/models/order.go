@@ -4,24 +4,100 @@ import (
 	"time"
 )
 
+// Order amounts are integer minor currency units (e.g. cents), never floats.
+// A multi-line order lists its lines in Items; its ItemID is the first
+// line's, Quantity is the total and UnitPriceMinor is 0.
 type Order struct {
-	ID        string    `json:"id" db:"id"`
-	ItemID    string    `json:"item_id" db:"item_id"`
-	Quantity  int       `json:"quantity" db:"quantity"`
-	UserEmail string    `json:"user_email" db:"user_email"`
-	Status    string    `json:"status" db:"status"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	ID             string      `json:"id" db:"id"`
+	ItemID         string      `json:"item_id" db:"item_id"`
+	Quantity       int         `json:"quantity" db:"quantity"`
+	UserEmail      string      `json:"user_email" db:"user_email"`
+	ShipToRegion   string      `json:"ship_to_region,omitempty" db:"ship_to_region"`
+	Status         string      `json:"status" db:"status"`
+	UnitPriceMinor int64       `json:"unit_price_minor" db:"unit_price_minor"`
+	Currency       string      `json:"currency" db:"currency"`
+	TotalMinor     int64       `json:"total_minor" db:"total_minor"`
+	Items          []OrderLine `json:"items,omitempty" db:"-"`
+	ReaperAttempts int         `json:"-" db:"reaper_attempts"`
+	CreatedAt      time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at" db:"updated_at"`
 }
 
+// OrderLine is one line of an order, priced at the catalog price when the
+// order was created
+type OrderLine struct {
+	ItemID         string `json:"item_id" db:"item_id"`
+	Quantity       int    `json:"quantity" db:"quantity"`
+	UnitPriceMinor int64  `json:"unit_price_minor" db:"unit_price_minor"`
+}
+
+// OrderStatusHistory is one entry in an order's audit trail of status changes
+type OrderStatusHistory struct {
+	ID         int64     `json:"id" db:"id"`
+	OrderID    string    `json:"order_id" db:"order_id"`
+	FromStatus string    `json:"from_status,omitempty" db:"from_status"`
+	ToStatus   string    `json:"to_status" db:"to_status"`
+	Reason     string    `json:"reason,omitempty" db:"reason"`
+	EventType  string    `json:"event_type,omitempty" db:"event_type"`
+	EventID    string    `json:"event_id,omitempty" db:"event_id"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// StatusChange describes what caused a status transition
+type StatusChange struct {
+	Reason    string
+	EventType string
+	EventID   string
+}
+
+// IdempotencyRecord stores the outcome of a request made with an
+// Idempotency-Key so that retries get the original response
+type IdempotencyRecord struct {
+	Key            string     `db:"key"`
+	RequestHash    string     `db:"request_hash"`
+	ResponseStatus int        `db:"response_status"`
+	ResponseBody   []byte     `db:"response_body"`
+	OrderID        string     `db:"order_id"`
+	CreatedAt      time.Time  `db:"created_at"`
+	CompletedAt    *time.Time `db:"completed_at"`
+}
+
+// Completed reports whether the original request has finished and its
+// response can be replayed
+func (r *IdempotencyRecord) Completed() bool {
+	return r.CompletedAt != nil
+}
+
+// CreateOrderRequest orders either one item (ItemID and Quantity) or
+// several (Items); inventory reserves all lines of an order or none
 type CreateOrderRequest struct {
-	ItemID    string `json:"item_id" binding:"required"`
-	Quantity  int    `json:"quantity" binding:"required,min=1"`
-	UserEmail string `json:"user_email" binding:"required,email"`
+	ItemID    string             `json:"item_id,omitempty" binding:"required_without=Items,excluded_with=Items"`
+	Quantity  int                `json:"quantity,omitempty" binding:"required_without=Items,excluded_with=Items,omitempty,min=1"`
+	Items     []OrderLineRequest `json:"items,omitempty" binding:"omitempty,min=1,max=50,dive"`
+	UserEmail string             `json:"user_email" binding:"required,email"`
+	// ShipToRegion is where the order ships to; inventory uses it to pick
+	// the nearest warehouse
+	ShipToRegion string `json:"ship_to_region" binding:"omitempty,max=50"`
+}
+
+// OrderLineRequest is one line of a multi-line order request
+type OrderLineRequest struct {
+	ItemID   string `json:"item_id" binding:"required"`
+	Quantity int    `json:"quantity" binding:"required,min=1"`
+}
+
+// Lines returns the request's order lines: Items, or its one item
+func (r *CreateOrderRequest) Lines() []OrderLineRequest {
+	if len(r.Items) > 0 {
+		return r.Items
+	}
+	return []OrderLineRequest{{ItemID: r.ItemID, Quantity: r.Quantity}}
 }
 
 const (
-	OrderStatusPending   = "PENDING"
-	OrderStatusProcessed = "PROCESSED"
-	OrderStatusFailed    = "FAILED"
+	OrderStatusPending     = "PENDING"
+	OrderStatusBackordered = "BACKORDERED"
+	OrderStatusCompleted   = "COMPLETED"
+	OrderStatusCancelled   = "CANCELLED"
+	OrderStatusTimedOut    = "TIMED_OUT"
 )
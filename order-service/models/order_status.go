@@ -0,0 +1,72 @@
+package models
+
+// orderTransitions is the order state machine: for every status it lists the
+// statuses an order is allowed to move to next. Statuses with no outgoing
+// transitions are terminal.
+var orderTransitions = map[string][]string{
+	OrderStatusPending:     {OrderStatusBackordered, OrderStatusCompleted, OrderStatusCancelled, OrderStatusTimedOut},
+	OrderStatusBackordered: {OrderStatusCompleted, OrderStatusCancelled},
+	OrderStatusCompleted:   {},
+	OrderStatusCancelled:   {},
+	OrderStatusTimedOut:    {},
+}
+
+// IsValidStatus reports whether status is a known order status
+func IsValidStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// IsTerminalStatus reports whether an order in status can no longer change
+func IsTerminalStatus(status string) bool {
+	next, ok := orderTransitions[status]
+	return ok && len(next) == 0
+}
+
+// CanTransition reports whether an order may move from one status to another
+func CanTransition(from, to string) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// SourceStatuses returns the statuses an order must currently be in to be
+// moved to the given status
+func SourceStatuses(to string) []string {
+	var sources []string
+	for from := range orderTransitions {
+		if CanTransition(from, to) {
+			sources = append(sources, from)
+		}
+	}
+	return sources
+}
+
+// NonTerminalStatuses returns the statuses in which an order is still waiting
+// on the saga
+func NonTerminalStatuses() []string {
+	var statuses []string
+	for status, next := range orderTransitions {
+		if len(next) > 0 {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// ReapableStatuses returns the non-terminal statuses in which an order is
+// expected to make progress soon. BACKORDERED orders are left out: they wait
+// for stock for as long as the inventory service allows, and it cancels them
+// once that wait is over.
+func ReapableStatuses() []string {
+	var statuses []string
+	for _, status := range NonTerminalStatuses() {
+		if status != OrderStatusBackordered {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
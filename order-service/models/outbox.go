@@ -0,0 +1,17 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// OutboxEvent is an event recorded in the same transaction as the status
+// change it announces (e.g. order.timed_out), so it cannot be lost if the
+// broker is down when the change is made. It is deleted once published.
+type OutboxEvent struct {
+	ID         int64           `json:"id" db:"id"`
+	OrderID    string          `json:"order_id" db:"order_id"`
+	RoutingKey string          `json:"routing_key" db:"routing_key"`
+	Payload    json.RawMessage `json:"payload" db:"payload"`
+	CreatedAt  time.Time       `json:"created_at" db:"created_at"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Product is the order service's read-only copy of an inventory product,
+// kept in products_view and used to validate and price orders. ParentID is
+// set on variants (SKUs); HasVariants is set on the products they belong
+// to, which cannot be ordered themselves. AllowBackorder products can be
+// ordered beyond their available stock. Version is the inventory product's
+// version, which every change to it increases.
+type Product struct {
+	ID              string    `json:"id" db:"id"`
+	Name            string    `json:"name" db:"name"`
+	Stock           int       `json:"stock" db:"stock"`
+	Reserved        int       `json:"reserved" db:"reserved"`
+	PriceMinor      int64     `json:"price_minor" db:"price_minor"`
+	Currency        string    `json:"currency" db:"currency"`
+	AllowBackorder  bool      `json:"allow_backorder" db:"allow_backorder"`
+	ParentID        string    `json:"parent_id,omitempty" db:"parent_id"`
+	HasVariants     bool      `json:"-" db:"-"`
+	Version         int64     `json:"version" db:"source_version"`
+	SourceUpdatedAt time.Time `json:"updated_at" db:"source_updated_at"`
+	ProjectedAt     time.Time `json:"projected_at" db:"projected_at"`
+}
+
+// Available returns the stock that is not already held for other orders
+func (p *Product) Available() int {
+	return p.Stock - p.Reserved
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+)
+
+// Saga states tracked by the orchestrator for orders placed in orchestration
+// mode. Each non-terminal state names the reply the orchestrator waits for.
+const (
+	SagaStatePaymentPending   = "PAYMENT_PENDING"
+	SagaStateInventoryPending = "INVENTORY_PENDING"
+	SagaStateCapturePending   = "CAPTURE_PENDING"
+	SagaStateCompensating     = "COMPENSATING"
+	SagaStateCompleted        = "COMPLETED"
+	SagaStateCancelled        = "CANCELLED"
+	SagaStateAborted          = "ABORTED"
+)
+
+// Saga is the orchestrator's persisted progress for one order
+type Saga struct {
+	OrderID   string    `json:"order_id" db:"order_id"`
+	State     string    `json:"state" db:"state"`
+	LastError string    `json:"last_error,omitempty" db:"last_error"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// IsTerminalSagaState reports whether a saga in state has finished
+func IsTerminalSagaState(state string) bool {
+	switch state {
+	case SagaStateCompleted, SagaStateCancelled, SagaStateAborted:
+		return true
+	}
+	return false
+}
+
+// NonTerminalSagaStates returns the states of sagas still in progress
+func NonTerminalSagaStates() []string {
+	return []string{SagaStatePaymentPending, SagaStateInventoryPending, SagaStateCapturePending, SagaStateCompensating}
+}
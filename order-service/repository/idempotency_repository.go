@@ -0,0 +1,152 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
+)
+
+// ErrIdempotencyKeyUsed is returned when the response for a key was
+// stored by another request first, e.g. one that took the key over
+var ErrIdempotencyKeyUsed = errors.New("idempotency key was already used")
+
+// staleIdempotencyKeyAge is how long a key can stay in progress before a
+// retry may take it over. A request that still holds it is long gone by
+// then, e.g. because the service crashed before creating the order.
+const staleIdempotencyKeyAge = time.Minute
+
+// IdempotentResponse is the response stored for a reserved key in the same
+// transaction as the order it answers, so a created order never leaves its
+// key in progress. Body builds the response from the order.
+type IdempotentResponse struct {
+	Key    string
+	Status int
+	Body   func(order *models.Order) ([]byte, error)
+}
+
+type IdempotencyRepository struct {
+	db *sql.DB
+}
+
+func NewIdempotencyRepository(db *sql.DB) *IdempotencyRepository {
+	return &IdempotencyRepository{db: db}
+}
+
+// Reserve claims key for a request with the given hash. It returns
+// reserved=true if the caller now owns the key and should process the request;
+// otherwise it returns the record left by the earlier request with that key.
+// A key left in progress for longer than staleIdempotencyKeyAge is taken over
+// by a retry of the same request; a different request gets the record, so
+// the caller reports the mismatch.
+func (r *IdempotencyRepository) Reserve(key, requestHash string) (*models.IdempotencyRecord, bool, error) {
+	query := `
+		INSERT INTO idempotency_keys (key, request_hash, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE
+		SET created_at = EXCLUDED.created_at
+		WHERE idempotency_keys.completed_at IS NULL AND idempotency_keys.created_at < $4
+		  AND idempotency_keys.request_hash = EXCLUDED.request_hash
+	`
+
+	now := time.Now()
+	result, err := r.db.Exec(query, key, requestHash, now, now.Add(-staleIdempotencyKeyAge))
+	if err != nil {
+		return nil, false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if rowsAffected == 1 {
+		return nil, true, nil
+	}
+
+	record, err := r.Get(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return record, false, nil
+}
+
+// completeKey stores the response for a reserved key in tx. It fails with
+// ErrIdempotencyKeyUsed if the key is no longer in progress.
+func completeKey(tx *sql.Tx, response *IdempotentResponse, order *models.Order) error {
+	body, err := response.Body(order)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE idempotency_keys
+		SET response_status = $1, response_body = $2, order_id = $3, completed_at = $4
+		WHERE key = $5 AND completed_at IS NULL
+	`
+
+	result, err := tx.Exec(query, response.Status, string(body), order.ID, time.Now(), response.Key)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrIdempotencyKeyUsed
+	}
+
+	return nil
+}
+
+// Release frees a reserved key whose request failed, so the client can retry
+func (r *IdempotencyRepository) Release(key string) error {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE key = $1 AND completed_at IS NULL
+	`
+
+	_, err := r.db.Exec(query, key)
+	return err
+}
+
+// Get returns the record for a key
+func (r *IdempotencyRepository) Get(key string) (*models.IdempotencyRecord, error) {
+	record := &models.IdempotencyRecord{}
+
+	var (
+		status  sql.NullInt64
+		body    sql.NullString
+		orderID sql.NullString
+	)
+
+	query := `
+		SELECT key, request_hash, response_status, response_body, order_id, created_at, completed_at
+		FROM idempotency_keys
+		WHERE key = $1
+	`
+
+	err := r.db.QueryRow(query, key).Scan(
+		&record.Key,
+		&record.RequestHash,
+		&status,
+		&body,
+		&orderID,
+		&record.CreatedAt,
+		&record.CompletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	record.ResponseStatus = int(status.Int64)
+	record.ResponseBody = []byte(body.String)
+	record.OrderID = orderID.String
+
+	return record, nil
+}
@@ -2,13 +2,37 @@ package repository
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
 )
 
+var (
+	ErrOrderNotFound     = errors.New("order not found")
+	ErrInvalidTransition = errors.New("invalid order status transition")
+)
+
+// TransitionError is returned when an order is not in a status from which the
+// requested status can be reached
+type TransitionError struct {
+	OrderID string
+	From    string
+	To      string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("order %s cannot move from %s to %s", e.OrderID, e.From, e.To)
+}
+
+func (e *TransitionError) Unwrap() error {
+	return ErrInvalidTransition
+}
+
 type OrderRepository struct {
 	db *sql.DB
 }
@@ -17,28 +41,54 @@ func NewOrderRepository(db *sql.DB) *OrderRepository {
 	return &OrderRepository{db: db}
 }
 
-func (r *OrderRepository) Create(req *models.CreateOrderRequest) (*models.Order, error) {
+// Create stores a new PENDING order of lines, priced at the catalog prices
+// in currency. An order of several lines keeps them in order_lines. If
+// response is set, the reserved idempotency key is completed with it in the
+// same transaction.
+func (r *OrderRepository) Create(req *models.CreateOrderRequest, lines []models.OrderLine, currency string, response *IdempotentResponse) (*models.Order, error) {
 	order := &models.Order{
-		ID:        uuid.New().String(),
-		ItemID:    req.ItemID,
-		Quantity:  req.Quantity,
-		UserEmail: req.UserEmail,
-		Status:    models.OrderStatusPending,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:           uuid.New().String(),
+		ItemID:       lines[0].ItemID,
+		UserEmail:    req.UserEmail,
+		ShipToRegion: req.ShipToRegion,
+		Status:       models.OrderStatusPending,
+		Currency:     currency,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}
+
+	for _, line := range lines {
+		order.Quantity += line.Quantity
+		order.TotalMinor += line.UnitPriceMinor * int64(line.Quantity)
 	}
 
+	if len(lines) == 1 {
+		order.UnitPriceMinor = lines[0].UnitPriceMinor
+	} else {
+		order.Items = lines
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
 	query := `
-		INSERT INTO orders (id, item_id, quantity, user_email, status, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO orders (id, item_id, quantity, user_email, ship_to_region, status, unit_price_minor, currency, total_minor, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 	`
 
-	_, err := r.db.Exec(query,
+	_, err = tx.Exec(query,
 		order.ID,
 		order.ItemID,
 		order.Quantity,
 		order.UserEmail,
+		order.ShipToRegion,
 		order.Status,
+		order.UnitPriceMinor,
+		order.Currency,
+		order.TotalMinor,
 		order.CreatedAt,
 		order.UpdatedAt,
 	)
@@ -47,6 +97,33 @@ func (r *OrderRepository) Create(req *models.CreateOrderRequest) (*models.Order,
 		return nil, err
 	}
 
+	lineQuery := `
+		INSERT INTO order_lines (order_id, line, item_id, quantity, unit_price_minor)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+
+	for i, line := range order.Items {
+		if _, err := tx.Exec(lineQuery, order.ID, i+1, line.ItemID, line.Quantity, line.UnitPriceMinor); err != nil {
+			return nil, err
+		}
+	}
+
+	// Record the initial status as the first history entry
+	change := models.StatusChange{Reason: "Order created"}
+	if err := insertHistory(tx, order.ID, "", order.Status, change, order.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	if response != nil {
+		if err := completeKey(tx, response, order); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
 	return order, nil
 }
 
@@ -54,7 +131,7 @@ func (r *OrderRepository) GetByID(id string) (*models.Order, error) {
 	order := &models.Order{}
 
 	query := `
-		SELECT id, item_id, quantity, user_email, status, created_at, updated_at
+		SELECT id, item_id, quantity, user_email, ship_to_region, status, unit_price_minor, currency, total_minor, created_at, updated_at
 		FROM orders
 		WHERE id = $1
 	`
@@ -64,7 +141,11 @@ func (r *OrderRepository) GetByID(id string) (*models.Order, error) {
 		&order.ItemID,
 		&order.Quantity,
 		&order.UserEmail,
+		&order.ShipToRegion,
 		&order.Status,
+		&order.UnitPriceMinor,
+		&order.Currency,
+		&order.TotalMinor,
 		&order.CreatedAt,
 		&order.UpdatedAt,
 	)
@@ -73,16 +154,217 @@ func (r *OrderRepository) GetByID(id string) (*models.Order, error) {
 		return nil, err
 	}
 
+	if order.Items, err = r.getLines(order.ID); err != nil {
+		return nil, err
+	}
+
 	return order, nil
 }
 
-func (r *OrderRepository) UpdateStatus(id, status string) error {
+// FindStuck returns up to limit orders that have sat in one of statuses
+// since before olderThan, oldest first
+func (r *OrderRepository) FindStuck(statuses []string, olderThan time.Time, limit int) ([]models.Order, error) {
+	query := `
+		SELECT id, item_id, quantity, user_email, ship_to_region, status, unit_price_minor, currency, total_minor, reaper_attempts, created_at, updated_at
+		FROM orders
+		WHERE status = ANY($1) AND updated_at < $2
+		ORDER BY updated_at
+		LIMIT $3
+	`
+
+	rows, err := r.db.Query(query, pq.Array(statuses), olderThan, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []models.Order{}
+	for rows.Next() {
+		var order models.Order
+		if err := rows.Scan(
+			&order.ID,
+			&order.ItemID,
+			&order.Quantity,
+			&order.UserEmail,
+			&order.ShipToRegion,
+			&order.Status,
+			&order.UnitPriceMinor,
+			&order.Currency,
+			&order.TotalMinor,
+			&order.ReaperAttempts,
+			&order.CreatedAt,
+			&order.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// Republished orders need their lines
+	for i := range orders {
+		if orders[i].Items, err = r.getLines(orders[i].ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return orders, nil
+}
+
+// getLines returns the lines of a multi-line order, or nil for an order of
+// one item
+func (r *OrderRepository) getLines(orderID string) ([]models.OrderLine, error) {
+	query := `
+		SELECT item_id, quantity, unit_price_minor
+		FROM order_lines
+		WHERE order_id = $1
+		ORDER BY line
+	`
+
+	rows, err := r.db.Query(query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []models.OrderLine
+	for rows.Next() {
+		var line models.OrderLine
+		if err := rows.Scan(&line.ItemID, &line.Quantity, &line.UnitPriceMinor); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, rows.Err()
+}
+
+// MarkRepublished records a reaper retry and restarts the order's deadline.
+// It only succeeds while the order is still in the status it was found in.
+func (r *OrderRepository) MarkRepublished(id, status string) (bool, error) {
 	query := `
 		UPDATE orders
+		SET reaper_attempts = reaper_attempts + 1, updated_at = $1
+		WHERE id = $2 AND status = $3
+	`
+
+	result, err := r.db.Exec(query, time.Now(), id, status)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// UpdateStatus moves an order to status, but only if the order state machine
+// allows it from the order's current status. The guard is part of the UPDATE
+// itself so concurrent consumers cannot overwrite a terminal status. The
+// transition and what caused it are recorded in order_status_history in the
+// same transaction, as is outbox, the event announcing the change, if any.
+// It returns the status the order moved from.
+func (r *OrderRepository) UpdateStatus(id, status string, change models.StatusChange, outbox *models.OutboxEvent) (string, error) {
+	sources := models.SourceStatuses(status)
+	if len(sources) == 0 {
+		return "", &TransitionError{OrderID: id, To: status}
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	query := `
+		UPDATE orders o
 		SET status = $1, updated_at = $2
-		WHERE id = $3
+		FROM (SELECT id, status FROM orders WHERE id = $3 FOR UPDATE) prev
+		WHERE o.id = prev.id AND prev.status = ANY($4)
+		RETURNING prev.status
+	`
+
+	var from string
+	err = tx.QueryRow(query, status, now, id, pq.Array(sources)).Scan(&from)
+	if err == sql.ErrNoRows {
+		// Find out whether the order is missing or just in the wrong status
+		var current string
+		err := tx.QueryRow(`SELECT status FROM orders WHERE id = $1`, id).Scan(&current)
+		if err == sql.ErrNoRows {
+			return "", ErrOrderNotFound
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", &TransitionError{OrderID: id, From: current, To: status}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := insertHistory(tx, id, from, status, change, now); err != nil {
+		return "", err
+	}
+
+	if outbox != nil {
+		if err := insertOutbox(tx, outbox, now); err != nil {
+			return "", err
+		}
+	}
+
+	return from, tx.Commit()
+}
+
+// GetStatusHistory returns an order's status transitions, oldest first
+func (r *OrderRepository) GetStatusHistory(orderID string) ([]models.OrderStatusHistory, error) {
+	query := `
+		SELECT id, order_id, COALESCE(from_status, ''), to_status, reason, event_type, event_id, created_at
+		FROM order_status_history
+		WHERE order_id = $1
+		ORDER BY created_at, id
+	`
+
+	rows, err := r.db.Query(query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []models.OrderStatusHistory{}
+	for rows.Next() {
+		var entry models.OrderStatusHistory
+		if err := rows.Scan(
+			&entry.ID,
+			&entry.OrderID,
+			&entry.FromStatus,
+			&entry.ToStatus,
+			&entry.Reason,
+			&entry.EventType,
+			&entry.EventID,
+			&entry.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		history = append(history, entry)
+	}
+
+	return history, rows.Err()
+}
+
+func insertHistory(tx *sql.Tx, orderID, from, to string, change models.StatusChange, at time.Time) error {
+	query := `
+		INSERT INTO order_status_history (order_id, from_status, to_status, reason, event_type, event_id, created_at)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7)
 	`
 
-	_, err := r.db.Exec(query, status, time.Now(), id)
+	_, err := tx.Exec(query, orderID, from, to, change.Reason, change.EventType, change.EventID, at)
 	return err
 }
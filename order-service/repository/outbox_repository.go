@@ -0,0 +1,55 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
+)
+
+// PendingOutbox returns up to limit outbox events recorded before the given
+// time that have not been published yet, oldest first
+func (r *OrderRepository) PendingOutbox(before time.Time, limit int) ([]models.OutboxEvent, error) {
+	query := `
+		SELECT id, order_id, routing_key, payload, created_at
+		FROM order_outbox
+		WHERE created_at < $1
+		ORDER BY id
+		LIMIT $2
+	`
+
+	rows, err := r.db.Query(query, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.OutboxEvent{}
+	for rows.Next() {
+		var event models.OutboxEvent
+		if err := rows.Scan(&event.ID, &event.OrderID, &event.RoutingKey, &event.Payload, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// DeleteOutbox removes an outbox event once it has been published
+func (r *OrderRepository) DeleteOutbox(id int64) error {
+	_, err := r.db.Exec(`DELETE FROM order_outbox WHERE id = $1`, id)
+	return err
+}
+
+// insertOutbox records an event in the transaction of the change it announces
+func insertOutbox(tx *sql.Tx, event *models.OutboxEvent, at time.Time) error {
+	query := `
+		INSERT INTO order_outbox (order_id, routing_key, payload, created_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`
+
+	event.CreatedAt = at
+	return tx.QueryRow(query, event.OrderID, event.RoutingKey, []byte(event.Payload), at).Scan(&event.ID)
+}
@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
+)
+
+// ProductViewRepository stores the local products_view projection of the
+// inventory catalog
+type ProductViewRepository struct {
+	db *sql.DB
+}
+
+func NewProductViewRepository(db *sql.DB) *ProductViewRepository {
+	return &ProductViewRepository{db: db}
+}
+
+func (r *ProductViewRepository) GetByID(id string) (*models.Product, error) {
+	product := &models.Product{}
+
+	query := `
+		SELECT p.id, p.name, p.stock, p.reserved, p.price_minor, p.currency, p.allow_backorder, p.parent_id,
+			EXISTS (SELECT 1 FROM products_view v WHERE v.parent_id = p.id),
+			p.source_version, p.source_updated_at, p.projected_at
+		FROM products_view p
+		WHERE p.id = $1
+	`
+
+	err := r.db.QueryRow(query, id).Scan(
+		&product.ID,
+		&product.Name,
+		&product.Stock,
+		&product.Reserved,
+		&product.PriceMinor,
+		&product.Currency,
+		&product.AllowBackorder,
+		&product.ParentID,
+		&product.HasVariants,
+		&product.Version,
+		&product.SourceUpdatedAt,
+		&product.ProjectedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return product, nil
+}
+
+// Upsert writes a product snapshot unless the view already holds a newer
+// one, so out-of-order events cannot roll a product back. Snapshots are
+// ordered by version, as some changes (e.g. a stock alert) do not move
+// updated_at; the timestamp only breaks ties between equal versions. It
+// reports whether the snapshot was applied.
+func (r *ProductViewRepository) Upsert(product *models.Product) (bool, error) {
+	query := `
+		INSERT INTO products_view (id, name, stock, reserved, price_minor, currency, allow_backorder, parent_id, source_version, source_updated_at, projected_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (id) DO UPDATE
+		SET name = EXCLUDED.name,
+			stock = EXCLUDED.stock,
+			reserved = EXCLUDED.reserved,
+			price_minor = EXCLUDED.price_minor,
+			currency = EXCLUDED.currency,
+			allow_backorder = EXCLUDED.allow_backorder,
+			parent_id = EXCLUDED.parent_id,
+			source_version = EXCLUDED.source_version,
+			source_updated_at = EXCLUDED.source_updated_at,
+			projected_at = EXCLUDED.projected_at
+		WHERE products_view.source_version < EXCLUDED.source_version
+			OR (products_view.source_version = EXCLUDED.source_version
+				AND products_view.source_updated_at <= EXCLUDED.source_updated_at)
+	`
+
+	result, err := r.db.Exec(query,
+		product.ID,
+		product.Name,
+		product.Stock,
+		product.Reserved,
+		product.PriceMinor,
+		product.Currency,
+		product.AllowBackorder,
+		product.ParentID,
+		product.Version,
+		product.SourceUpdatedAt,
+		product.ProjectedAt,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// ReplaceAll atomically swaps the whole projection for products
+func (r *ProductViewRepository) ReplaceAll(products []models.Product) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM products_view`); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO products_view (id, name, stock, reserved, price_minor, currency, allow_backorder, parent_id, source_version, source_updated_at, projected_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`
+
+	now := time.Now()
+	for _, product := range products {
+		_, err := tx.Exec(query,
+			product.ID,
+			product.Name,
+			product.Stock,
+			product.Reserved,
+			product.PriceMinor,
+			product.Currency,
+			product.AllowBackorder,
+			product.ParentID,
+			product.Version,
+			product.SourceUpdatedAt,
+			now,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *ProductViewRepository) Count() (int, error) {
+	var count int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM products_view`).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
+)
+
+var ErrSagaNotFound = errors.New("saga not found")
+
+type SagaRepository struct {
+	db *sql.DB
+}
+
+func NewSagaRepository(db *sql.DB) *SagaRepository {
+	return &SagaRepository{db: db}
+}
+
+// Create starts tracking an orchestrated saga for an order
+func (r *SagaRepository) Create(orderID, state string) error {
+	query := `
+		INSERT INTO sagas (order_id, state, created_at, updated_at)
+		VALUES ($1, $2, $3, $3)
+		ON CONFLICT (order_id) DO NOTHING
+	`
+
+	_, err := r.db.Exec(query, orderID, state, time.Now())
+	return err
+}
+
+func (r *SagaRepository) GetByOrderID(orderID string) (*models.Saga, error) {
+	saga := &models.Saga{}
+
+	query := `
+		SELECT order_id, state, last_error, created_at, updated_at
+		FROM sagas
+		WHERE order_id = $1
+	`
+
+	err := r.db.QueryRow(query, orderID).Scan(
+		&saga.OrderID,
+		&saga.State,
+		&saga.LastError,
+		&saga.CreatedAt,
+		&saga.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrSagaNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return saga, nil
+}
+
+// Advance moves a saga to the next state, recording lastError if it is not
+// empty. It reports whether the saga was still in one of the from states, so
+// duplicate or late replies do not advance it twice.
+func (r *SagaRepository) Advance(orderID string, from []string, to, lastError string) (bool, error) {
+	query := `
+		UPDATE sagas
+		SET state = $1,
+			last_error = CASE WHEN $2 = '' THEN last_error ELSE $2 END,
+			updated_at = $3
+		WHERE order_id = $4 AND state = ANY($5)
+	`
+
+	result, err := r.db.Exec(query, to, lastError, time.Now(), orderID, pq.Array(from))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
@@ -0,0 +1,219 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/messaging"
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/repository"
+)
+
+// sagaStep is the saga states a participant reply is expected in and the
+// state it moves the saga to
+type sagaStep struct {
+	from []string
+	to   string
+}
+
+// sagaSteps is the orchestrated saga: the payment is authorized first, then
+// stock is reserved and the payment captured. An inventory failure is
+// compensated by voiding the authorization; a refused capture has already
+// released it, and the cancelled order gives the stock back. payment.successful
+// and payment.refunded answer the payment.charge and payment.refund commands
+// of sagas started before payments were authorized.
+var sagaSteps = map[string]sagaStep{
+	"payment.authorized":    {[]string{models.SagaStatePaymentPending}, models.SagaStateInventoryPending},
+	"payment.successful":    {[]string{models.SagaStatePaymentPending}, models.SagaStateInventoryPending},
+	"payment.failed":        {[]string{models.SagaStatePaymentPending, models.SagaStateCapturePending}, models.SagaStateCancelled},
+	"inventory.successful":  {[]string{models.SagaStateInventoryPending}, models.SagaStateCapturePending},
+	"inventory.failed":      {[]string{models.SagaStateInventoryPending}, models.SagaStateCompensating},
+	"payment.captured":      {[]string{models.SagaStateCapturePending}, models.SagaStateCompleted},
+	"payment.voided":        {[]string{models.SagaStateCompensating}, models.SagaStateCancelled},
+	"payment.void_failed":   {[]string{models.SagaStateCompensating}, models.SagaStateCancelled},
+	"payment.refunded":      {[]string{models.SagaStateCompensating}, models.SagaStateCancelled},
+	"payment.refund_failed": {[]string{models.SagaStateCompensating}, models.SagaStateCancelled},
+}
+
+// Orchestrator drives orders placed in orchestration mode. Instead of each
+// participant reacting to the previous one's event, it persists the saga
+// state per order, sends commands on the saga exchange and advances on the
+// participants' replies.
+type Orchestrator struct {
+	sagas        *repository.SagaRepository
+	orders       *repository.OrderRepository
+	orderService *OrderService
+	publisher    *messaging.Publisher
+}
+
+func NewOrchestrator(sagas *repository.SagaRepository, orders *repository.OrderRepository, orderService *OrderService, publisher *messaging.Publisher) *Orchestrator {
+	return &Orchestrator{
+		sagas:        sagas,
+		orders:       orders,
+		orderService: orderService,
+		publisher:    publisher,
+	}
+}
+
+// Start begins the saga for a newly created order by asking payment to
+// authorize it. order.created is still published for observers; participants
+// skip it.
+func (o *Orchestrator) Start(order *models.Order) error {
+	if err := o.sagas.Create(order.ID, models.SagaStatePaymentPending); err != nil {
+		return err
+	}
+
+	if err := o.publisher.PublishOrderCreated(messaging.NewOrderCreatedEvent(order), messaging.Orchestration); err != nil {
+		log.Printf("Failed to publish order.created event for order %s: %v", order.ID, err)
+	}
+
+	return o.publisher.PublishSagaCommand("payment.authorize", messaging.NewSagaCommand(order, ""))
+}
+
+// HandleSagaReply advances an order's saga on a participant reply. Replies
+// that do not match the saga's current state (duplicates, or replies for a
+// saga that was aborted) are ignored.
+func (o *Orchestrator) HandleSagaReply(eventType, orderID, detail, eventID string) error {
+	if eventType == "inventory.backordered" {
+		return o.backordered(orderID, detail, eventID)
+	}
+
+	step, ok := sagaSteps[eventType]
+	if !ok {
+		return nil
+	}
+
+	saga, err := o.sagas.GetByOrderID(orderID)
+	if errors.Is(err, repository.ErrSagaNotFound) {
+		log.Printf("Ignoring %s reply for order %s without a saga", eventType, orderID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	lastError := ""
+	switch eventType {
+	case "payment.failed", "inventory.failed":
+		lastError = detail
+	case "payment.refund_failed":
+		lastError = fmt.Sprintf("%s; refund failed: %s", saga.LastError, detail)
+	case "payment.void_failed":
+		lastError = fmt.Sprintf("%s; void failed: %s", saga.LastError, detail)
+	}
+
+	advanced, err := o.sagas.Advance(orderID, step.from, step.to, lastError)
+	if err != nil {
+		return err
+	}
+	if !advanced {
+		log.Printf("Ignoring %s reply for saga of order %s in state %s", eventType, orderID, saga.State)
+		return nil
+	}
+
+	saga.State = step.to
+	if lastError != "" {
+		saga.LastError = lastError
+	}
+	log.Printf("Saga for order %s moved to %s on %s", orderID, saga.State, eventType)
+
+	switch eventType {
+	case "payment.refund_failed":
+		log.Printf("Refund for order %s needs manual follow-up: %s", orderID, detail)
+	case "payment.void_failed":
+		log.Printf("Void for order %s needs manual follow-up: %s", orderID, detail)
+	}
+
+	order, err := o.orders.GetByID(orderID)
+	if err != nil {
+		return err
+	}
+
+	// The saga has already moved on, so a failure here is not retried by
+	// redelivering the reply; the reaper resumes the saga instead
+	change := models.StatusChange{
+		Reason:    detail,
+		EventType: eventType,
+		EventID:   eventID,
+	}
+	if err := o.act(order, saga, change); err != nil {
+		log.Printf("Failed to act on saga for order %s in state %s: %v", orderID, saga.State, err)
+	}
+
+	return nil
+}
+
+// backordered marks an order whose stock is backordered. The saga keeps
+// waiting in INVENTORY_PENDING for inventory's final reply, which comes once
+// the stock arrives or the backorder expires.
+func (o *Orchestrator) backordered(orderID, detail, eventID string) error {
+	saga, err := o.sagas.GetByOrderID(orderID)
+	if errors.Is(err, repository.ErrSagaNotFound) {
+		log.Printf("Ignoring inventory.backordered reply for order %s without a saga", orderID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if saga.State != models.SagaStateInventoryPending {
+		log.Printf("Ignoring inventory.backordered reply for saga of order %s in state %s", orderID, saga.State)
+		return nil
+	}
+
+	change := models.StatusChange{
+		Reason:    detail,
+		EventType: "inventory.backordered",
+		EventID:   eventID,
+	}
+	return o.orderService.UpdateOrderStatus(orderID, models.OrderStatusBackordered, change)
+}
+
+// Resume repeats the action for an order's current saga state, e.g. when a
+// command or reply was lost. It reports whether the order has a saga; orders
+// placed in choreography mode do not.
+func (o *Orchestrator) Resume(order *models.Order) (bool, error) {
+	saga, err := o.sagas.GetByOrderID(order.ID)
+	if errors.Is(err, repository.ErrSagaNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	change := models.StatusChange{
+		Reason:    "Saga resumed by the order reaper",
+		EventType: "order.reaper",
+	}
+	return true, o.act(order, saga, change)
+}
+
+// Abort stops an order's saga so that later replies are ignored, e.g. once the
+// reaper has timed the order out
+func (o *Orchestrator) Abort(orderID, reason string) error {
+	_, err := o.sagas.Advance(orderID, models.NonTerminalSagaStates(), models.SagaStateAborted, reason)
+	return err
+}
+
+// act performs what the saga's state calls for: the next command while it is
+// in progress, or the order's final status once it has finished
+func (o *Orchestrator) act(order *models.Order, saga *models.Saga, change models.StatusChange) error {
+	switch saga.State {
+	case models.SagaStatePaymentPending:
+		return o.publisher.PublishSagaCommand("payment.authorize", messaging.NewSagaCommand(order, ""))
+	case models.SagaStateInventoryPending:
+		return o.publisher.PublishSagaCommand("inventory.reserve", messaging.NewSagaCommand(order, ""))
+	case models.SagaStateCapturePending:
+		return o.publisher.PublishSagaCommand("payment.capture", messaging.NewSagaCommand(order, ""))
+	case models.SagaStateCompensating:
+		reason := "Inventory reservation failed: " + saga.LastError
+		return o.publisher.PublishSagaCommand("payment.void", messaging.NewSagaCommand(order, reason))
+	case models.SagaStateCompleted:
+		return o.orderService.UpdateOrderStatus(order.ID, models.OrderStatusCompleted, change)
+	case models.SagaStateCancelled:
+		change.Reason = saga.LastError
+		return o.orderService.UpdateOrderStatus(order.ID, models.OrderStatusCancelled, change)
+	}
+	return nil
+}
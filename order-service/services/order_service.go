@@ -1,30 +1,174 @@
 package services
 
 import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"log"
+	"time"
 
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/messaging"
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
 	"github.com/spksupakorn/ecommerce-event-driven/order-service/repository"
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/stream"
 )
 
+// rejectedTransitions counts status updates refused by the order state
+// machine, keyed by "FROM->TO"
+var rejectedTransitions = expvar.NewMap("order_rejected_transitions")
+
 type OrderService struct {
-	repo *repository.OrderRepository
+	repo      *repository.OrderRepository
+	broker    *stream.Broker
+	publisher *messaging.Publisher
 }
 
-func NewOrderService(repo *repository.OrderRepository) *OrderService {
+func NewOrderService(repo *repository.OrderRepository, broker *stream.Broker, publisher *messaging.Publisher) *OrderService {
 	return &OrderService{
-		repo: repo,
+		repo:      repo,
+		broker:    broker,
+		publisher: publisher,
+	}
+}
+
+// UpdateOrderStatus applies a status transition triggered by a saga event.
+// Transitions the state machine does not allow (e.g. a late payment.failed
+// for a COMPLETED order) and updates for unknown orders are logged and
+// dropped rather than returned, so the triggering message is not redelivered
+// forever.
+func (s *OrderService) UpdateOrderStatus(orderID string, status string, change models.StatusChange) error {
+	// Let participants compensate, e.g. give back stock held for the order
+	var outbox *models.OutboxEvent
+	if status == models.OrderStatusCancelled {
+		event, err := newOutboxEvent(orderID, "order.cancelled", messaging.NewOrderCancelledEvent(orderID, change.Reason))
+		if err != nil {
+			return err
+		}
+		outbox = event
+	}
+
+	applied, err := s.transition(orderID, status, change, outbox)
+	if err != nil || !applied {
+		return err
+	}
+
+	if outbox != nil {
+		s.publishOutbox(outbox)
+	}
+
+	return nil
+}
+
+// TimeOutOrder moves a stuck order to TIMED_OUT and publishes order.timed_out
+// so that participants can compensate (e.g. refund a payment already taken).
+// It reports whether the order was timed out; an order that completed or was
+// cancelled in the meantime is left alone.
+func (s *OrderService) TimeOutOrder(order *models.Order, reason string) (bool, error) {
+	change := models.StatusChange{
+		Reason:    reason,
+		EventType: "order.reaper",
+	}
+
+	outbox, err := newOutboxEvent(order.ID, "order.timed_out", messaging.NewOrderTimedOutEvent(order, reason))
+	if err != nil {
+		return false, err
+	}
+
+	applied, err := s.transition(order.ID, models.OrderStatusTimedOut, change, outbox)
+	if err != nil || !applied {
+		return false, err
+	}
+
+	s.publishOutbox(outbox)
+	return true, nil
+}
+
+// PublishOutbox publishes up to limit outbox events recorded before the
+// given time, i.e. those whose publish failed when their status change was
+// made, and returns how many were published
+func (s *OrderService) PublishOutbox(before time.Time, limit int) (int, error) {
+	events, err := s.repo.PendingOutbox(before, limit)
+	if err != nil {
+		return 0, err
 	}
+
+	published := 0
+	for i := range events {
+		if s.publishOutbox(&events[i]) {
+			published++
+		}
+	}
+
+	return published, nil
 }
 
-func (s *OrderService) UpdateOrderStatus(orderID string, status string) error {
-	log.Printf("Updating order %s status to %s", orderID, status)
+// publishOutbox publishes an outbox event and deletes it once published. An
+// event that cannot be published is kept for PublishOutbox to retry.
+func (s *OrderService) publishOutbox(event *models.OutboxEvent) bool {
+	var err error
+	switch event.RoutingKey {
+	case "order.cancelled":
+		err = s.publisher.PublishOrderCancelled(event.Payload)
+	case "order.timed_out":
+		err = s.publisher.PublishOrderTimedOut(event.Payload)
+	default:
+		err = fmt.Errorf("unknown routing key %q", event.RoutingKey)
+	}
+	if err != nil {
+		log.Printf("Failed to publish %s event for order %s, will retry: %v", event.RoutingKey, event.OrderID, err)
+		return false
+	}
 
-	err := s.repo.UpdateStatus(orderID, status)
+	if err := s.repo.DeleteOutbox(event.ID); err != nil {
+		// Published again on the next retry; participants ignore repeats
+		log.Printf("Failed to delete published %s event for order %s: %v", event.RoutingKey, event.OrderID, err)
+	}
+	return true
+}
+
+// newOutboxEvent builds the outbox event for payload
+func newOutboxEvent(orderID, routingKey string, payload interface{}) (*models.OutboxEvent, error) {
+	body, err := json.Marshal(payload)
 	if err != nil {
+		return nil, err
+	}
+	return &models.OutboxEvent{OrderID: orderID, RoutingKey: routingKey, Payload: body}, nil
+}
+
+// transition records a status change in the order's history, with outbox if
+// it is set, and pushes it to clients streaming the order. It reports whether
+// the change was applied.
+func (s *OrderService) transition(orderID string, status string, change models.StatusChange, outbox *models.OutboxEvent) (bool, error) {
+	log.Printf("Updating order %s status to %s (%s: %s)", orderID, status, change.EventType, change.Reason)
+
+	from, err := s.repo.UpdateStatus(orderID, status, change, outbox)
+
+	var transitionErr *repository.TransitionError
+	switch {
+	case errors.As(err, &transitionErr):
+		rejectedTransitions.Add(transitionErr.From+"->"+transitionErr.To, 1)
+		log.Printf("Rejected illegal status transition: %v", err)
+		return false, nil
+	case errors.Is(err, repository.ErrOrderNotFound):
+		log.Printf("Ignoring status update for unknown order %s", orderID)
+		return false, nil
+	case err != nil:
 		log.Printf("Failed to update order status: %v", err)
-		return err
+		return false, err
 	}
 
 	log.Printf("Successfully updated order %s to status %s", orderID, status)
-	return nil
+
+	s.broker.Publish(stream.StatusUpdate{
+		OrderID:    orderID,
+		FromStatus: from,
+		Status:     status,
+		Reason:     change.Reason,
+		EventType:  change.EventType,
+		Terminal:   models.IsTerminalStatus(status),
+		At:         time.Now(),
+	})
+
+	return true, nil
 }
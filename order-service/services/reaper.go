@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/messaging"
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/models"
+	"github.com/spksupakorn/ecommerce-event-driven/order-service/repository"
+)
+
+// reaperBatchSize caps how many stuck orders are handled per run
+const reaperBatchSize = 100
+
+// Reaper outcomes, exposed on /debug/vars
+var (
+	reaperTimedOut        = expvar.NewInt("order_reaper_timed_out")
+	reaperRepublished     = expvar.NewInt("order_reaper_republished")
+	reaperOutboxPublished = expvar.NewInt("order_reaper_outbox_published")
+)
+
+// Reaper periodically finds orders stuck in a non-terminal status (other than
+// BACKORDERED) for longer than the deadline. Each is first re-emitted as
+// order.created (or, for orchestrated orders, its saga resumed) up to
+// maxRepublish times in case a message was lost, then marked TIMED_OUT. It
+// also publishes order.timed_out and order.cancelled events left in the
+// outbox because the broker was down when the order moved.
+type Reaper struct {
+	repo         *repository.OrderRepository
+	orderService *OrderService
+	orchestrator *Orchestrator
+	publisher    *messaging.Publisher
+	choreography messaging.SagaContext
+	deadline     time.Duration
+	interval     time.Duration
+	maxRepublish int
+}
+
+func NewReaper(repo *repository.OrderRepository, orderService *OrderService, orchestrator *Orchestrator, publisher *messaging.Publisher, choreography messaging.SagaContext, deadline, interval time.Duration, maxRepublish int) *Reaper {
+	return &Reaper{
+		repo:         repo,
+		orderService: orderService,
+		orchestrator: orchestrator,
+		publisher:    publisher,
+		choreography: choreography,
+		deadline:     deadline,
+		interval:     interval,
+		maxRepublish: maxRepublish,
+	}
+}
+
+// Start runs the reaper until ctx is cancelled
+func (r *Reaper) Start(ctx context.Context) {
+	log.Printf("Order reaper started (deadline %s, interval %s, max republish %d)", r.deadline, r.interval, r.maxRepublish)
+
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Println("Order reaper stopped")
+				return
+			case <-ticker.C:
+				r.reap()
+			}
+		}
+	}()
+}
+
+func (r *Reaper) reap() {
+	// Events younger than an interval may still be being published
+	published, err := r.orderService.PublishOutbox(time.Now().Add(-r.interval), reaperBatchSize)
+	if err != nil {
+		log.Printf("Order reaper failed to publish the outbox: %v", err)
+	}
+	reaperOutboxPublished.Add(int64(published))
+
+	orders, err := r.repo.FindStuck(models.ReapableStatuses(), time.Now().Add(-r.deadline), reaperBatchSize)
+	if err != nil {
+		log.Printf("Order reaper failed to find stuck orders: %v", err)
+		return
+	}
+
+	for i := range orders {
+		order := &orders[i]
+
+		if order.ReaperAttempts < r.maxRepublish {
+			r.republish(order)
+			continue
+		}
+
+		reason := fmt.Sprintf("No saga progress for %s while %s", r.deadline, order.Status)
+		timedOut, err := r.orderService.TimeOutOrder(order, reason)
+		if err != nil {
+			log.Printf("Order reaper failed to time out order %s: %v", order.ID, err)
+			continue
+		}
+		if timedOut {
+			reaperTimedOut.Add(1)
+			log.Printf("Order %s timed out: %s", order.ID, reason)
+
+			if err := r.orchestrator.Abort(order.ID, reason); err != nil {
+				log.Printf("Order reaper failed to abort saga for order %s: %v", order.ID, err)
+			}
+		}
+	}
+}
+
+func (r *Reaper) republish(order *models.Order) {
+	marked, err := r.repo.MarkRepublished(order.ID, order.Status)
+	if err != nil {
+		log.Printf("Order reaper failed to mark order %s for retry: %v", order.ID, err)
+		return
+	}
+	if !marked {
+		// The order moved on since it was found
+		return
+	}
+
+	resumed, err := r.orchestrator.Resume(order)
+	if err != nil {
+		log.Printf("Order reaper failed to resume saga for order %s: %v", order.ID, err)
+		return
+	}
+	if resumed {
+		reaperRepublished.Add(1)
+		log.Printf("Resumed saga for stuck order %s (attempt %d)", order.ID, order.ReaperAttempts+1)
+		return
+	}
+
+	if err := r.publisher.PublishOrderCreated(messaging.NewOrderCreatedEvent(order), r.choreography); err != nil {
+		log.Printf("Order reaper failed to re-emit order.created for order %s: %v", order.ID, err)
+		return
+	}
+
+	reaperRepublished.Add(1)
+	log.Printf("Re-emitted order.created for stuck order %s (attempt %d)", order.ID, order.ReaperAttempts+1)
+}
@@ -0,0 +1,77 @@
+package stream
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is how many updates a slow subscriber may fall behind
+// before further updates to it are dropped
+const subscriberBuffer = 16
+
+// StatusUpdate is an order status transition pushed to stream subscribers
+type StatusUpdate struct {
+	OrderID    string    `json:"order_id"`
+	FromStatus string    `json:"from_status,omitempty"`
+	Status     string    `json:"status"`
+	Reason     string    `json:"reason,omitempty"`
+	EventType  string    `json:"event_type,omitempty"`
+	Terminal   bool      `json:"terminal"`
+	At         time.Time `json:"at"`
+}
+
+// Broker fans out status updates applied by this instance to the clients
+// streaming the affected order
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan StatusUpdate]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		subscribers: make(map[string]map[chan StatusUpdate]struct{}),
+	}
+}
+
+// Subscribe registers interest in an order's updates. The returned function
+// must be called to unsubscribe once the client goes away.
+func (b *Broker) Subscribe(orderID string) (<-chan StatusUpdate, func()) {
+	ch := make(chan StatusUpdate, subscriberBuffer)
+
+	b.mu.Lock()
+	if b.subscribers[orderID] == nil {
+		b.subscribers[orderID] = make(map[chan StatusUpdate]struct{})
+	}
+	b.subscribers[orderID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers[orderID], ch)
+			if len(b.subscribers[orderID]) == 0 {
+				delete(b.subscribers, orderID)
+			}
+			b.mu.Unlock()
+		})
+	}
+
+	return ch, unsubscribe
+}
+
+// Publish delivers an update to every subscriber of the order without
+// blocking; subscribers whose buffer is full miss the update
+func (b *Broker) Publish(update StatusUpdate) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers[update.OrderID] {
+		select {
+		case ch <- update:
+		default:
+			log.Printf("Dropping status update for slow stream subscriber of order %s", update.OrderID)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"database/sql"
+	"log"
+
+	_ "github.com/lib/pq"
+)
+
+func InitDB(databaseURL string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	if err := createTables(db); err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(5)
+
+	log.Println("Payment database connected successfully")
+	return db, nil
+}
+
+func createTables(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS payments (
+		id BIGSERIAL PRIMARY KEY,
+		order_id VARCHAR(255) NOT NULL UNIQUE,
+		item_id VARCHAR(255) NOT NULL DEFAULT '',
+		quantity INTEGER NOT NULL DEFAULT 0,
+		user_email VARCHAR(255) NOT NULL DEFAULT '',
+		status VARCHAR(20) NOT NULL,
+		amount_minor BIGINT NOT NULL,
+		currency VARCHAR(3) NOT NULL,
+		provider_ref VARCHAR(255) NOT NULL DEFAULT '',
+		failure_reason TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_payments_status ON payments(status, created_at);
+
+	CREATE TABLE IF NOT EXISTS refunds (
+		id BIGSERIAL PRIMARY KEY,
+		payment_id BIGINT NOT NULL REFERENCES payments(id),
+		order_id VARCHAR(255) NOT NULL,
+		amount_minor BIGINT NOT NULL,
+		currency VARCHAR(3) NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		provider_ref VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_refunds_payment ON refunds(payment_id);
+
+	-- Partial refunds: a payment can have several refunds, each with its own
+	-- idempotency key. Refunds recorded before were full and succeeded.
+	ALTER TABLE payments ADD COLUMN IF NOT EXISTS refunded_minor BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE refunds ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'SUCCEEDED';
+	ALTER TABLE refunds ADD COLUMN IF NOT EXISTS idempotency_key VARCHAR(255);
+	ALTER TABLE refunds ADD COLUMN IF NOT EXISTS failure_reason TEXT NOT NULL DEFAULT '';
+	ALTER TABLE refunds ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+	UPDATE payments SET refunded_minor = amount_minor WHERE status = 'REFUNDED' AND refunded_minor = 0;
+	UPDATE refunds SET idempotency_key = 'refund-' || id WHERE idempotency_key IS NULL;
+
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_refunds_idempotency ON refunds(payment_id, idempotency_key);
+
+	CREATE TABLE IF NOT EXISTS abandoned_orders (
+		order_id VARCHAR(255) PRIMARY KEY,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+
+	log.Println("Payments tables created successfully")
+	return nil
+}
+
+func CloseDB(db *sql.DB) {
+	if err := db.Close(); err != nil {
+		log.Printf("Error closing database: %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcome is what the fake provider does with an authorization
+type Outcome string
+
+const (
+	Approve Outcome = "approve"
+	Decline Outcome = "decline"
+	Fail    Outcome = "error"
+)
+
+// Rule picks the outcome of authorizations for a card token, an exact
+// amount or (AtLeast) any amount from Amount up
+type Rule struct {
+	Token   string
+	Amount  int64
+	AtLeast bool
+	Outcome Outcome
+	Message string
+}
+
+func (r Rule) matches(req AuthorizeRequest) bool {
+	switch {
+	case r.Token != "":
+		return r.Token == req.CardToken
+	case r.AtLeast:
+		return req.AmountMinor >= r.Amount
+	default:
+		return req.AmountMinor == r.Amount
+	}
+}
+
+// DefaultRules decline Stripe's test cards for declines, so the same card
+// tokens behave alike with the fake and with Stripe in test mode. They are
+// checked after any configured rules.
+var DefaultRules = []Rule{
+	{Token: "pm_card_chargeDeclined", Outcome: Decline, Message: "Your card was declined."},
+	{Token: "pm_card_chargeDeclinedInsufficientFunds", Outcome: Decline, Message: "Your card has insufficient funds."},
+	{Token: "pm_card_chargeDeclinedExpiredCard", Outcome: Decline, Message: "Your card has expired."},
+}
+
+// ParseRules reads comma-separated rules (FAKE_GATEWAY_RULES) of the form
+// "token:<token>=<outcome>", "amount:<minor>=<outcome>" or
+// "amount>=<minor>=<outcome>", where an outcome is approve, decline or
+// error and may be followed by ":<message>"
+func ParseRules(s string) ([]Rule, error) {
+	rules := []Rule{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var rule Rule
+		var match, rest string
+		if strings.HasPrefix(entry, "amount>=") {
+			rule.AtLeast = true
+			match, rest, _ = strings.Cut(strings.TrimPrefix(entry, "amount>="), "=")
+		} else {
+			match, rest, _ = strings.Cut(entry, "=")
+			if token, ok := strings.CutPrefix(match, "token:"); ok {
+				rule.Token = token
+			} else if amount, ok := strings.CutPrefix(match, "amount:"); ok {
+				match = amount
+			} else {
+				return nil, fmt.Errorf("fake gateway rule %q: want token:, amount: or amount>=", entry)
+			}
+		}
+
+		if rule.Token == "" {
+			amount, err := strconv.ParseInt(match, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("fake gateway rule %q: invalid amount: %w", entry, err)
+			}
+			rule.Amount = amount
+		}
+
+		outcome, message, _ := strings.Cut(rest, ":")
+		rule.Outcome = Outcome(outcome)
+		rule.Message = message
+		switch rule.Outcome {
+		case Approve:
+		case Decline:
+			if rule.Message == "" {
+				rule.Message = "Your card was declined."
+			}
+		case Fail:
+			if rule.Message == "" {
+				rule.Message = "The payment provider is unavailable."
+			}
+		default:
+			return nil, fmt.Errorf("fake gateway rule %q: unknown outcome %q (want %s, %s or %s)", entry, outcome, Approve, Decline, Fail)
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Fake is a deterministic in-memory provider for development and checks.
+// Authorizations follow the first matching rule and are approved if none
+// matches; captures, voids and refunds are checked against the payment's
+// state like a real provider would. Payments are forgotten on restart, so
+// refunds of payments it has not seen are accepted.
+type Fake struct {
+	rules   []Rule
+	latency time.Duration
+
+	mu       sync.Mutex
+	seq      int
+	payments map[string]*fakePayment
+	results  map[string]fakeResult
+}
+
+type fakePayment struct {
+	amountMinor int64
+	currency    string
+	status      string
+	captured    int64
+	refunded    int64
+}
+
+// Fake payment states
+const (
+	fakeAuthorized = "requires_capture"
+	fakeCaptured   = "succeeded"
+	fakeVoided     = "canceled"
+)
+
+// fakeResult is the remembered outcome of a call with an idempotency key
+type fakeResult struct {
+	ref string
+	err error
+}
+
+func NewFake(rules []Rule, latency time.Duration) *Fake {
+	return &Fake{
+		rules:    append(append([]Rule{}, rules...), DefaultRules...),
+		latency:  latency,
+		payments: make(map[string]*fakePayment),
+		results:  make(map[string]fakeResult),
+	}
+}
+
+func (f *Fake) Authorize(ctx context.Context, req AuthorizeRequest) (string, error) {
+	return f.once(ctx, "authorize", req.IdempotencyKey, func() (string, error) {
+		if req.AmountMinor <= 0 || req.Currency == "" {
+			return "", newError(ErrInvalidRequest, "Amount and currency are required.")
+		}
+
+		if rule, ok := f.match(req); ok {
+			switch rule.Outcome {
+			case Decline:
+				return "", newError(ErrDeclined, "%s", rule.Message)
+			case Fail:
+				return "", newError(ErrUnavailable, "%s", rule.Message)
+			}
+		}
+
+		f.seq++
+		ref := fmt.Sprintf("pi_fake_%d", f.seq)
+		f.payments[ref] = &fakePayment{amountMinor: req.AmountMinor, currency: req.Currency, status: fakeAuthorized}
+		return ref, nil
+	})
+}
+
+// Capture takes up to the authorized amount; the rest of the hold is
+// released
+func (f *Fake) Capture(ctx context.Context, paymentRef string, amountMinor int64, idempotencyKey string) error {
+	_, err := f.once(ctx, "capture", idempotencyKey, func() (string, error) {
+		payment, err := f.payment(paymentRef)
+		if err != nil {
+			return "", err
+		}
+		if payment.status != fakeAuthorized {
+			return "", newError(ErrInvalidRequest, "Payment %s cannot be captured because it is %s.", paymentRef, payment.status)
+		}
+		if amountMinor <= 0 || amountMinor > payment.amountMinor {
+			return "", newError(ErrInvalidRequest, "Capture amount %d must be between 1 and the authorized %d.", amountMinor, payment.amountMinor)
+		}
+
+		payment.status = fakeCaptured
+		payment.captured = amountMinor
+		return paymentRef, nil
+	})
+	return err
+}
+
+func (f *Fake) Void(ctx context.Context, paymentRef, idempotencyKey string) error {
+	_, err := f.once(ctx, "void", idempotencyKey, func() (string, error) {
+		payment, err := f.payment(paymentRef)
+		if err != nil {
+			return "", err
+		}
+		if payment.status != fakeAuthorized {
+			return "", newError(ErrInvalidRequest, "Payment %s cannot be voided because it is %s.", paymentRef, payment.status)
+		}
+
+		payment.status = fakeVoided
+		return paymentRef, nil
+	})
+	return err
+}
+
+func (f *Fake) Refund(ctx context.Context, req RefundRequest) (string, error) {
+	return f.once(ctx, "refund", req.IdempotencyKey, func() (string, error) {
+		if req.AmountMinor <= 0 {
+			return "", newError(ErrInvalidRequest, "Refund amount must be positive.")
+		}
+
+		if payment, ok := f.payments[req.PaymentRef]; ok {
+			if payment.status != fakeCaptured {
+				return "", newError(ErrInvalidRequest, "Payment %s cannot be refunded because it is %s.", req.PaymentRef, payment.status)
+			}
+			if req.AmountMinor > payment.captured-payment.refunded {
+				return "", newError(ErrInvalidRequest, "Refund amount %d exceeds the %d left to refund.", req.AmountMinor, payment.captured-payment.refunded)
+			}
+			payment.refunded += req.AmountMinor
+		}
+
+		f.seq++
+		return fmt.Sprintf("re_fake_%d", f.seq), nil
+	})
+}
+
+// match returns the first rule for an authorization
+func (f *Fake) match(req AuthorizeRequest) (Rule, bool) {
+	for _, rule := range f.rules {
+		if rule.matches(req) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+func (f *Fake) payment(ref string) (*fakePayment, error) {
+	payment, ok := f.payments[ref]
+	if !ok {
+		return nil, newError(ErrNotFound, "No such payment: %s", ref)
+	}
+	return payment, nil
+}
+
+// once runs call after the configured latency, unless an earlier call of the
+// same operation with the same idempotency key already has an outcome.
+// Unavailable errors are not remembered, so they can be retried.
+func (f *Fake) once(ctx context.Context, operation, idempotencyKey string, call func() (string, error)) (string, error) {
+	if f.latency > 0 {
+		select {
+		case <-time.After(f.latency):
+		case <-ctx.Done():
+			return "", newError(ErrUnavailable, "%v", ctx.Err())
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := operation + ":" + idempotencyKey
+	if idempotencyKey != "" {
+		if result, ok := f.results[key]; ok {
+			return result.ref, result.err
+		}
+	}
+
+	ref, err := call()
+	if idempotencyKey != "" && !errors.Is(err, ErrUnavailable) {
+		f.results[key] = fakeResult{ref: ref, err: err}
+	}
+	return ref, err
+}
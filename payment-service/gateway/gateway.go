@@ -0,0 +1,102 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Provider names accepted by New (PAYMENT_GATEWAY)
+const (
+	FakeProvider   = "fake"
+	StripeProvider = "stripe"
+)
+
+// Kinds of provider error; Error wraps one of them
+var (
+	ErrDeclined       = errors.New("payment declined")
+	ErrNotFound       = errors.New("payment not found at provider")
+	ErrInvalidRequest = errors.New("invalid payment request")
+	ErrUnavailable    = errors.New("payment provider unavailable")
+)
+
+// Error is a failure reported by (or on the way to) a provider. Message is
+// the provider's own wording, e.g. "Your card was declined.".
+type Error struct {
+	Kind    error
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+func newError(kind error, format string, args ...interface{}) *Error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+// AuthorizeRequest places a hold of AmountMinor on the card behind
+// CardToken. Retrying with the same IdempotencyKey returns the first
+// authorization instead of placing a second hold.
+type AuthorizeRequest struct {
+	OrderID        string
+	AmountMinor    int64
+	Currency       string
+	CardToken      string
+	IdempotencyKey string
+}
+
+// RefundRequest gives back AmountMinor of a captured payment
+type RefundRequest struct {
+	PaymentRef     string
+	AmountMinor    int64
+	Currency       string
+	Reason         string
+	IdempotencyKey string
+}
+
+// Gateway is a payment provider. Authorize returns the provider's reference
+// for the payment, which Capture, Void and Refund take; Refund returns the
+// reference of the refund. Every call takes an idempotency key so that a
+// retried message cannot move money twice.
+type Gateway interface {
+	Authorize(ctx context.Context, req AuthorizeRequest) (string, error)
+	Capture(ctx context.Context, paymentRef string, amountMinor int64, idempotencyKey string) error
+	Void(ctx context.Context, paymentRef, idempotencyKey string) error
+	Refund(ctx context.Context, req RefundRequest) (string, error)
+}
+
+// Options configures the providers New can build
+type Options struct {
+	// Fake provider
+	FakeRules   string
+	FakeLatency time.Duration
+
+	// Stripe provider
+	StripeURL    string
+	StripeAPIKey string
+	Timeout      time.Duration
+}
+
+// New returns the provider with the given name
+func New(name string, opts Options) (Gateway, error) {
+	switch name {
+	case FakeProvider:
+		rules, err := ParseRules(opts.FakeRules)
+		if err != nil {
+			return nil, err
+		}
+		return NewFake(rules, opts.FakeLatency), nil
+	case StripeProvider:
+		if opts.StripeAPIKey == "" {
+			return nil, errors.New("the stripe gateway needs an API key")
+		}
+		return NewStripe(opts.StripeURL, opts.StripeAPIKey, opts.Timeout), nil
+	}
+	return nil, fmt.Errorf("unknown payment gateway %q (want %s or %s)", name, FakeProvider, StripeProvider)
+}
@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	checkGateway(t, NewFake(nil, 0), "pm_card_visa")
+}
+
+// TestStripeAgainstMockServer runs the Stripe adapter against the mock
+// server, so it is checked without Stripe
+func TestStripeAgainstMockServer(t *testing.T) {
+	server := httptest.NewServer(NewMockServer(NewFake(nil, 0), "sk_test_mock"))
+	defer server.Close()
+
+	checkGateway(t, NewStripe(server.URL, "sk_test_mock", 10*time.Second), "pm_card_visa")
+}
+
+// TestStripeTestMode runs the Stripe adapter against Stripe's test mode. It
+// is skipped unless STRIPE_TEST_API_KEY holds a test mode key.
+func TestStripeTestMode(t *testing.T) {
+	apiKey := os.Getenv("STRIPE_TEST_API_KEY")
+	if apiKey == "" {
+		t.Skip("STRIPE_TEST_API_KEY is not set")
+	}
+
+	checkGateway(t, NewStripe("https://api.stripe.com", apiKey, 30*time.Second), "pm_card_visa")
+}
+
+// checkGateway runs a charge, partial refunds, a void, a decline and a few
+// invalid calls through gw. Amounts are in USD cents.
+func checkGateway(t *testing.T, gw Gateway, cardToken string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	run := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	expect := func(step string, err, kind error) {
+		t.Helper()
+		switch {
+		case kind == nil && err != nil:
+			t.Errorf("%s: %v", step, err)
+		case kind != nil && !errors.Is(err, kind):
+			t.Errorf("%s: want %q, got %v", step, kind, err)
+		}
+	}
+
+	t.Run("charge and refund in parts", func(t *testing.T) {
+		// Charge 25.00 and refund it in two parts; a third refund is too much
+		charge := AuthorizeRequest{OrderID: run, AmountMinor: 2500, Currency: "USD", CardToken: cardToken, IdempotencyKey: run + "-authorize"}
+		ref, err := gw.Authorize(ctx, charge)
+		if err != nil {
+			t.Fatalf("authorize: %v", err)
+		}
+
+		again, err := gw.Authorize(ctx, charge)
+		expect("repeated authorize", err, nil)
+		if err == nil && again != ref {
+			t.Errorf("repeated authorize: want %s, got a second authorization %s", ref, again)
+		}
+
+		expect("capture", gw.Capture(ctx, ref, 2500, run+"-capture"), nil)
+		for i, amount := range []int64{1000, 1500} {
+			_, err := gw.Refund(ctx, RefundRequest{PaymentRef: ref, AmountMinor: amount, Currency: "USD", Reason: "test", IdempotencyKey: fmt.Sprintf("%s-refund-%d", run, i)})
+			expect(fmt.Sprintf("refund %d", amount), err, nil)
+		}
+		_, err = gw.Refund(ctx, RefundRequest{PaymentRef: ref, AmountMinor: 1, Currency: "USD", Reason: "test", IdempotencyKey: run + "-refund-over"})
+		expect("refund beyond the charge", err, ErrInvalidRequest)
+	})
+
+	t.Run("void", func(t *testing.T) {
+		// Authorize and void; the voided payment cannot be captured
+		ref, err := gw.Authorize(ctx, AuthorizeRequest{OrderID: run, AmountMinor: 1200, Currency: "USD", CardToken: cardToken, IdempotencyKey: run + "-void-authorize"})
+		if err != nil {
+			t.Fatalf("authorize to void: %v", err)
+		}
+
+		expect("void", gw.Void(ctx, ref, run+"-void"), nil)
+		expect("capture after void", gw.Capture(ctx, ref, 1200, run+"-void-capture"), ErrInvalidRequest)
+	})
+
+	t.Run("decline", func(t *testing.T) {
+		_, err := gw.Authorize(ctx, AuthorizeRequest{OrderID: run, AmountMinor: 2500, Currency: "USD", CardToken: "pm_card_chargeDeclined", IdempotencyKey: run + "-declined"})
+		expect("authorize a declined card", err, ErrDeclined)
+	})
+
+	t.Run("unknown payment", func(t *testing.T) {
+		expect("capture an unknown payment", gw.Capture(ctx, "pi_unknown_"+run, 100, run+"-unknown"), ErrNotFound)
+	})
+}
@@ -0,0 +1,199 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MockServer serves the parts of the Stripe API that the Stripe gateway uses,
+// backed by a Fake, so the adapter can be run end to end without Stripe. It
+// requires apiKey as the bearer token if apiKey is set.
+type MockServer struct {
+	fake   *Fake
+	apiKey string
+}
+
+func NewMockServer(fake *Fake, apiKey string) *MockServer {
+	return &MockServer{fake: fake, apiKey: apiKey}
+}
+
+func (m *MockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeStripeError(w, http.StatusMethodNotAllowed, "invalid_request_error", "", "Only POST is supported.")
+		return
+	}
+	if m.apiKey != "" && r.Header.Get("Authorization") != "Bearer "+m.apiKey {
+		writeStripeError(w, http.StatusUnauthorized, "invalid_request_error", "", "Invalid API Key provided.")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeStripeError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case path == "v1/payment_intents":
+		m.createPaymentIntent(w, r, key)
+	case len(parts) == 4 && parts[1] == "payment_intents" && parts[3] == "capture":
+		m.capturePaymentIntent(w, r, parts[2], key)
+	case len(parts) == 4 && parts[1] == "payment_intents" && parts[3] == "cancel":
+		m.cancelPaymentIntent(w, r, parts[2], key)
+	case path == "v1/refunds":
+		m.createRefund(w, r, key)
+	default:
+		writeStripeError(w, http.StatusNotFound, "invalid_request_error", "", "Unrecognized request URL (POST: "+r.URL.Path+").")
+	}
+}
+
+func (m *MockServer) createPaymentIntent(w http.ResponseWriter, r *http.Request, key string) {
+	amount, _ := strconv.ParseInt(r.PostForm.Get("amount"), 10, 64)
+	ref, err := m.fake.Authorize(r.Context(), AuthorizeRequest{
+		OrderID:        r.PostForm.Get("metadata[order_id]"),
+		AmountMinor:    amount,
+		Currency:       r.PostForm.Get("currency"),
+		CardToken:      r.PostForm.Get("payment_method"),
+		IdempotencyKey: key,
+	})
+	if err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+
+	// Without manual capture the intent is captured straight away
+	if r.PostForm.Get("capture_method") != "manual" {
+		if err := m.fake.Capture(r.Context(), ref, amount, key+"-capture"); err != nil {
+			writeGatewayError(w, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, m.paymentIntent(ref))
+}
+
+func (m *MockServer) capturePaymentIntent(w http.ResponseWriter, r *http.Request, ref, key string) {
+	amount, err := m.amountOrRemaining(r.PostForm.Get("amount_to_capture"), ref, false)
+	if err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+
+	if err := m.fake.Capture(r.Context(), ref, amount, key); err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, m.paymentIntent(ref))
+}
+
+func (m *MockServer) cancelPaymentIntent(w http.ResponseWriter, r *http.Request, ref, key string) {
+	if err := m.fake.Void(r.Context(), ref, key); err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, m.paymentIntent(ref))
+}
+
+func (m *MockServer) createRefund(w http.ResponseWriter, r *http.Request, key string) {
+	paymentRef := r.PostForm.Get("payment_intent")
+	amount, err := m.amountOrRemaining(r.PostForm.Get("amount"), paymentRef, true)
+	if err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+
+	ref, err := m.fake.Refund(r.Context(), RefundRequest{
+		PaymentRef:     paymentRef,
+		AmountMinor:    amount,
+		Reason:         r.PostForm.Get("metadata[reason]"),
+		IdempotencyKey: key,
+	})
+	if err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+
+	intent := m.paymentIntent(paymentRef)
+	writeJSON(w, http.StatusOK, stripeRefund{
+		ID:            ref,
+		Object:        "refund",
+		Amount:        amount,
+		Currency:      intent.Currency,
+		PaymentIntent: paymentRef,
+		Status:        "succeeded",
+	})
+}
+
+// amountOrRemaining parses an optional amount parameter. Stripe defaults to
+// the whole authorized amount for captures and to what is left to refund
+// for refunds.
+func (m *MockServer) amountOrRemaining(value, ref string, refund bool) (int64, error) {
+	if value != "" {
+		amount, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, newError(ErrInvalidRequest, "Invalid integer: %s", value)
+		}
+		return amount, nil
+	}
+
+	m.fake.mu.Lock()
+	defer m.fake.mu.Unlock()
+
+	payment, err := m.fake.payment(ref)
+	if err != nil {
+		return 0, err
+	}
+	if refund {
+		return payment.captured - payment.refunded, nil
+	}
+	return payment.amountMinor, nil
+}
+
+func (m *MockServer) paymentIntent(ref string) stripePaymentIntent {
+	m.fake.mu.Lock()
+	defer m.fake.mu.Unlock()
+
+	intent := stripePaymentIntent{ID: ref, Object: "payment_intent"}
+	if payment, ok := m.fake.payments[ref]; ok {
+		intent.Amount = payment.amountMinor
+		intent.Currency = payment.currency
+		intent.Status = payment.status
+	}
+	return intent
+}
+
+// writeGatewayError answers with the status and error type Stripe uses for
+// the kind of err
+func writeGatewayError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrDeclined):
+		writeStripeError(w, http.StatusPaymentRequired, "card_error", "card_declined", err.Error())
+	case errors.Is(err, ErrNotFound):
+		writeStripeError(w, http.StatusNotFound, "invalid_request_error", "resource_missing", err.Error())
+	case errors.Is(err, ErrInvalidRequest):
+		writeStripeError(w, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+	default:
+		writeStripeError(w, http.StatusInternalServerError, "api_error", "", err.Error())
+	}
+}
+
+func writeStripeError(w http.ResponseWriter, status int, errorType, code, message string) {
+	var body stripeError
+	body.Error.Type = errorType
+	body.Error.Code = code
+	body.Error.Message = message
+	writeJSON(w, status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
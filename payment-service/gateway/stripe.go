@@ -0,0 +1,160 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stripe talks to the Stripe API (or anything that speaks it, such as the
+// mock-gateway command). Authorizations are PaymentIntents confirmed with
+// manual capture, so Capture and Void map to capturing and cancelling the
+// intent.
+type Stripe struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func NewStripe(baseURL, apiKey string, timeout time.Duration) *Stripe {
+	return &Stripe{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// stripePaymentIntent and stripeRefund hold the fields of Stripe's objects
+// that are used here
+type stripePaymentIntent struct {
+	ID       string `json:"id"`
+	Object   string `json:"object"`
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	Status   string `json:"status"`
+}
+
+type stripeRefund struct {
+	ID            string `json:"id"`
+	Object        string `json:"object"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	PaymentIntent string `json:"payment_intent"`
+	Status        string `json:"status"`
+}
+
+type stripeError struct {
+	Error struct {
+		Type        string `json:"type"`
+		Code        string `json:"code,omitempty"`
+		DeclineCode string `json:"decline_code,omitempty"`
+		Message     string `json:"message"`
+	} `json:"error"`
+}
+
+func (s *Stripe) Authorize(ctx context.Context, req AuthorizeRequest) (string, error) {
+	form := url.Values{}
+	form.Set("amount", strconv.FormatInt(req.AmountMinor, 10))
+	form.Set("currency", strings.ToLower(req.Currency))
+	form.Set("payment_method", req.CardToken)
+	form.Set("payment_method_types[]", "card")
+	form.Set("capture_method", "manual")
+	form.Set("confirm", "true")
+	form.Set("metadata[order_id]", req.OrderID)
+
+	var intent stripePaymentIntent
+	if err := s.post(ctx, "/v1/payment_intents", form, req.IdempotencyKey, &intent); err != nil {
+		return "", err
+	}
+
+	// Anything else (e.g. requires_action for 3-D Secure) cannot be
+	// completed without the customer
+	if intent.Status != "requires_capture" {
+		return "", newError(ErrDeclined, "Payment %s needs %s.", intent.ID, intent.Status)
+	}
+	return intent.ID, nil
+}
+
+func (s *Stripe) Capture(ctx context.Context, paymentRef string, amountMinor int64, idempotencyKey string) error {
+	form := url.Values{}
+	form.Set("amount_to_capture", strconv.FormatInt(amountMinor, 10))
+
+	var intent stripePaymentIntent
+	return s.post(ctx, "/v1/payment_intents/"+url.PathEscape(paymentRef)+"/capture", form, idempotencyKey, &intent)
+}
+
+func (s *Stripe) Void(ctx context.Context, paymentRef, idempotencyKey string) error {
+	var intent stripePaymentIntent
+	return s.post(ctx, "/v1/payment_intents/"+url.PathEscape(paymentRef)+"/cancel", url.Values{}, idempotencyKey, &intent)
+}
+
+func (s *Stripe) Refund(ctx context.Context, req RefundRequest) (string, error) {
+	form := url.Values{}
+	form.Set("payment_intent", req.PaymentRef)
+	form.Set("amount", strconv.FormatInt(req.AmountMinor, 10))
+	form.Set("metadata[reason]", req.Reason)
+
+	var refund stripeRefund
+	if err := s.post(ctx, "/v1/refunds", form, req.IdempotencyKey, &refund); err != nil {
+		return "", err
+	}
+	if refund.Status == "failed" || refund.Status == "canceled" {
+		return "", newError(ErrDeclined, "Refund %s %s.", refund.ID, refund.Status)
+	}
+	return refund.ID, nil
+}
+
+// post sends a form-encoded API request and decodes the response into out.
+// Network errors, rate limits and server errors are ErrUnavailable; card
+// errors are ErrDeclined.
+func (s *Stripe) post(ctx context.Context, path string, form url.Values, idempotencyKey string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.baseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return newError(ErrUnavailable, "%v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return newError(ErrUnavailable, "%v", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		var apiErr stripeError
+		if err := json.Unmarshal(body, &apiErr); err != nil || apiErr.Error.Message == "" {
+			apiErr.Error.Message = fmt.Sprintf("%s %s returned %s", req.Method, path, resp.Status)
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			return newError(ErrUnavailable, "%s", apiErr.Error.Message)
+		case resp.StatusCode == http.StatusPaymentRequired || apiErr.Error.Type == "card_error":
+			return newError(ErrDeclined, "%s", apiErr.Error.Message)
+		case resp.StatusCode == http.StatusNotFound || apiErr.Error.Code == "resource_missing":
+			return newError(ErrNotFound, "%s", apiErr.Error.Message)
+		default:
+			return newError(ErrInvalidRequest, "%s", apiErr.Error.Message)
+		}
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return newError(ErrUnavailable, "invalid response from %s: %v", path, err)
+	}
+	return nil
+}
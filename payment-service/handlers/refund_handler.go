@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/spksupakorn/ecommerce-event-driven/payment-service/gateway"
+	"github.com/spksupakorn/ecommerce-event-driven/payment-service/models"
+	"github.com/spksupakorn/ecommerce-event-driven/payment-service/repository"
+	"github.com/spksupakorn/ecommerce-event-driven/payment-service/services"
+)
+
+// IdempotencyKeyHeader lets clients safely retry refund requests
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const maxIdempotencyKeyLength = 200
+
+type RefundHandler struct {
+	paymentService *services.PaymentService
+}
+
+func NewRefundHandler(paymentService *services.PaymentService) *RefundHandler {
+	return &RefundHandler{paymentService: paymentService}
+}
+
+// GetPayment returns an order's payment, including how much of it has been
+// refunded
+func (h *RefundHandler) GetPayment(c *gin.Context) {
+	orderID := c.Param("order_id")
+
+	payment, err := h.paymentService.GetPayment(orderID)
+	if errors.Is(err, repository.ErrPaymentNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get payment for order %s: %v", orderID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get payment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, payment)
+}
+
+// ListRefunds returns an order's refunds, oldest first
+func (h *RefundHandler) ListRefunds(c *gin.Context) {
+	orderID := c.Param("order_id")
+
+	refunds, err := h.paymentService.ListRefunds(orderID)
+	if err != nil {
+		log.Printf("Failed to list refunds for order %s: %v", orderID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list refunds"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"refunds": refunds})
+}
+
+// CreateRefund refunds part of an order's payment, or all that is left of
+// it. Without an Idempotency-Key every request is a new refund; with one, a
+// repeat returns the original refund (200 instead of 201).
+func (h *RefundHandler) CreateRefund(c *gin.Context) {
+	orderID := c.Param("order_id")
+
+	var req models.CreateRefundRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key := c.GetHeader(IdempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 200 characters"})
+		return
+	}
+	if key == "" {
+		key = uuid.New().String()
+	}
+
+	refund, created, err := h.paymentService.RequestRefund(orderID, req.AmountMinor, req.Reason, key)
+	switch {
+	case errors.Is(err, repository.ErrPaymentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	case errors.Is(err, repository.ErrNotRefundable):
+		c.JSON(http.StatusConflict, gin.H{"error": "Only captured payments that are not fully refunded can be refunded"})
+		return
+	case errors.Is(err, repository.ErrRefundTooLarge):
+		c.JSON(http.StatusConflict, gin.H{"error": "Refund exceeds the refundable balance"})
+		return
+	case errors.Is(err, repository.ErrRefundKeyReused):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different refund"})
+		return
+	case errors.Is(err, gateway.ErrUnavailable):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Payment provider unavailable - retry with the same Idempotency-Key", "refund": refund})
+		return
+	case err != nil:
+		log.Printf("Failed to refund order %s: %v", orderID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refund payment"})
+		return
+	}
+
+	if refund.Status == models.RefundFailed {
+		c.JSON(http.StatusBadGateway, gin.H{"error": refund.FailureReason, "refund": refund})
+		return
+	}
+
+	status := http.StatusCreated
+	if !created {
+		status = http.StatusOK
+	}
+	c.JSON(status, refund)
+}
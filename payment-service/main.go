@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/spksupakorn/ecommerce-event-driven/payment-service/config"
+	"github.com/spksupakorn/ecommerce-event-driven/payment-service/database"
+	"github.com/spksupakorn/ecommerce-event-driven/payment-service/gateway"
+	"github.com/spksupakorn/ecommerce-event-driven/payment-service/handlers"
 	"github.com/spksupakorn/ecommerce-event-driven/payment-service/messaging"
+	"github.com/spksupakorn/ecommerce-event-driven/payment-service/repository"
 	"github.com/spksupakorn/ecommerce-event-driven/payment-service/services"
 )
 
@@ -15,8 +25,33 @@ func main() {
 	// Load configuration
 	cfg := config.LoadConfig()
 
+	// Payment provider
+	paymentGateway, err := gateway.New(cfg.PaymentGateway, gateway.Options{
+		FakeRules:    cfg.FakeGatewayRules,
+		FakeLatency:  cfg.FakeGatewayLatency,
+		StripeURL:    cfg.StripeAPIURL,
+		StripeAPIKey: cfg.StripeAPIKey,
+		Timeout:      cfg.GatewayTimeout,
+	})
+	if err != nil {
+		log.Fatalf("Invalid PAYMENT_GATEWAY: %v", err)
+	}
+
+	// "mock-gateway" serves a local stand-in for the Stripe API; it does not
+	// need the database
+	if len(os.Args) > 1 && os.Args[1] == "mock-gateway" {
+		os.Exit(mockGateway(os.Args[2:]))
+	}
+
+	// Initialize database
+	db, err := database.InitDB(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer database.CloseDB(db)
+
 	// Initialize payment service
-	paymentService := services.NewPaymentService()
+	paymentService := services.NewPaymentService(repository.NewPaymentRepository(db), paymentGateway, cfg.CardToken)
 
 	// Initialize publisher
 	publisher, err := messaging.NewPublisher(cfg.RabbitMQURL)
@@ -39,6 +74,13 @@ func main() {
 	}
 	defer refundConsumer.Close()
 
+	// Initialize command consumer (for orchestrated sagas)
+	commandConsumer, err := messaging.NewCommandConsumer(cfg.RabbitMQURL, paymentService, publisher)
+	if err != nil {
+		log.Fatalf("Failed to initialize command consumer: %v", err)
+	}
+	defer commandConsumer.Close()
+
 	// Start consuming messages
 	if err := consumer.Start(); err != nil {
 		log.Fatalf("Failed to start consumer: %v", err)
@@ -49,7 +91,41 @@ func main() {
 		log.Fatalf("Failed to start refund consumer: %v", err)
 	}
 
-	log.Println("Payment Service started successfully (with refund support)")
+	// Start command consumer
+	if err := commandConsumer.Start(); err != nil {
+		log.Fatalf("Failed to start command consumer: %v", err)
+	}
+
+	// Start the retrier for refunds left pending
+	retrierCtx, stopRetrier := context.WithCancel(context.Background())
+	defer stopRetrier()
+	retrier := services.NewRefundRetrier(paymentService, cfg.RefundRetryInterval)
+	retrier.Start(retrierCtx)
+
+	// Setup Gin router for the refund API
+	if cfg.AdminAPIToken == "" {
+		log.Println("ADMIN_API_TOKEN is not set: the payment and refund API is disabled")
+	}
+	router := setupRouter(handlers.NewRefundHandler(paymentService), cfg.AdminAPIToken)
+
+	// Create HTTP server
+	srv := &http.Server{
+		Addr:         ":" + cfg.ServerPort,
+		Handler:      router,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	// Start server in goroutine
+	go func() {
+		log.Printf("Payment API starting on port %s", cfg.ServerPort)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	log.Printf("Payment Service started successfully (with refund support, %s gateway)", cfg.PaymentGateway)
 
 	// Wait for interrupt signal
 	quit := make(chan os.Signal, 1)
@@ -57,4 +133,71 @@ func main() {
 	<-quit
 
 	log.Println("Shutting down Payment Service...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Server forced to shutdown: %v", err)
+	}
+}
+
+func setupRouter(refundHandler *handlers.RefundHandler, adminToken string) *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(gin.Logger())
+	router.Use(gin.Recovery())
+
+	// Health check endpoint
+	router.GET("/health", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "healthy"})
+	})
+
+	// Payment and refund endpoints (admin)
+	v1 := router.Group("/api/v1", handlers.RequireAdminToken(adminToken))
+	{
+		v1.GET("/payments/:order_id", refundHandler.GetPayment)
+		v1.GET("/payments/:order_id/refunds", refundHandler.ListRefunds)
+		v1.POST("/payments/:order_id/refunds", refundHandler.CreateRefund)
+	}
+
+	return router
+}
+
+// mockGateway serves the Stripe API subset used by the stripe gateway,
+// backed by the fake gateway, until interrupted
+func mockGateway(args []string) int {
+	flags := flag.NewFlagSet("mock-gateway", flag.ExitOnError)
+	addr := flags.String("addr", ":12111", "address to listen on")
+	apiKey := flags.String("api-key", "", "bearer token to require (any if empty)")
+	rules := flags.String("rules", "", "fake gateway rules, as in FAKE_GATEWAY_RULES")
+	latency := flags.Duration("latency", 0, "delay before each call is answered")
+	flags.Parse(args)
+
+	parsed, err := gateway.ParseRules(*rules)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	server := &http.Server{
+		Addr:    *addr,
+		Handler: gateway.NewMockServer(gateway.NewFake(parsed, *latency), *apiKey),
+	}
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		<-quit
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	log.Printf("Mock payment gateway listening on %s", *addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Mock payment gateway failed: %v", err)
+		return 1
+	}
+	return 0
 }
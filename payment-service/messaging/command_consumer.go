@@ -0,0 +1,276 @@
+package messaging
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/spksupakorn/ecommerce-event-driven/payment-service/models"
+	"github.com/streadway/amqp"
+)
+
+// PaymentCommandHandler defines the payment operations the saga orchestrator
+// can command
+type PaymentCommandHandler interface {
+	AuthorizingPaymentProcessor
+	CompensationProcessor
+}
+
+// CommandConsumer executes the payment commands sent by the order service's
+// saga orchestrator: payment.authorize, payment.capture and payment.void, and
+// payment.charge and payment.refund for sagas started before authorizing. The
+// outcome is published as the usual payment event, marked as orchestrated,
+// which the orchestrator treats as the reply.
+type CommandConsumer struct {
+	conn           *amqp.Connection
+	channel        *amqp.Channel
+	paymentService PaymentCommandHandler
+	publisher      *Publisher
+}
+
+type SagaCommand struct {
+	OrderID    string `json:"order_id"`
+	ItemID     string `json:"item_id"`
+	Quantity   int    `json:"quantity"`
+	UserEmail  string `json:"user_email"`
+	TotalMinor int64  `json:"total_minor"`
+	Currency   string `json:"currency"`
+	Reason     string `json:"reason"`
+}
+
+func NewCommandConsumer(rabbitMQURL string, paymentService PaymentCommandHandler, publisher *Publisher) (*CommandConsumer, error) {
+	conn, err := amqp.Dial(rabbitMQURL)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare saga exchange
+	err = channel.ExchangeDeclare(
+		"saga",
+		"topic",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare queue for payment commands
+	queue, err := channel.QueueDeclare(
+		"saga.commands.payment.queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Bind queue to the payment commands
+	for _, routingKey := range []string{"payment.authorize", "payment.capture", "payment.void", "payment.charge", "payment.refund"} {
+		err = channel.QueueBind(
+			queue.Name,
+			routingKey,
+			"saga",
+			false,
+			nil,
+		)
+		if err != nil {
+			channel.Close()
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	log.Println("Payment Service Command Consumer initialized successfully")
+
+	return &CommandConsumer{
+		conn:           conn,
+		channel:        channel,
+		paymentService: paymentService,
+		publisher:      publisher,
+	}, nil
+}
+
+func (c *CommandConsumer) Start() error {
+	msgs, err := c.channel.Consume(
+		"saga.commands.payment.queue",
+		"",
+		false, // manual ack
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for msg := range msgs {
+			var cmd SagaCommand
+			if err := json.Unmarshal(msg.Body, &cmd); err != nil {
+				log.Printf("Failed to unmarshal command: %v", err)
+				msg.Nack(false, false) // Don't requeue
+				continue
+			}
+
+			log.Printf("Received %s command: %+v", msg.RoutingKey, cmd)
+
+			var handleErr error
+			switch msg.RoutingKey {
+			case "payment.authorize":
+				handleErr = c.authorize(cmd)
+			case "payment.capture":
+				handleErr = c.capture(cmd)
+			case "payment.void":
+				handleErr = c.void(cmd)
+			case "payment.charge":
+				handleErr = c.charge(cmd)
+			case "payment.refund":
+				handleErr = c.refund(cmd)
+			default:
+				log.Printf("Ignoring unknown command: %s", msg.RoutingKey)
+			}
+
+			if handleErr != nil {
+				log.Printf("Failed to handle %s command: %v", msg.RoutingKey, handleErr)
+				msg.Nack(false, true) // Requeue
+				continue
+			}
+
+			// Acknowledge the message
+			msg.Ack(false)
+		}
+	}()
+
+	log.Println("Command Consumer started, waiting for payment commands...")
+	return nil
+}
+
+// authorize places a hold for an order's payment and replies with the
+// outcome. An authorization that cannot be finished now is retried by
+// requeueing the command.
+func (c *CommandConsumer) authorize(cmd SagaCommand) error {
+	amount, success, message, err := c.paymentService.AuthorizePayment(
+		cmd.OrderID,
+		cmd.ItemID,
+		cmd.Quantity,
+		cmd.UserEmail,
+		cmd.TotalMinor,
+		cmd.Currency,
+	)
+	if err != nil {
+		return err
+	}
+
+	// The orchestrator passes the ship-to region to inventory itself
+	if success {
+		return c.publisher.PublishPaymentAuthorized(cmd.OrderID, cmd.ItemID, cmd.Quantity, nil, cmd.UserEmail, "", amount, cmd.Currency, message, Orchestration)
+	}
+	return c.publisher.PublishPaymentFailed(cmd.OrderID, cmd.ItemID, cmd.Quantity, nil, cmd.UserEmail, message, Orchestration)
+}
+
+// capture takes the authorized payment of an order whose stock has been
+// deducted and replies with the outcome. A capture the provider refuses has
+// already released the hold and is answered with payment.failed; one that
+// cannot be finished now is retried by requeueing the command.
+func (c *CommandConsumer) capture(cmd SagaCommand) error {
+	amount, currency, success, message, err := c.paymentService.CapturePayment(cmd.OrderID)
+	if err != nil {
+		return err
+	}
+
+	if success {
+		return c.publisher.PublishPaymentCaptured(cmd.OrderID, cmd.ItemID, cmd.Quantity, cmd.UserEmail, amount, currency, message, Orchestration)
+	}
+	return c.publisher.PublishPaymentFailed(cmd.OrderID, cmd.ItemID, cmd.Quantity, nil, cmd.UserEmail, message, Orchestration)
+}
+
+// void releases the hold of an order's authorized payment and replies with
+// the outcome. A payment that was captured after all is refunded instead. A
+// void that cannot be finished now is retried by requeueing the command; a
+// hold the provider refuses to release is answered with payment.void_failed.
+func (c *CommandConsumer) void(cmd SagaCommand) error {
+	amount, currency, voided, message, err := c.paymentService.VoidPayment(cmd.OrderID, cmd.Reason)
+	if err != nil {
+		return err
+	}
+	if voided {
+		return c.publisher.PublishPaymentVoided(cmd.OrderID, cmd.ItemID, cmd.Quantity, cmd.UserEmail, amount, currency, cmd.Reason, Orchestration)
+	}
+
+	status, err := c.paymentService.PaymentStatus(cmd.OrderID)
+	if err != nil {
+		return err
+	}
+	if status == models.PaymentSucceeded || status == models.PaymentRefunded {
+		return c.refund(cmd)
+	}
+	return c.publisher.PublishPaymentVoidFailed(cmd.OrderID, message, Orchestration)
+}
+
+// charge takes payment for an order and replies with the outcome
+func (c *CommandConsumer) charge(cmd SagaCommand) error {
+	amount, success, message, err := c.paymentService.ProcessPayment(
+		cmd.OrderID,
+		cmd.ItemID,
+		cmd.Quantity,
+		cmd.UserEmail,
+		cmd.TotalMinor,
+		cmd.Currency,
+	)
+	if err != nil {
+		return err
+	}
+
+	// The orchestrator passes the ship-to region to inventory itself
+	if success {
+		return c.publisher.PublishPaymentProcessed(cmd.OrderID, cmd.ItemID, cmd.Quantity, nil, cmd.UserEmail, "", amount, cmd.Currency, message, Orchestration)
+	}
+	return c.publisher.PublishPaymentFailed(cmd.OrderID, cmd.ItemID, cmd.Quantity, nil, cmd.UserEmail, message, Orchestration)
+}
+
+// refund compensates the payment for an order and replies with the
+// outcome. A refund that cannot be finished now is retried by requeueing
+// the command rather than replying that it failed.
+func (c *CommandConsumer) refund(cmd SagaCommand) error {
+	amount, currency, success, message, err := c.paymentService.RefundPayment(
+		cmd.OrderID,
+		cmd.ItemID,
+		cmd.Quantity,
+		cmd.UserEmail,
+		cmd.Reason,
+	)
+	if err != nil {
+		return err
+	}
+
+	if success {
+		return c.publisher.PublishPaymentRefunded(cmd.OrderID, cmd.ItemID, cmd.Quantity, cmd.UserEmail, amount, currency, cmd.Reason, Orchestration)
+	}
+	return c.publisher.PublishPaymentRefundFailed(cmd.OrderID, message, Orchestration)
+}
+
+func (c *CommandConsumer) Close() {
+	if c.channel != nil {
+		c.channel.Close()
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
@@ -9,24 +9,54 @@ import (
 
 // PaymentProcessor defines the interface for processing payments
 type PaymentProcessor interface {
-	ProcessPayment(orderID, itemID string, quantity int, userEmail string) (float64, bool, string)
+	ProcessPayment(orderID, itemID string, quantity int, userEmail string, amountMinor int64, currency string) (int64, bool, string, error)
+}
+
+// AuthorizingPaymentProcessor defines the interface for payment-first sagas,
+// where the payment is authorized before stock is deducted and captured
+// afterwards
+type AuthorizingPaymentProcessor interface {
+	PaymentProcessor
+	AuthorizePayment(orderID, itemID string, quantity int, userEmail string, amountMinor int64, currency string) (int64, bool, string, error)
+	CapturePayment(orderID string) (int64, string, bool, string, error)
 }
 
 type Consumer struct {
 	conn           *amqp.Connection
 	channel        *amqp.Channel
-	paymentService PaymentProcessor
+	paymentService AuthorizingPaymentProcessor
 	publisher      *Publisher
 }
 
 type OrderCreatedEvent struct {
+	OrderID      string      `json:"order_id"`
+	ItemID       string      `json:"item_id"`
+	Quantity     int         `json:"quantity"`
+	UserEmail    string      `json:"user_email"`
+	ShipToRegion string      `json:"ship_to_region"`
+	TotalMinor   int64       `json:"total_minor"`
+	Currency     string      `json:"currency"`
+	Items        []OrderLine `json:"items"`
+}
+
+type InventoryReservedEvent struct {
+	OrderID    string      `json:"order_id"`
+	ItemID     string      `json:"item_id"`
+	Quantity   int         `json:"quantity"`
+	UserEmail  string      `json:"user_email"`
+	TotalMinor int64       `json:"total_minor"`
+	Currency   string      `json:"currency"`
+	Items      []OrderLine `json:"items"`
+}
+
+type InventorySuccessfulEvent struct {
 	OrderID   string `json:"order_id"`
 	ItemID    string `json:"item_id"`
 	Quantity  int    `json:"quantity"`
 	UserEmail string `json:"user_email"`
 }
 
-func NewConsumer(rabbitMQURL string, paymentService PaymentProcessor, publisher *Publisher) (*Consumer, error) {
+func NewConsumer(rabbitMQURL string, paymentService AuthorizingPaymentProcessor, publisher *Publisher) (*Consumer, error) {
 	conn, err := amqp.Dial(rabbitMQURL)
 	if err != nil {
 		return nil, err
@@ -83,6 +113,81 @@ func NewConsumer(rabbitMQURL string, paymentService PaymentProcessor, publisher
 		return nil, err
 	}
 
+	// Declare inventory exchange
+	err = channel.ExchangeDeclare(
+		"inventory",
+		"topic",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare queue for inventory.reserved events (inventory-first sagas)
+	reservedQueue, err := channel.QueueDeclare(
+		"inventory.reserved.payment.queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Bind reserved queue to exchange
+	err = channel.QueueBind(
+		reservedQueue.Name,
+		"inventory.reserved",
+		"inventory",
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare queue for inventory.successful events (captures payment-first
+	// orders once their stock is deducted)
+	successfulQueue, err := channel.QueueDeclare(
+		"inventory.successful.payment.queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Bind successful queue to exchange
+	err = channel.QueueBind(
+		successfulQueue.Name,
+		"inventory.successful",
+		"inventory",
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
 	log.Println("Payment Service RabbitMQ consumer initialized successfully")
 
 	return &Consumer{
@@ -107,6 +212,33 @@ func (c *Consumer) Start() error {
 		return err
 	}
 
+	reservedMsgs, err := c.channel.Consume(
+		"inventory.reserved.payment.queue",
+		"",
+		false, // manual ack
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	successfulMsgs, err := c.channel.Consume(
+		"inventory.successful.payment.queue",
+		"",
+		false, // manual ack
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Handle order.created events (payment-first sagas)
 	go func() {
 		for msg := range msgs {
 			var event OrderCreatedEvent
@@ -116,41 +248,176 @@ func (c *Consumer) Start() error {
 				continue
 			}
 
+			// Orchestrated orders are authorized on a payment.authorize command,
+			// and inventory-first orders charged once their stock is reserved
+			saga := sagaContext(msg)
+			if saga.Orchestrated() || saga.InventoryFirst() {
+				msg.Ack(false)
+				continue
+			}
+
 			log.Printf("Received order.created event: %+v", event)
 
-			// Process the payment
-			amount, success, message := c.paymentService.ProcessPayment(
-				event.OrderID,
-				event.ItemID,
-				event.Quantity,
-				event.UserEmail,
-			)
-
-			if success {
-				// Publish payment.successful event
-				if err := c.publisher.PublishPaymentProcessed(event.OrderID, event.ItemID, event.Quantity, event.UserEmail, amount, message); err != nil {
-					log.Printf("Failed to publish payment.successful event: %v", err)
-					msg.Nack(false, true) // Requeue
-					continue
-				}
-			} else {
-				// Publish payment.failed event
-				if err := c.publisher.PublishPaymentFailed(event.OrderID, event.ItemID, event.Quantity, event.UserEmail, message); err != nil {
-					log.Printf("Failed to publish payment.failed event: %v", err)
-					msg.Nack(false, true) // Requeue
-					continue
-				}
+			c.authorize(msg, saga, event.OrderID, event.ItemID, event.Quantity, event.Items, event.UserEmail, event.ShipToRegion, event.TotalMinor, event.Currency)
+		}
+	}()
+
+	// Handle inventory.reserved events (inventory-first sagas)
+	go func() {
+		for msg := range reservedMsgs {
+			var event InventoryReservedEvent
+			if err := json.Unmarshal(msg.Body, &event); err != nil {
+				log.Printf("Failed to unmarshal message: %v", err)
+				msg.Nack(false, false) // Don't requeue
+				continue
+			}
+
+			saga := sagaContext(msg)
+			if saga.Orchestrated() {
+				msg.Ack(false)
+				continue
+			}
+
+			log.Printf("Received inventory.reserved event: %+v", event)
+
+			// The stock is already allocated, so the ship-to region is not needed
+			c.charge(msg, saga, event.OrderID, event.ItemID, event.Quantity, event.Items, event.UserEmail, "", event.TotalMinor, event.Currency)
+		}
+	}()
+
+	// Handle inventory.successful events (payment-first sagas)
+	go func() {
+		for msg := range successfulMsgs {
+			var event InventorySuccessfulEvent
+			if err := json.Unmarshal(msg.Body, &event); err != nil {
+				log.Printf("Failed to unmarshal message: %v", err)
+				msg.Nack(false, false) // Don't requeue
+				continue
+			}
+
+			// Inventory-first orders were charged in full before their stock
+			// was deducted
+			saga := sagaContext(msg)
+			if saga.Orchestrated() || saga.InventoryFirst() {
+				msg.Ack(false)
+				continue
 			}
 
-			// Acknowledge the message
-			msg.Ack(false)
+			log.Printf("Received inventory.successful event: %+v", event)
+
+			c.capture(msg, saga, event.OrderID, event.ItemID, event.Quantity, event.UserEmail)
 		}
 	}()
 
-	log.Println("Payment Consumer started, waiting for messages...")
+	log.Println("Payment Consumer started, waiting for order.created, inventory.reserved and inventory.successful messages...")
 	return nil
 }
 
+// authorize places a hold for a payment-first order, publishes the outcome
+// and acknowledges msg. Inventory deducts the order's stock on
+// payment.authorized, passing items and shipToRegion on as for charge. An
+// authorization that cannot be finished now is retried by requeueing msg.
+func (c *Consumer) authorize(msg amqp.Delivery, saga SagaContext, orderID, itemID string, quantity int, items []OrderLine, userEmail, shipToRegion string, totalMinor int64, currency string) {
+	amount, success, message, err := c.paymentService.AuthorizePayment(
+		orderID,
+		itemID,
+		quantity,
+		userEmail,
+		totalMinor,
+		currency,
+	)
+	if err != nil {
+		log.Printf("Authorization for order %s not finished, retrying: %v", orderID, err)
+		msg.Nack(false, true) // Requeue
+		return
+	}
+
+	if success {
+		if err := c.publisher.PublishPaymentAuthorized(orderID, itemID, quantity, items, userEmail, shipToRegion, amount, currency, message, saga); err != nil {
+			log.Printf("Failed to publish payment.authorized event: %v", err)
+			msg.Nack(false, true) // Requeue
+			return
+		}
+	} else {
+		if err := c.publisher.PublishPaymentFailed(orderID, itemID, quantity, items, userEmail, message, saga); err != nil {
+			log.Printf("Failed to publish payment.failed event: %v", err)
+			msg.Nack(false, true) // Requeue
+			return
+		}
+	}
+
+	msg.Ack(false)
+}
+
+// capture takes the authorized payment of an order whose stock has been
+// deducted. If the provider refuses the capture payment.failed is published,
+// so the order is cancelled and its stock given back; a capture that cannot
+// be finished now is retried by requeueing msg.
+func (c *Consumer) capture(msg amqp.Delivery, saga SagaContext, orderID, itemID string, quantity int, userEmail string) {
+	amount, currency, success, message, err := c.paymentService.CapturePayment(orderID)
+	if err != nil {
+		log.Printf("Capture for order %s not finished, retrying: %v", orderID, err)
+		msg.Nack(false, true) // Requeue
+		return
+	}
+
+	if success {
+		if err := c.publisher.PublishPaymentCaptured(orderID, itemID, quantity, userEmail, amount, currency, message, saga); err != nil {
+			log.Printf("Failed to publish payment.captured event: %v", err)
+			msg.Nack(false, true) // Requeue
+			return
+		}
+	} else {
+		if err := c.publisher.PublishPaymentFailed(orderID, itemID, quantity, nil, userEmail, message, saga); err != nil {
+			log.Printf("Failed to publish payment.failed event: %v", err)
+			msg.Nack(false, true) // Requeue
+			return
+		}
+	}
+
+	msg.Ack(false)
+}
+
+// charge processes the payment for an order, publishes the outcome within the
+// order's saga and acknowledges msg. items and shipToRegion are passed on to
+// inventory for reserving the order's lines and picking a warehouse. A
+// charge that cannot be finished now is retried by requeueing msg.
+func (c *Consumer) charge(msg amqp.Delivery, saga SagaContext, orderID, itemID string, quantity int, items []OrderLine, userEmail, shipToRegion string, totalMinor int64, currency string) {
+	// Process the payment
+	amount, success, message, err := c.paymentService.ProcessPayment(
+		orderID,
+		itemID,
+		quantity,
+		userEmail,
+		totalMinor,
+		currency,
+	)
+	if err != nil {
+		log.Printf("Payment for order %s not finished, retrying: %v", orderID, err)
+		msg.Nack(false, true) // Requeue
+		return
+	}
+
+	if success {
+		// Publish payment.successful event
+		if err := c.publisher.PublishPaymentProcessed(orderID, itemID, quantity, items, userEmail, shipToRegion, amount, currency, message, saga); err != nil {
+			log.Printf("Failed to publish payment.successful event: %v", err)
+			msg.Nack(false, true) // Requeue
+			return
+		}
+	} else {
+		// Publish payment.failed event
+		if err := c.publisher.PublishPaymentFailed(orderID, itemID, quantity, items, userEmail, message, saga); err != nil {
+			log.Printf("Failed to publish payment.failed event: %v", err)
+			msg.Nack(false, true) // Requeue
+			return
+		}
+	}
+
+	// Acknowledge the message
+	msg.Ack(false)
+}
+
 func (c *Consumer) Close() {
 	if c.channel != nil {
 		c.channel.Close()
@@ -5,6 +5,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/streadway/amqp"
 )
 
@@ -14,33 +15,79 @@ type Publisher struct {
 }
 
 type PaymentProcessedEvent struct {
+	OrderID      string      `json:"order_id"`
+	ItemID       string      `json:"item_id"`
+	Quantity     int         `json:"quantity"`
+	UserEmail    string      `json:"user_email"`
+	ShipToRegion string      `json:"ship_to_region,omitempty"`
+	AmountMinor  int64       `json:"amount_minor"`
+	Currency     string      `json:"currency"`
+	Status       string      `json:"status"`
+	Message      string      `json:"message"`
+	ProcessedAt  time.Time   `json:"processed_at"`
+	Items        []OrderLine `json:"items,omitempty"`
+}
+
+// OrderLine is one item of a multi-line order, passed through from the order
+// to inventory
+type OrderLine struct {
+	ItemID   string `json:"item_id"`
+	Quantity int    `json:"quantity"`
+}
+
+type PaymentFailedEvent struct {
+	OrderID   string      `json:"order_id"`
+	ItemID    string      `json:"item_id"`
+	Quantity  int         `json:"quantity"`
+	UserEmail string      `json:"user_email"`
+	Reason    string      `json:"reason"`
+	FailedAt  time.Time   `json:"failed_at"`
+	Items     []OrderLine `json:"items,omitempty"`
+}
+
+type PaymentCapturedEvent struct {
 	OrderID     string    `json:"order_id"`
 	ItemID      string    `json:"item_id"`
 	Quantity    int       `json:"quantity"`
 	UserEmail   string    `json:"user_email"`
-	Amount      float64   `json:"amount"`
-	Status      string    `json:"status"`
+	AmountMinor int64     `json:"amount_minor"`
+	Currency    string    `json:"currency"`
 	Message     string    `json:"message"`
-	ProcessedAt time.Time `json:"processed_at"`
+	CapturedAt  time.Time `json:"captured_at"`
 }
 
-type PaymentFailedEvent struct {
-	OrderID   string    `json:"order_id"`
-	ItemID    string    `json:"item_id"`
-	Quantity  int       `json:"quantity"`
-	UserEmail string    `json:"user_email"`
-	Reason    string    `json:"reason"`
-	FailedAt  time.Time `json:"failed_at"`
+type PaymentVoidedEvent struct {
+	OrderID     string    `json:"order_id"`
+	ItemID      string    `json:"item_id"`
+	Quantity    int       `json:"quantity"`
+	UserEmail   string    `json:"user_email"`
+	AmountMinor int64     `json:"amount_minor"`
+	Currency    string    `json:"currency"`
+	Reason      string    `json:"reason"`
+	VoidedAt    time.Time `json:"voided_at"`
+}
+
+type PaymentRefundFailedEvent struct {
+	OrderID  string    `json:"order_id"`
+	Reason   string    `json:"reason"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+type PaymentVoidFailedEvent struct {
+	OrderID  string    `json:"order_id"`
+	Reason   string    `json:"reason"`
+	FailedAt time.Time `json:"failed_at"`
 }
 
 type PaymentRefundedEvent struct {
-	OrderID    string    `json:"order_id"`
-	ItemID     string    `json:"item_id"`
-	Quantity   int       `json:"quantity"`
-	UserEmail  string    `json:"user_email"`
-	Amount     float64   `json:"amount"`
-	Reason     string    `json:"reason"`
-	RefundedAt time.Time `json:"refunded_at"`
+	OrderID     string    `json:"order_id"`
+	ItemID      string    `json:"item_id"`
+	Quantity    int       `json:"quantity"`
+	UserEmail   string    `json:"user_email"`
+	AmountMinor int64     `json:"amount_minor"`
+	Currency    string    `json:"currency"`
+	Reason      string    `json:"reason"`
+	RefundedAt  time.Time `json:"refunded_at"`
 }
 
 func NewPublisher(rabbitMQURL string) (*Publisher, error) {
@@ -79,16 +126,21 @@ func NewPublisher(rabbitMQURL string) (*Publisher, error) {
 	}, nil
 }
 
-func (p *Publisher) PublishPaymentProcessed(orderID, itemID string, quantity int, userEmail string, amount float64, message string) error {
+// PublishPaymentProcessed publishes payment.successful. items are the lines
+// of a multi-line order, nil for a single item.
+func (p *Publisher) PublishPaymentProcessed(orderID, itemID string, quantity int, items []OrderLine, userEmail, shipToRegion string, amountMinor int64, currency, message string, saga SagaContext) error {
 	event := PaymentProcessedEvent{
-		OrderID:     orderID,
-		ItemID:      itemID,
-		Quantity:    quantity,
-		UserEmail:   userEmail,
-		Amount:      amount,
-		Status:      "SUCCESS",
-		Message:     message,
-		ProcessedAt: time.Now(),
+		OrderID:      orderID,
+		ItemID:       itemID,
+		Quantity:     quantity,
+		UserEmail:    userEmail,
+		ShipToRegion: shipToRegion,
+		AmountMinor:  amountMinor,
+		Currency:     currency,
+		Status:       "SUCCESS",
+		Message:      message,
+		ProcessedAt:  time.Now(),
+		Items:        items,
 	}
 
 	body, err := json.Marshal(event)
@@ -105,6 +157,8 @@ func (p *Publisher) PublishPaymentProcessed(orderID, itemID string, quantity int
 			ContentType:  "application/json",
 			Body:         body,
 			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      saga.headers(),
 		},
 	)
 	if err != nil {
@@ -115,7 +169,134 @@ func (p *Publisher) PublishPaymentProcessed(orderID, itemID string, quantity int
 	return nil
 }
 
-func (p *Publisher) PublishPaymentFailed(orderID, itemID string, quantity int, userEmail string, reason string) error {
+// PublishPaymentAuthorized publishes payment.authorized, with the same
+// fields as payment.successful, once a payment-first order's total is held
+// on the card. items are the lines of a multi-line order, nil for a single
+// item.
+func (p *Publisher) PublishPaymentAuthorized(orderID, itemID string, quantity int, items []OrderLine, userEmail, shipToRegion string, amountMinor int64, currency, message string, saga SagaContext) error {
+	event := PaymentProcessedEvent{
+		OrderID:      orderID,
+		ItemID:       itemID,
+		Quantity:     quantity,
+		UserEmail:    userEmail,
+		ShipToRegion: shipToRegion,
+		AmountMinor:  amountMinor,
+		Currency:     currency,
+		Status:       "AUTHORIZED",
+		Message:      message,
+		ProcessedAt:  time.Now(),
+		Items:        items,
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = p.channel.Publish(
+		"payments",           // exchange
+		"payment.authorized", // routing key
+		false,                // mandatory
+		false,                // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      saga.headers(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published payment.authorized event for order: %s", orderID)
+	return nil
+}
+
+// PublishPaymentCaptured publishes payment.captured once an authorized
+// payment has been taken
+func (p *Publisher) PublishPaymentCaptured(orderID, itemID string, quantity int, userEmail string, amountMinor int64, currency, message string, saga SagaContext) error {
+	event := PaymentCapturedEvent{
+		OrderID:     orderID,
+		ItemID:      itemID,
+		Quantity:    quantity,
+		UserEmail:   userEmail,
+		AmountMinor: amountMinor,
+		Currency:    currency,
+		Message:     message,
+		CapturedAt:  time.Now(),
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = p.channel.Publish(
+		"payments",         // exchange
+		"payment.captured", // routing key
+		false,              // mandatory
+		false,              // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      saga.headers(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published payment.captured event for order: %s (%d %s)", orderID, amountMinor, currency)
+	return nil
+}
+
+// PublishPaymentVoided publishes payment.voided once the hold of an
+// authorized payment has been released instead of captured
+func (p *Publisher) PublishPaymentVoided(orderID, itemID string, quantity int, userEmail string, amountMinor int64, currency, reason string, saga SagaContext) error {
+	event := PaymentVoidedEvent{
+		OrderID:     orderID,
+		ItemID:      itemID,
+		Quantity:    quantity,
+		UserEmail:   userEmail,
+		AmountMinor: amountMinor,
+		Currency:    currency,
+		Reason:      reason,
+		VoidedAt:    time.Now(),
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = p.channel.Publish(
+		"payments",       // exchange
+		"payment.voided", // routing key
+		false,            // mandatory
+		false,            // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      saga.headers(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published payment.voided event for order: %s (%d %s released, reason: %s)", orderID, amountMinor, currency, reason)
+	return nil
+}
+
+// PublishPaymentFailed publishes payment.failed. items are the lines of a
+// multi-line order, nil for a single item.
+func (p *Publisher) PublishPaymentFailed(orderID, itemID string, quantity int, items []OrderLine, userEmail string, reason string, saga SagaContext) error {
 	event := PaymentFailedEvent{
 		OrderID:   orderID,
 		ItemID:    itemID,
@@ -123,6 +304,7 @@ func (p *Publisher) PublishPaymentFailed(orderID, itemID string, quantity int, u
 		UserEmail: userEmail,
 		Reason:    reason,
 		FailedAt:  time.Now(),
+		Items:     items,
 	}
 
 	body, err := json.Marshal(event)
@@ -139,6 +321,8 @@ func (p *Publisher) PublishPaymentFailed(orderID, itemID string, quantity int, u
 			ContentType:  "application/json",
 			Body:         body,
 			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      saga.headers(),
 		},
 	)
 	if err != nil {
@@ -149,15 +333,16 @@ func (p *Publisher) PublishPaymentFailed(orderID, itemID string, quantity int, u
 	return nil
 }
 
-func (p *Publisher) PublishPaymentRefunded(orderID, itemID string, quantity int, userEmail string, amount float64, reason string) error {
+func (p *Publisher) PublishPaymentRefunded(orderID, itemID string, quantity int, userEmail string, amountMinor int64, currency, reason string, saga SagaContext) error {
 	event := PaymentRefundedEvent{
-		OrderID:    orderID,
-		ItemID:     itemID,
-		Quantity:   quantity,
-		UserEmail:  userEmail,
-		Amount:     amount,
-		Reason:     reason,
-		RefundedAt: time.Now(),
+		OrderID:     orderID,
+		ItemID:      itemID,
+		Quantity:    quantity,
+		UserEmail:   userEmail,
+		AmountMinor: amountMinor,
+		Currency:    currency,
+		Reason:      reason,
+		RefundedAt:  time.Now(),
 	}
 
 	body, err := json.Marshal(event)
@@ -174,13 +359,86 @@ func (p *Publisher) PublishPaymentRefunded(orderID, itemID string, quantity int,
 			ContentType:  "application/json",
 			Body:         body,
 			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      saga.headers(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published payment.refunded event for order: %s (%d %s refunded, reason: %s)", orderID, amountMinor, currency, reason)
+	return nil
+}
+
+// PublishPaymentRefundFailed reports a refund command that could not be
+// carried out, so the saga orchestrator does not wait for it forever
+func (p *Publisher) PublishPaymentRefundFailed(orderID, reason string, saga SagaContext) error {
+	event := PaymentRefundFailedEvent{
+		OrderID:  orderID,
+		Reason:   reason,
+		FailedAt: time.Now(),
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = p.channel.Publish(
+		"payments",              // exchange
+		"payment.refund_failed", // routing key
+		false,                   // mandatory
+		false,                   // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      saga.headers(),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Published payment.refund_failed event for order: %s (reason: %s)", orderID, reason)
+	return nil
+}
+
+// PublishPaymentVoidFailed reports a payment.void command whose hold the
+// provider refused to release, so the saga orchestrator does not wait for it
+// forever
+func (p *Publisher) PublishPaymentVoidFailed(orderID, reason string, saga SagaContext) error {
+	event := PaymentVoidFailedEvent{
+		OrderID:  orderID,
+		Reason:   reason,
+		FailedAt: time.Now(),
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = p.channel.Publish(
+		"payments",            // exchange
+		"payment.void_failed", // routing key
+		false,                 // mandatory
+		false,                 // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         body,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    uuid.New().String(),
+			Headers:      saga.headers(),
 		},
 	)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Published payment.refunded event for order: %s ($%.2f refunded, reason: %s)", orderID, amount, reason)
+	log.Printf("Published payment.void_failed event for order: %s (reason: %s)", orderID, reason)
 	return nil
 }
 
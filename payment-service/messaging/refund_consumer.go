@@ -4,18 +4,27 @@ import (
 	"encoding/json"
 	"log"
 
+	"github.com/spksupakorn/ecommerce-event-driven/payment-service/models"
 	"github.com/streadway/amqp"
 )
 
 // RefundProcessor defines the interface for processing refunds
 type RefundProcessor interface {
-	RefundPayment(orderID, itemID string, quantity int, userEmail, reason string) (float64, bool, string)
+	RefundPayment(orderID, itemID string, quantity int, userEmail, reason string) (int64, string, bool, string, error)
+}
+
+// CompensationProcessor defines the interface for giving back an order's
+// payment: an authorized payment is voided and a captured one refunded
+type CompensationProcessor interface {
+	RefundProcessor
+	VoidPayment(orderID, reason string) (int64, string, bool, string, error)
+	PaymentStatus(orderID string) (string, error)
 }
 
 type RefundConsumer struct {
 	conn           *amqp.Connection
 	channel        *amqp.Channel
-	paymentService RefundProcessor
+	paymentService CompensationProcessor
 	publisher      *Publisher
 }
 
@@ -27,7 +36,15 @@ type InventoryFailedEvent struct {
 	Reason    string `json:"reason"`
 }
 
-func NewRefundConsumer(rabbitMQURL string, paymentService RefundProcessor, publisher *Publisher) (*RefundConsumer, error) {
+type OrderTimedOutEvent struct {
+	OrderID   string `json:"order_id"`
+	ItemID    string `json:"item_id"`
+	Quantity  int    `json:"quantity"`
+	UserEmail string `json:"user_email"`
+	Reason    string `json:"reason"`
+}
+
+func NewRefundConsumer(rabbitMQURL string, paymentService CompensationProcessor, publisher *Publisher) (*RefundConsumer, error) {
 	conn, err := amqp.Dial(rabbitMQURL)
 	if err != nil {
 		return nil, err
@@ -84,6 +101,51 @@ func NewRefundConsumer(rabbitMQURL string, paymentService RefundProcessor, publi
 		return nil, err
 	}
 
+	// Declare orders exchange
+	err = channel.ExchangeDeclare(
+		"orders",
+		"topic",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Declare queue for order.timed_out events
+	timedOutQueue, err := channel.QueueDeclare(
+		"order.timed_out.payment.queue",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	// Bind timed out queue to exchange
+	err = channel.QueueBind(
+		timedOutQueue.Name,
+		"order.timed_out",
+		"orders",
+		false,
+		nil,
+	)
+	if err != nil {
+		channel.Close()
+		conn.Close()
+		return nil, err
+	}
+
 	log.Println("Payment Service Refund Consumer initialized successfully")
 
 	return &RefundConsumer{
@@ -108,6 +170,20 @@ func (c *RefundConsumer) Start() error {
 		return err
 	}
 
+	timedOutMsgs, err := c.channel.Consume(
+		"order.timed_out.payment.queue",
+		"",
+		false, // manual ack
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	// Handle inventory.failed events
 	go func() {
 		for msg := range msgs {
 			var event InventoryFailedEvent
@@ -117,38 +193,115 @@ func (c *RefundConsumer) Start() error {
 				continue
 			}
 
+			// Orchestrated orders are voided on a payment.void command
+			if sagaContext(msg).Orchestrated() {
+				msg.Ack(false)
+				continue
+			}
+
 			log.Printf("Received inventory.failed event for refund: %+v", event)
 
-			// Process the refund (compensation transaction)
-			amount, success, message := c.paymentService.RefundPayment(
-				event.OrderID,
-				event.ItemID,
-				event.Quantity,
-				event.UserEmail,
-				event.Reason,
-			)
-
-			if success {
-				// Publish payment.refunded event
-				refundReason := "Inventory reservation failed: " + event.Reason
-				if err := c.publisher.PublishPaymentRefunded(event.OrderID, event.ItemID, event.Quantity, event.UserEmail, amount, refundReason); err != nil {
-					log.Printf("Failed to publish payment.refunded event: %v", err)
-					msg.Nack(false, true) // Requeue
-					continue
-				}
-			} else {
-				log.Printf("Refund processing failed: %s", message)
+			// A payment-first order's payment is only authorized at this point,
+			// so it is voided rather than refunded
+			refundReason := "Inventory reservation failed: " + event.Reason
+			c.refund(msg, event.OrderID, event.ItemID, event.Quantity, event.UserEmail, event.Reason, refundReason)
+		}
+	}()
+
+	// Handle order.timed_out events
+	go func() {
+		for msg := range timedOutMsgs {
+			var event OrderTimedOutEvent
+			if err := json.Unmarshal(msg.Body, &event); err != nil {
+				log.Printf("Failed to unmarshal message: %v", err)
+				msg.Nack(false, false) // Don't requeue
+				continue
 			}
 
-			// Acknowledge the message
-			msg.Ack(false)
+			log.Printf("Received order.timed_out event for refund: %+v", event)
+
+			refundReason := "Order timed out: " + event.Reason
+			c.refund(msg, event.OrderID, event.ItemID, event.Quantity, event.UserEmail, event.Reason, refundReason)
 		}
 	}()
 
-	log.Println("Refund Consumer started, waiting for inventory.failed messages...")
+	log.Println("Refund Consumer started, waiting for inventory.failed and order.timed_out messages...")
 	return nil
 }
 
+// refund runs the compensation transaction for an order and acknowledges
+// msg. An authorized payment is voided; otherwise a captured payment is
+// refunded. A void or refund that cannot be finished now, e.g. because the
+// provider is unavailable, is retried by requeueing msg. A hold the provider
+// refuses to release is recorded on the payment (VOID_FAILED) and msg is
+// acknowledged, as retrying it would never succeed.
+func (c *RefundConsumer) refund(msg amqp.Delivery, orderID, itemID string, quantity int, userEmail, reason, refundReason string) {
+	amount, currency, voided, message, err := c.paymentService.VoidPayment(orderID, refundReason)
+	if err != nil {
+		log.Printf("Void for order %s not finished, retrying: %v", orderID, err)
+		msg.Nack(false, true) // Requeue
+		return
+	}
+	if voided {
+		if err := c.publisher.PublishPaymentVoided(orderID, itemID, quantity, userEmail, amount, currency, refundReason, sagaContext(msg)); err != nil {
+			log.Printf("Failed to publish payment.voided event: %v", err)
+			msg.Nack(false, true) // Requeue
+			return
+		}
+		msg.Ack(false)
+		return
+	}
+
+	status, err := c.paymentService.PaymentStatus(orderID)
+	if err != nil {
+		log.Printf("Failed to look up payment for order %s: %v", orderID, err)
+		msg.Nack(false, true) // Requeue
+		return
+	}
+
+	switch status {
+	case models.PaymentSucceeded, models.PaymentRefunded:
+	case models.PaymentVoidFailed:
+		log.Printf("Void failed for order %s: %s", orderID, message)
+		msg.Ack(false)
+		return
+	default:
+		// Not captured (or never charged), so there is nothing to refund; a
+		// charge still running is declined as the order is abandoned
+		log.Printf("No captured payment for order %s - nothing to refund", orderID)
+		msg.Ack(false)
+		return
+	}
+
+	// Process the refund (compensation transaction)
+	amount, currency, refunded, message, err := c.paymentService.RefundPayment(
+		orderID,
+		itemID,
+		quantity,
+		userEmail,
+		reason,
+	)
+	if err != nil {
+		log.Printf("Refund for order %s not finished, retrying: %v", orderID, err)
+		msg.Nack(false, true) // Requeue
+		return
+	}
+
+	if refunded {
+		// Publish payment.refunded event
+		if err := c.publisher.PublishPaymentRefunded(orderID, itemID, quantity, userEmail, amount, currency, refundReason, sagaContext(msg)); err != nil {
+			log.Printf("Failed to publish payment.refunded event: %v", err)
+			msg.Nack(false, true) // Requeue
+			return
+		}
+	} else {
+		log.Printf("Refund processing failed: %s", message)
+	}
+
+	// Acknowledge the message
+	msg.Ack(false)
+}
+
 func (c *RefundConsumer) Close() {
 	if c.channel != nil {
 		c.channel.Close()
@@ -0,0 +1,72 @@
+package models
+
+import "time"
+
+// Payment states. A payment is PENDING while the charge is with the
+// provider. An AUTHORIZED payment holds the amount on the card until it is
+// captured (SUCCEEDED) or VOIDED; one whose hold the provider refused to
+// release is VOID_FAILED and needs checking by hand. A SUCCEEDED payment can
+// be refunded in parts and becomes REFUNDED once all of it is. FAILED,
+// VOIDED, VOID_FAILED and REFUNDED are final.
+const (
+	PaymentPending    = "PENDING"
+	PaymentAuthorized = "AUTHORIZED"
+	PaymentSucceeded  = "SUCCEEDED"
+	PaymentFailed     = "FAILED"
+	PaymentVoided     = "VOIDED"
+	PaymentVoidFailed = "VOID_FAILED"
+	PaymentRefunded   = "REFUNDED"
+)
+
+// Payment is the charge for an order; each order is charged at most once.
+// Amounts are integer minor currency units (e.g. cents). ProviderRef is the
+// payment provider's reference for the charge. RefundedMinor is how much of
+// it has been refunded so far.
+type Payment struct {
+	ID            int64     `json:"id" db:"id"`
+	OrderID       string    `json:"order_id" db:"order_id"`
+	ItemID        string    `json:"item_id" db:"item_id"`
+	Quantity      int       `json:"quantity" db:"quantity"`
+	UserEmail     string    `json:"user_email" db:"user_email"`
+	Status        string    `json:"status" db:"status"`
+	AmountMinor   int64     `json:"amount_minor" db:"amount_minor"`
+	Currency      string    `json:"currency" db:"currency"`
+	ProviderRef   string    `json:"provider_ref,omitempty" db:"provider_ref"`
+	FailureReason string    `json:"failure_reason,omitempty" db:"failure_reason"`
+	RefundedMinor int64     `json:"refunded_minor" db:"refunded_minor"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Refund states. A refund is PENDING while it is with the provider; its
+// amount counts against the payment's refundable balance until it FAILED.
+const (
+	RefundPending   = "PENDING"
+	RefundSucceeded = "SUCCEEDED"
+	RefundFailed    = "FAILED"
+)
+
+// Refund is money given back for a payment, all of it or a part. A payment
+// can have several refunds; IdempotencyKey tells them apart, so a retried
+// request does not refund twice.
+type Refund struct {
+	ID             int64     `json:"id" db:"id"`
+	PaymentID      int64     `json:"payment_id" db:"payment_id"`
+	OrderID        string    `json:"order_id" db:"order_id"`
+	Status         string    `json:"status" db:"status"`
+	AmountMinor    int64     `json:"amount_minor" db:"amount_minor"`
+	Currency       string    `json:"currency" db:"currency"`
+	Reason         string    `json:"reason" db:"reason"`
+	IdempotencyKey string    `json:"idempotency_key" db:"idempotency_key"`
+	ProviderRef    string    `json:"provider_ref,omitempty" db:"provider_ref"`
+	FailureReason  string    `json:"failure_reason,omitempty" db:"failure_reason"`
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// CreateRefundRequest asks for a refund of part of an order's payment, or
+// of all that is left of it when AmountMinor is 0
+type CreateRefundRequest struct {
+	AmountMinor int64  `json:"amount_minor" binding:"min=0"`
+	Reason      string `json:"reason" binding:"required,max=500"`
+}
@@ -0,0 +1,590 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/payment-service/models"
+)
+
+var (
+	ErrPaymentNotFound = errors.New("payment not found")
+	ErrOrderAbandoned  = errors.New("order was cancelled before payment")
+	ErrNotRefundable   = errors.New("payment cannot be refunded")
+	ErrNotCapturable   = errors.New("payment cannot be captured")
+	ErrNotVoidable     = errors.New("payment cannot be voided")
+	ErrRefundTooLarge  = errors.New("refund exceeds the refundable balance")
+	ErrRefundKeyReused = errors.New("idempotency key was already used for a different refund")
+)
+
+const paymentColumns = `id, order_id, item_id, quantity, user_email, status, amount_minor, currency, provider_ref, failure_reason, refunded_minor, created_at, updated_at`
+
+const refundColumns = `id, payment_id, order_id, status, amount_minor, currency, reason, idempotency_key, provider_ref, failure_reason, created_at, updated_at`
+
+// PaymentRepository stores payments, their refunds and the orders that were
+// compensated before they were paid for. Changes for one order are
+// serialized with an advisory lock on the order ID.
+type PaymentRepository struct {
+	db *sql.DB
+}
+
+func NewPaymentRepository(db *sql.DB) *PaymentRepository {
+	return &PaymentRepository{db: db}
+}
+
+// GetByOrderID returns an order's payment
+func (r *PaymentRepository) GetByOrderID(orderID string) (*models.Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE order_id = $1`
+	return scanPayment(r.db.QueryRow(query, orderID))
+}
+
+// Start records a PENDING payment for an order about to be charged. If the
+// order already has a payment it is returned instead, with created false, so
+// a redelivered charge does not charge twice. Orders compensated before they
+// were paid for fail with ErrOrderAbandoned.
+func (r *PaymentRepository) Start(payment *models.Payment) (*models.Payment, bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	abandoned, err := lockOrder(tx, payment.OrderID)
+	if err != nil {
+		return nil, false, err
+	}
+	if abandoned {
+		return nil, false, ErrOrderAbandoned
+	}
+
+	existing, err := scanPayment(tx.QueryRow(`SELECT `+paymentColumns+` FROM payments WHERE order_id = $1`, payment.OrderID))
+	if err == nil {
+		return existing, false, nil
+	}
+	if !errors.Is(err, ErrPaymentNotFound) {
+		return nil, false, err
+	}
+
+	now := time.Now()
+	payment.Status = models.PaymentPending
+	payment.CreatedAt = now
+	payment.UpdatedAt = now
+
+	query := `
+		INSERT INTO payments (order_id, item_id, quantity, user_email, status, amount_minor, currency, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+		RETURNING id
+	`
+
+	err = tx.QueryRow(query, payment.OrderID, payment.ItemID, payment.Quantity, payment.UserEmail, payment.Status, payment.AmountMinor, payment.Currency, now).Scan(&payment.ID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+
+	return payment, true, nil
+}
+
+// Complete records the outcome of a PENDING payment's charge or
+// authorization. A successful one for an order that was abandoned meanwhile
+// is recorded as FAILED, so the caller can give the money back or release
+// the hold; check the returned payment's status.
+func (r *PaymentRepository) Complete(payment *models.Payment, status, providerRef, failureReason string) (*models.Payment, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	abandoned, err := lockOrder(tx, payment.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	if abandoned && (status == models.PaymentSucceeded || status == models.PaymentAuthorized) {
+		status = models.PaymentFailed
+		failureReason = ErrOrderAbandoned.Error()
+	}
+
+	query := `
+		UPDATE payments
+		SET status = $1, provider_ref = $2, failure_reason = $3, updated_at = $4
+		WHERE id = $5 AND status = $6
+		RETURNING ` + paymentColumns
+
+	completed, err := scanPayment(tx.QueryRow(query, status, providerRef, failureReason, time.Now(), payment.ID, models.PaymentPending))
+	if errors.Is(err, ErrPaymentNotFound) {
+		// Completed by a concurrent delivery of the same charge
+		return r.GetByOrderID(payment.OrderID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return completed, nil
+}
+
+// Abandon marks an order as compensated before payment, so that a later or
+// still running charge or capture for it is declined, unless the order has a
+// successful payment. It returns the order's payment, if any, so a SUCCEEDED
+// one can be refunded and an AUTHORIZED one voided.
+func (r *PaymentRepository) Abandon(orderID, reason string) (*models.Payment, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockOrder(tx, orderID); err != nil {
+		return nil, err
+	}
+
+	payment, err := scanPayment(tx.QueryRow(`SELECT `+paymentColumns+` FROM payments WHERE order_id = $1`, orderID))
+	if err != nil && !errors.Is(err, ErrPaymentNotFound) {
+		return nil, err
+	}
+	if payment != nil && payment.Status == models.PaymentSucceeded {
+		return payment, nil
+	}
+
+	query := `
+		INSERT INTO abandoned_orders (order_id, reason, created_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (order_id) DO NOTHING
+	`
+
+	if _, err := tx.Exec(query, orderID, reason, time.Now()); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+// StartCapture returns an order's payment for capturing. Orders abandoned
+// since the payment was authorized fail with ErrOrderAbandoned, so their
+// hold is voided rather than captured.
+func (r *PaymentRepository) StartCapture(orderID string) (*models.Payment, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	abandoned, err := lockOrder(tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	payment, err := scanPayment(tx.QueryRow(`SELECT `+paymentColumns+` FROM payments WHERE order_id = $1`, orderID))
+	if err != nil {
+		return nil, err
+	}
+	if abandoned && payment.Status == models.PaymentAuthorized {
+		return payment, ErrOrderAbandoned
+	}
+
+	return payment, tx.Commit()
+}
+
+// RecordCapture marks an AUTHORIZED payment SUCCEEDED once the provider has
+// captured it, and reports whether the order was abandoned meanwhile, in
+// which case the caller gives the money back. It fails with
+// ErrNotCapturable if the payment is no longer AUTHORIZED.
+func (r *PaymentRepository) RecordCapture(payment *models.Payment) (*models.Payment, bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	abandoned, err := lockOrder(tx, payment.OrderID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	captured, ok, err := setStatus(tx, payment, models.PaymentAuthorized, models.PaymentSucceeded, "")
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, ErrNotCapturable
+	}
+
+	return captured, abandoned, tx.Commit()
+}
+
+// RecordVoid marks an AUTHORIZED payment VOIDED once the provider has
+// released the hold. It fails with ErrNotVoidable if the payment is no
+// longer AUTHORIZED.
+func (r *PaymentRepository) RecordVoid(payment *models.Payment, reason string) (*models.Payment, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockOrder(tx, payment.OrderID); err != nil {
+		return nil, err
+	}
+
+	voided, ok, err := setStatus(tx, payment, models.PaymentAuthorized, models.PaymentVoided, reason)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotVoidable
+	}
+
+	return voided, tx.Commit()
+}
+
+// RecordVoidFailure marks an AUTHORIZED payment VOID_FAILED when the
+// provider refuses to release its hold. It fails with ErrNotVoidable if the
+// payment is no longer AUTHORIZED.
+func (r *PaymentRepository) RecordVoidFailure(payment *models.Payment, failureReason string) (*models.Payment, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockOrder(tx, payment.OrderID); err != nil {
+		return nil, err
+	}
+
+	failed, ok, err := setStatus(tx, payment, models.PaymentAuthorized, models.PaymentVoidFailed, failureReason)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotVoidable
+	}
+
+	return failed, tx.Commit()
+}
+
+// StartRefund records a PENDING refund of amountMinor of an order's
+// SUCCEEDED payment, or of all that is left of it if amountMinor is 0. The
+// amount must fit in the refundable balance: what is neither refunded nor
+// being refunded. A refund already recorded under key is returned instead,
+// with created false, so a retried request does not refund twice. It
+// returns the payment too, whose provider reference is refunded.
+func (r *PaymentRepository) StartRefund(orderID string, amountMinor int64, reason, key string) (*models.Refund, *models.Payment, bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockOrder(tx, orderID); err != nil {
+		return nil, nil, false, err
+	}
+
+	payment, err := scanPayment(tx.QueryRow(`SELECT `+paymentColumns+` FROM payments WHERE order_id = $1`, orderID))
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	existing, err := scanRefund(tx.QueryRow(`SELECT `+refundColumns+` FROM refunds WHERE payment_id = $1 AND idempotency_key = $2`, payment.ID, key))
+	if err == nil {
+		if amountMinor != 0 && amountMinor != existing.AmountMinor {
+			return nil, nil, false, ErrRefundKeyReused
+		}
+		return existing, payment, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, false, err
+	}
+
+	if payment.Status != models.PaymentSucceeded {
+		return nil, payment, false, ErrNotRefundable
+	}
+
+	var pendingMinor int64
+	query := `
+		SELECT COALESCE(SUM(amount_minor), 0) FROM refunds WHERE payment_id = $1 AND status = $2
+	`
+
+	if err := tx.QueryRow(query, payment.ID, models.RefundPending).Scan(&pendingMinor); err != nil {
+		return nil, nil, false, err
+	}
+
+	balance := payment.AmountMinor - payment.RefundedMinor - pendingMinor
+	if amountMinor == 0 {
+		amountMinor = balance
+	}
+	if amountMinor <= 0 || amountMinor > balance {
+		return nil, payment, false, ErrRefundTooLarge
+	}
+
+	now := time.Now()
+	refund := &models.Refund{
+		PaymentID:      payment.ID,
+		OrderID:        orderID,
+		Status:         models.RefundPending,
+		AmountMinor:    amountMinor,
+		Currency:       payment.Currency,
+		Reason:         reason,
+		IdempotencyKey: key,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+
+	query = `
+		INSERT INTO refunds (payment_id, order_id, status, amount_minor, currency, reason, idempotency_key, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+		RETURNING id
+	`
+
+	err = tx.QueryRow(query, refund.PaymentID, refund.OrderID, refund.Status, refund.AmountMinor, refund.Currency, refund.Reason, refund.IdempotencyKey, now).Scan(&refund.ID)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, false, err
+	}
+
+	return refund, payment, true, nil
+}
+
+// CompleteRefund marks a PENDING refund SUCCEEDED once the provider has
+// given the money back, and adds it to the payment's refunded amount. The
+// payment becomes REFUNDED when all of it is refunded.
+func (r *PaymentRepository) CompleteRefund(refund *models.Refund, providerRef string) (*models.Refund, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockOrder(tx, refund.OrderID); err != nil {
+		return nil, err
+	}
+
+	completed, ok, err := setRefundStatus(tx, refund, models.RefundSucceeded, providerRef, "")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// Completed by a concurrent retry of the same refund
+		return r.getRefund(refund.ID)
+	}
+
+	query := `
+		UPDATE payments
+		SET refunded_minor = refunded_minor + $1,
+		    status = CASE WHEN refunded_minor + $1 >= amount_minor THEN $2 ELSE status END,
+		    updated_at = $3
+		WHERE id = $4
+	`
+
+	if _, err := tx.Exec(query, completed.AmountMinor, models.PaymentRefunded, time.Now(), completed.PaymentID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return completed, nil
+}
+
+// FailRefund marks a PENDING refund the provider refused FAILED, which
+// returns its amount to the refundable balance
+func (r *PaymentRepository) FailRefund(refund *models.Refund, failureReason string) (*models.Refund, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := lockOrder(tx, refund.OrderID); err != nil {
+		return nil, err
+	}
+
+	failed, ok, err := setRefundStatus(tx, refund, models.RefundFailed, "", failureReason)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return r.getRefund(refund.ID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return failed, nil
+}
+
+// PendingRefunds returns up to limit refunds still PENDING that were last
+// updated before the given time, oldest first
+func (r *PaymentRepository) PendingRefunds(before time.Time, limit int) ([]*models.Refund, error) {
+	query := `SELECT ` + refundColumns + ` FROM refunds WHERE status = $1 AND updated_at < $2 ORDER BY id LIMIT $3`
+
+	rows, err := r.db.Query(query, models.RefundPending, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := []*models.Refund{}
+	for rows.Next() {
+		refund, err := scanRefund(rows)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, refund)
+	}
+
+	return refunds, rows.Err()
+}
+
+// ListRefunds returns an order's refunds, oldest first
+func (r *PaymentRepository) ListRefunds(orderID string) ([]*models.Refund, error) {
+	query := `SELECT ` + refundColumns + ` FROM refunds WHERE order_id = $1 ORDER BY id`
+
+	rows, err := r.db.Query(query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refunds := []*models.Refund{}
+	for rows.Next() {
+		refund, err := scanRefund(rows)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, refund)
+	}
+
+	return refunds, rows.Err()
+}
+
+func (r *PaymentRepository) getRefund(id int64) (*models.Refund, error) {
+	return scanRefund(r.db.QueryRow(`SELECT `+refundColumns+` FROM refunds WHERE id = $1`, id))
+}
+
+// setRefundStatus moves a PENDING refund to its final state and reports
+// whether it was still PENDING
+func setRefundStatus(tx *sql.Tx, refund *models.Refund, status, providerRef, failureReason string) (*models.Refund, bool, error) {
+	query := `
+		UPDATE refunds
+		SET status = $1, provider_ref = $2, failure_reason = $3, updated_at = $4
+		WHERE id = $5 AND status = $6
+		RETURNING ` + refundColumns
+
+	updated, err := scanRefund(tx.QueryRow(query, status, providerRef, failureReason, time.Now(), refund.ID, models.RefundPending))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return updated, true, nil
+}
+
+// setStatus moves a payment from one state to another and reports whether
+// it was in the from state
+func setStatus(tx *sql.Tx, payment *models.Payment, from, to, failureReason string) (*models.Payment, bool, error) {
+	query := `
+		UPDATE payments
+		SET status = $1, failure_reason = $2, updated_at = $3
+		WHERE id = $4 AND status = $5
+		RETURNING ` + paymentColumns
+
+	updated, err := scanPayment(tx.QueryRow(query, to, failureReason, time.Now(), payment.ID, from))
+	if errors.Is(err, ErrPaymentNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return updated, true, nil
+}
+
+// lockOrder serializes charging and refunding an order until tx ends, and
+// reports whether the order was abandoned
+func lockOrder(tx *sql.Tx, orderID string) (bool, error) {
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, orderID); err != nil {
+		return false, err
+	}
+
+	var abandoned bool
+	query := `
+		SELECT EXISTS (SELECT 1 FROM abandoned_orders WHERE order_id = $1)
+	`
+
+	if err := tx.QueryRow(query, orderID).Scan(&abandoned); err != nil {
+		return false, err
+	}
+
+	return abandoned, nil
+}
+
+func scanPayment(row *sql.Row) (*models.Payment, error) {
+	payment := &models.Payment{}
+
+	err := row.Scan(
+		&payment.ID,
+		&payment.OrderID,
+		&payment.ItemID,
+		&payment.Quantity,
+		&payment.UserEmail,
+		&payment.Status,
+		&payment.AmountMinor,
+		&payment.Currency,
+		&payment.ProviderRef,
+		&payment.FailureReason,
+		&payment.RefundedMinor,
+		&payment.CreatedAt,
+		&payment.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return payment, nil
+}
+
+// scanRefund scans a refund from a *sql.Row or *sql.Rows. Unlike
+// scanPayment it returns sql.ErrNoRows as is.
+func scanRefund(row interface{ Scan(...any) error }) (*models.Refund, error) {
+	refund := &models.Refund{}
+
+	err := row.Scan(
+		&refund.ID,
+		&refund.PaymentID,
+		&refund.OrderID,
+		&refund.Status,
+		&refund.AmountMinor,
+		&refund.Currency,
+		&refund.Reason,
+		&refund.IdempotencyKey,
+		&refund.ProviderRef,
+		&refund.FailureReason,
+		&refund.CreatedAt,
+		&refund.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return refund, nil
+}
@@ -1,74 +1,496 @@
 package services
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
-	"math/rand"
-	"sync"
 	"time"
+
+	"github.com/spksupakorn/ecommerce-event-driven/payment-service/gateway"
+	"github.com/spksupakorn/ecommerce-event-driven/payment-service/models"
+	"github.com/spksupakorn/ecommerce-event-driven/payment-service/repository"
 )
 
+// PaymentService charges and refunds orders. Payments and refunds are kept
+// in the database, so refunds still work after a restart. Money is moved
+// through the configured gateway with idempotency keys derived from the
+// payment's and refund's IDs, so retries never charge or refund twice.
 type PaymentService struct {
-	// Store payment amounts for potential refunds
-	payments map[string]float64
-	mu       sync.RWMutex
+	repo      *repository.PaymentRepository
+	gateway   gateway.Gateway
+	cardToken string
 }
 
-func NewPaymentService() *PaymentService {
+func NewPaymentService(repo *repository.PaymentRepository, gw gateway.Gateway, cardToken string) *PaymentService {
 	return &PaymentService{
-		payments: make(map[string]float64),
+		repo:      repo,
+		gateway:   gw,
+		cardToken: cardToken,
+	}
+}
+
+// ProcessPayment charges the order total: the amount is authorized and
+// captured straight away. An order is charged once: a repeated charge
+// returns the outcome of the first. A charge that cannot be finished now,
+// e.g. because the provider or the database is unavailable, returns an
+// error instead of failing: the caller retries it, and the retry sends the
+// same charge again.
+func (s *PaymentService) ProcessPayment(orderID, itemID string, quantity int, userEmail string, amountMinor int64, currency string) (int64, bool, string, error) {
+	log.Printf("Processing payment for order: %s (%d %s)", orderID, amountMinor, currency)
+	return s.charge(orderID, itemID, quantity, userEmail, amountMinor, currency, true)
+}
+
+// AuthorizePayment places a hold of the order total on the card, to be
+// captured once the order's stock is deducted (CapturePayment) or voided if
+// it cannot be (VoidPayment). A repeated authorization returns the outcome
+// of the first. Like ProcessPayment it returns an error if it cannot be
+// finished now.
+func (s *PaymentService) AuthorizePayment(orderID, itemID string, quantity int, userEmail string, amountMinor int64, currency string) (int64, bool, string, error) {
+	log.Printf("Authorizing payment for order: %s (%d %s)", orderID, amountMinor, currency)
+	return s.charge(orderID, itemID, quantity, userEmail, amountMinor, currency, false)
+}
+
+// charge authorizes the order total and, if capture is set, captures it
+func (s *PaymentService) charge(orderID, itemID string, quantity int, userEmail string, amountMinor int64, currency string, capture bool) (int64, bool, string, error) {
+	payment, created, err := s.repo.Start(&models.Payment{
+		OrderID:     orderID,
+		ItemID:      itemID,
+		Quantity:    quantity,
+		UserEmail:   userEmail,
+		AmountMinor: amountMinor,
+		Currency:    currency,
+	})
+	if errors.Is(err, repository.ErrOrderAbandoned) {
+		log.Printf("Payment declined for order %s: order was abandoned before payment", orderID)
+		return 0, false, "Payment declined - order was cancelled before payment", nil
+	}
+	if err != nil {
+		log.Printf("Failed to record payment for order %s: %v", orderID, err)
+		return 0, false, "Payment processing failed - please try again", err
+	}
+
+	if !created {
+		switch payment.Status {
+		case models.PaymentSucceeded:
+			log.Printf("Order %s was already charged %d %s", orderID, payment.AmountMinor, payment.Currency)
+			return payment.AmountMinor, true, "Payment processed successfully", nil
+		case models.PaymentAuthorized:
+			if capture {
+				amount, _, success, message, err := s.CapturePayment(orderID)
+				return amount, success, message, err
+			}
+			log.Printf("Order %s was already authorized for %d %s", orderID, payment.AmountMinor, payment.Currency)
+			return payment.AmountMinor, true, "Payment authorized successfully", nil
+		case models.PaymentFailed, models.PaymentVoided, models.PaymentVoidFailed:
+			return 0, false, payment.FailureReason, nil
+		case models.PaymentRefunded:
+			return 0, false, "Payment declined - order was already refunded", nil
+		}
+		// Still PENDING: the last attempt did not finish, so charge again
+	}
+
+	if amountMinor <= 0 {
+		log.Printf("Payment failed for order %s: invalid amount %d", orderID, amountMinor)
+		return s.fail(payment, "", "Payment processing failed - invalid order amount")
+	}
+
+	ctx := context.Background()
+	key := idempotencyKey(payment)
+
+	providerRef, err := s.gateway.Authorize(ctx, gateway.AuthorizeRequest{
+		OrderID:        orderID,
+		AmountMinor:    payment.AmountMinor,
+		Currency:       payment.Currency,
+		CardToken:      s.cardToken,
+		IdempotencyKey: key + "-authorize",
+	})
+	if errors.Is(err, gateway.ErrUnavailable) {
+		// Left PENDING, so that a retry sends the same authorization again
+		log.Printf("Payment authorization for order %s is pending: %v", orderID, err)
+		return 0, false, failureMessage(err), err
+	}
+	if err != nil {
+		log.Printf("Payment authorization failed for order %s: %v", orderID, err)
+		return s.fail(payment, "", failureMessage(err))
+	}
+
+	status := models.PaymentAuthorized
+	if capture {
+		err := s.gateway.Capture(ctx, providerRef, payment.AmountMinor, key+"-capture")
+		if errors.Is(err, gateway.ErrUnavailable) {
+			// The retry gets the same authorization back and captures it
+			log.Printf("Payment capture for order %s is pending: %v", orderID, err)
+			return 0, false, failureMessage(err), err
+		}
+		if err != nil {
+			log.Printf("Payment capture failed for order %s: %v", orderID, err)
+			s.voidHold(providerRef, payment)
+			return s.fail(payment, providerRef, failureMessage(err))
+		}
+		status = models.PaymentSucceeded
+	}
+
+	completed, err := s.repo.Complete(payment, status, providerRef, "")
+	if err != nil {
+		log.Printf("Failed to record payment for order %s: %v", orderID, err)
+		return 0, false, "Payment processing failed - please try again", err
+	}
+
+	if completed.Status != status {
+		// The order was cancelled while it was being charged, so the hold is
+		// released or the charge given back
+		log.Printf("Payment for order %s reversed: %s", orderID, completed.FailureReason)
+		if capture {
+			s.reverseCapture(providerRef, payment, completed.FailureReason)
+		} else {
+			s.voidHold(providerRef, payment)
+		}
+		return 0, false, "Payment declined - order was cancelled before payment", nil
+	}
+
+	if !capture {
+		log.Printf("Payment authorized for order %s: %d %s (ref %s)", orderID, completed.AmountMinor, completed.Currency, completed.ProviderRef)
+		return completed.AmountMinor, true, "Payment authorized successfully", nil
+	}
+
+	log.Printf("Payment successful for order %s: %d %s (ref %s)", orderID, completed.AmountMinor, completed.Currency, completed.ProviderRef)
+	return completed.AmountMinor, true, "Payment processed successfully", nil
+}
+
+// CapturePayment captures an order's authorized payment. A capture the
+// provider refuses voids the authorization and fails the payment; a
+// repeated capture returns the outcome of the first. A capture that cannot
+// be finished now, e.g. because the provider is unavailable, returns an
+// error and keeps the authorization, so the caller can retry it.
+func (s *PaymentService) CapturePayment(orderID string) (int64, string, bool, string, error) {
+	log.Printf("Capturing payment for order: %s", orderID)
+
+	payment, err := s.repo.StartCapture(orderID)
+	if errors.Is(err, repository.ErrOrderAbandoned) {
+		log.Printf("Capture declined for order %s: order was abandoned", orderID)
+		return 0, "", false, "Payment declined - order was cancelled before payment", nil
+	}
+	if errors.Is(err, repository.ErrPaymentNotFound) {
+		log.Printf("No payment found for order %s - cannot capture", orderID)
+		return 0, "", false, "No authorized payment found to capture", nil
+	}
+	if err != nil {
+		log.Printf("Failed to look up payment for order %s: %v", orderID, err)
+		return 0, "", false, "Payment capture failed - please try again", err
+	}
+
+	switch payment.Status {
+	case models.PaymentAuthorized:
+	case models.PaymentSucceeded:
+		log.Printf("Order %s was already captured %d %s", orderID, payment.AmountMinor, payment.Currency)
+		return payment.AmountMinor, payment.Currency, true, "Payment captured successfully", nil
+	case models.PaymentFailed, models.PaymentVoided, models.PaymentVoidFailed:
+		return 0, "", false, payment.FailureReason, nil
+	default:
+		log.Printf("Payment for order %s cannot be captured: it is %s", orderID, payment.Status)
+		return 0, "", false, "No authorized payment found to capture", nil
+	}
+
+	err = s.gateway.Capture(context.Background(), payment.ProviderRef, payment.AmountMinor, idempotencyKey(payment)+"-capture")
+	if errors.Is(err, gateway.ErrUnavailable) {
+		log.Printf("Payment capture for order %s is pending: %v", orderID, err)
+		return 0, "", false, failureMessage(err), err
+	}
+	if err != nil {
+		log.Printf("Payment capture failed for order %s: %v", orderID, err)
+		message := failureMessage(err)
+		if _, err := s.releaseHold(payment, message); err != nil {
+			// Retried with the capture, which the provider refuses again
+			return 0, "", false, message, err
+		}
+		return 0, "", false, message, nil
+	}
+
+	captured, abandoned, err := s.repo.RecordCapture(payment)
+	if errors.Is(err, repository.ErrNotCapturable) {
+		// Captured by a concurrent delivery of the same request
+		return payment.AmountMinor, payment.Currency, true, "Payment captured successfully", nil
+	}
+	if err != nil {
+		log.Printf("Failed to record capture for order %s: %v", orderID, err)
+		return 0, "", false, "Payment capture failed - please try again", err
+	}
+
+	if abandoned {
+		// The order was cancelled while it was being captured
+		log.Printf("Capture for order %s reversed: order was cancelled", orderID)
+		if s.reverseCapture(captured.ProviderRef, captured, repository.ErrOrderAbandoned.Error()) {
+			return 0, "", false, "Payment declined - order was cancelled before payment", nil
+		}
+	}
+
+	log.Printf("Payment captured for order %s: %d %s (ref %s)", orderID, captured.AmountMinor, captured.Currency, captured.ProviderRef)
+	return captured.AmountMinor, captured.Currency, true, "Payment captured successfully", nil
+}
+
+// fail records a declined charge and returns the result to report
+func (s *PaymentService) fail(payment *models.Payment, providerRef, message string) (int64, bool, string, error) {
+	if _, err := s.repo.Complete(payment, models.PaymentFailed, providerRef, message); err != nil {
+		log.Printf("Failed to record failed payment for order %s: %v", payment.OrderID, err)
+		return 0, false, message, err
+	}
+	return 0, false, message, nil
+}
+
+// voidHold releases an authorization at the provider
+func (s *PaymentService) voidHold(providerRef string, payment *models.Payment) error {
+	err := s.gateway.Void(context.Background(), providerRef, idempotencyKey(payment)+"-void")
+	if err != nil {
+		log.Printf("Failed to void authorization %s for order %s: %v", providerRef, payment.OrderID, err)
+	}
+	return err
+}
+
+// releaseHold voids an AUTHORIZED payment and records the outcome: VOIDED,
+// or VOID_FAILED if the provider refuses to release the hold, e.g. because
+// it expired or the provider no longer knows it. It returns the payment as
+// recorded, or an error if the void should be retried because the provider
+// or the database is unavailable.
+func (s *PaymentService) releaseHold(payment *models.Payment, reason string) (*models.Payment, error) {
+	err := s.voidHold(payment.ProviderRef, payment)
+	if errors.Is(err, gateway.ErrUnavailable) {
+		return nil, err
+	}
+
+	var released *models.Payment
+	if err != nil {
+		log.Printf("ALERT: hold %s for order %s could not be voided and needs checking with the provider: %v", payment.ProviderRef, payment.OrderID, err)
+		released, err = s.repo.RecordVoidFailure(payment, "Void failed - "+err.Error())
+	} else {
+		released, err = s.repo.RecordVoid(payment, reason)
 	}
+	if errors.Is(err, repository.ErrNotVoidable) {
+		// Settled by a concurrent delivery of the same request
+		return s.repo.GetByOrderID(payment.OrderID)
+	}
+	if err != nil {
+		log.Printf("Failed to record void for order %s: %v", payment.OrderID, err)
+		return nil, err
+	}
+	return released, nil
 }
 
-// ProcessPayment simulates payment processing with a 2-second delay
-func (s *PaymentService) ProcessPayment(orderID, itemID string, quantity int, userEmail string) (float64, bool, string) {
-	log.Printf("Processing payment for order: %s", orderID)
+// reverseCapture refunds a captured payment in full. It reports whether the
+// money was given back.
+func (s *PaymentService) reverseCapture(providerRef string, payment *models.Payment, reason string) bool {
+	if payment.Status == models.PaymentSucceeded {
+		refund, _, err := s.refund(payment.OrderID, 0, reason, "reversal")
+		if err != nil {
+			log.Printf("Failed to reverse charge %s for order %s: %v", providerRef, payment.OrderID, err)
+			return false
+		}
+		return refund.Status == models.RefundSucceeded
+	}
 
-	// Simulate payment processing time
-	time.Sleep(2 * time.Second)
+	// The payment was recorded as FAILED, so there is no refund to record
+	_, err := s.gateway.Refund(context.Background(), gateway.RefundRequest{
+		PaymentRef:     providerRef,
+		AmountMinor:    payment.AmountMinor,
+		Currency:       payment.Currency,
+		Reason:         reason,
+		IdempotencyKey: idempotencyKey(payment) + "-refund",
+	})
+	if err != nil {
+		log.Printf("Failed to reverse charge %s for order %s: %v", providerRef, payment.OrderID, err)
+		return false
+	}
+	return true
+}
 
-	// Calculate mock amount (random price between 10 and 1000)
-	amount := float64(quantity) * (10 + rand.Float64()*990)
+// VoidPayment releases the hold of an order's authorized payment
+// (compensation before capture). Like RefundPayment it remembers the order
+// as abandoned, so a capture that arrives later is declined. It fails if the
+// order has no authorized payment, e.g. because it was already captured; the
+// caller then refunds instead, if the payment was captured. A hold the
+// provider refuses to release is recorded as VOID_FAILED. A void that cannot
+// be finished now returns an error, so the caller can retry it.
+func (s *PaymentService) VoidPayment(orderID, reason string) (int64, string, bool, string, error) {
+	log.Printf("Processing void for order: %s (reason: %s)", orderID, reason)
 
-	// Simulate 95% success rate for payments
-	// For demonstration, you can adjust this logic
-	success := rand.Float64() < 0.95
+	payment, err := s.repo.Abandon(orderID, reason)
+	if err != nil {
+		log.Printf("Failed to look up payment for order %s: %v", orderID, err)
+		return 0, "", false, "Void failed - please try again", err
+	}
 
-	if success {
-		// Store payment amount for potential refund
-		s.mu.Lock()
-		s.payments[orderID] = amount
-		s.mu.Unlock()
+	if payment != nil && payment.Status == models.PaymentVoided {
+		log.Printf("Payment for order %s was already voided", orderID)
+		return payment.AmountMinor, payment.Currency, true, "Payment authorization voided", nil
+	}
 
-		log.Printf("Payment successful for order %s: $%.2f", orderID, amount)
-		return amount, true, "Payment processed successfully"
+	if payment == nil || payment.Status != models.PaymentAuthorized {
+		return 0, "", false, "No authorized payment found to void", nil
 	}
 
-	log.Printf("Payment failed for order %s", orderID)
-	return 0, false, "Payment processing failed - insufficient funds or card declined"
+	voided, err := s.releaseHold(payment, reason)
+	if err != nil {
+		return 0, "", false, "Void failed - please try again", err
+	}
+	if voided.Status != models.PaymentVoided {
+		return 0, "", false, voided.FailureReason, nil
+	}
+
+	log.Printf("Void successful for order %s: %d %s released (ref %s)", orderID, payment.AmountMinor, payment.Currency, payment.ProviderRef)
+	return payment.AmountMinor, payment.Currency, true, "Payment authorization voided", nil
 }
 
-// RefundPayment simulates refunding a payment (compensation transaction)
-func (s *PaymentService) RefundPayment(orderID, itemID string, quantity int, userEmail, reason string) (float64, bool, string) {
+// RefundPayment refunds what is left of a payment (compensation
+// transaction); parts refunded before through RequestRefund are not refunded
+// again. Orders without a successful payment are remembered as abandoned, so
+// a charge that arrives or finishes later (e.g. for an order that timed out)
+// is declined instead of kept. A refund that cannot be finished now, e.g.
+// because the provider is unavailable, returns an error: the caller retries
+// it and the retry sends the same refund again.
+func (s *PaymentService) RefundPayment(orderID, itemID string, quantity int, userEmail, reason string) (int64, string, bool, string, error) {
 	log.Printf("Processing refund for order: %s (reason: %s)", orderID, reason)
 
-	// Retrieve the original payment amount
-	s.mu.RLock()
-	amount, exists := s.payments[orderID]
-	s.mu.RUnlock()
+	payment, err := s.repo.Abandon(orderID, reason)
+	if err != nil {
+		log.Printf("Failed to look up payment for order %s: %v", orderID, err)
+		return 0, "", false, "Refund failed - please try again", err
+	}
 
-	if !exists {
+	if payment == nil || (payment.Status != models.PaymentSucceeded && payment.Status != models.PaymentRefunded) {
 		log.Printf("No payment found for order %s - cannot refund", orderID)
-		return 0, false, "No payment found to refund"
+		return 0, "", false, "No payment found to refund", nil
+	}
+
+	refund, _, err := s.refund(orderID, 0, reason, "compensation")
+	if errors.Is(err, repository.ErrNotRefundable) {
+		// Refunded in full already, through the refund API
+		log.Printf("Payment for order %s was already refunded", orderID)
+		return payment.RefundedMinor, payment.Currency, true, "Payment refunded successfully", nil
+	}
+	if err != nil {
+		log.Printf("Refund for order %s not finished: %v", orderID, err)
+		return 0, "", false, "Refund failed - please try again", err
+	}
+	if refund.Status != models.RefundSucceeded {
+		return 0, "", false, refund.FailureReason, nil
+	}
+
+	log.Printf("Refund successful for order %s: %d %s (ref %s)", orderID, refund.AmountMinor, refund.Currency, refund.ProviderRef)
+	return refund.AmountMinor, refund.Currency, true, "Payment refunded successfully", nil
+}
+
+// RequestRefund refunds amountMinor of an order's captured payment, or all
+// that is left of it if amountMinor is 0, e.g. for one line of an order or
+// as goodwill credit. A payment can be refunded several times up to its
+// amount. Requests with the same idempotency key are one refund: a repeated
+// one returns the first, with created false. A refund the provider could
+// not be reached for is left PENDING and fails with gateway.ErrUnavailable;
+// retrying it with the same key finishes it.
+func (s *PaymentService) RequestRefund(orderID string, amountMinor int64, reason, key string) (*models.Refund, bool, error) {
+	log.Printf("Processing refund request for order: %s (%d, reason: %s)", orderID, amountMinor, reason)
+	return s.refund(orderID, amountMinor, reason, "api-"+key)
+}
+
+// RetryPendingRefunds sends up to limit refunds again that are still
+// PENDING after olderThan, e.g. because the provider was unavailable or the
+// service stopped mid-refund, so their amount does not stay held out of the
+// refundable balance. It returns how many were finished.
+func (s *PaymentService) RetryPendingRefunds(olderThan time.Duration, limit int) (int, error) {
+	refunds, err := s.repo.PendingRefunds(time.Now().Add(-olderThan), limit)
+	if err != nil {
+		return 0, err
 	}
 
-	// Simulate refund processing time
-	time.Sleep(1 * time.Second)
+	finished := 0
+	for _, pending := range refunds {
+		refund, _, err := s.refund(pending.OrderID, pending.AmountMinor, pending.Reason, pending.IdempotencyKey)
+		if err != nil {
+			log.Printf("Retry of refund %d for order %s failed: %v", pending.ID, pending.OrderID, err)
+			continue
+		}
+		if refund.Status != models.RefundPending {
+			finished++
+		}
+	}
+
+	return finished, nil
+}
+
+// refund gives back amountMinor of an order's captured payment, or all that
+// is left of it if amountMinor is 0, as the refund recorded under key. A
+// refund that is no longer PENDING is returned as it is.
+func (s *PaymentService) refund(orderID string, amountMinor int64, reason, key string) (*models.Refund, bool, error) {
+	refund, payment, created, err := s.repo.StartRefund(orderID, amountMinor, reason, key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if refund.Status != models.RefundPending {
+		return refund, created, nil
+	}
 
-	// Remove payment from storage
-	s.mu.Lock()
-	delete(s.payments, orderID)
-	s.mu.Unlock()
+	refundRef, err := s.gateway.Refund(context.Background(), gateway.RefundRequest{
+		PaymentRef:     payment.ProviderRef,
+		AmountMinor:    refund.AmountMinor,
+		Currency:       refund.Currency,
+		Reason:         reason,
+		IdempotencyKey: fmt.Sprintf("%s-refund-%d", idempotencyKey(payment), refund.ID),
+	})
+	if errors.Is(err, gateway.ErrUnavailable) {
+		// Left PENDING, so that a retry sends the same request again
+		log.Printf("Refund %d for order %s is pending: %v", refund.ID, orderID, err)
+		return refund, created, err
+	}
+	if err != nil {
+		log.Printf("Refund %d for order %s failed: %v", refund.ID, orderID, err)
+		refund, err = s.repo.FailRefund(refund, "Refund failed - "+err.Error())
+		return refund, created, err
+	}
+
+	refund, err = s.repo.CompleteRefund(refund, refundRef)
+	if err != nil {
+		return nil, false, err
+	}
+
+	log.Printf("Refund %d for order %s succeeded: %d %s (ref %s)", refund.ID, orderID, refund.AmountMinor, refund.Currency, refund.ProviderRef)
+	return refund, created, nil
+}
 
-	log.Printf("Refund successful for order %s: $%.2f", orderID, amount)
-	return amount, true, "Payment refunded successfully"
+// GetPayment returns an order's payment
+func (s *PaymentService) GetPayment(orderID string) (*models.Payment, error) {
+	return s.repo.GetByOrderID(orderID)
+}
+
+// PaymentStatus returns the status of an order's payment, or "" if the
+// order has none
+func (s *PaymentService) PaymentStatus(orderID string) (string, error) {
+	payment, err := s.repo.GetByOrderID(orderID)
+	if errors.Is(err, repository.ErrPaymentNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return payment.Status, nil
+}
+
+// ListRefunds returns an order's refunds, oldest first
+func (s *PaymentService) ListRefunds(orderID string) ([]*models.Refund, error) {
+	return s.repo.ListRefunds(orderID)
+}
+
+// idempotencyKey is the prefix of the keys sent to the gateway for a payment
+func idempotencyKey(payment *models.Payment) string {
+	return fmt.Sprintf("payment-%d", payment.ID)
+}
+
+// failureMessage is the reason reported for a charge the gateway refused
+func failureMessage(err error) string {
+	if errors.Is(err, gateway.ErrDeclined) {
+		return "Payment declined - " + err.Error()
+	}
+	if errors.Is(err, gateway.ErrUnavailable) {
+		return "Payment processing failed - payment provider unavailable"
+	}
+	return "Payment processing failed - " + err.Error()
 }
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// refundRetryBatchSize caps how many pending refunds are sent again per run
+const refundRetryBatchSize = 100
+
+// RefundRetrier periodically sends refunds left PENDING again, so a refund
+// the provider could not be reached for is finished even if nobody retries
+// the request that started it.
+type RefundRetrier struct {
+	paymentService *PaymentService
+	interval       time.Duration
+}
+
+func NewRefundRetrier(paymentService *PaymentService, interval time.Duration) *RefundRetrier {
+	return &RefundRetrier{
+		paymentService: paymentService,
+		interval:       interval,
+	}
+}
+
+// Start runs the retrier until ctx is cancelled
+func (w *RefundRetrier) Start(ctx context.Context) {
+	log.Printf("Refund retrier started (interval %s)", w.interval)
+
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Println("Refund retrier stopped")
+				return
+			case <-ticker.C:
+				w.retry()
+			}
+		}
+	}()
+}
+
+func (w *RefundRetrier) retry() {
+	// Only refunds untouched for a whole interval, so requests still being
+	// handled are left alone. Refunds the provider still cannot be reached
+	// for are tried again on the next run.
+	finished, err := w.paymentService.RetryPendingRefunds(w.interval, refundRetryBatchSize)
+	if err != nil {
+		log.Printf("Refund retrier failed to look up pending refunds: %v", err)
+		return
+	}
+	if finished > 0 {
+		log.Printf("Refund retrier finished %d pending refunds", finished)
+	}
+}
@@ -2,14 +2,65 @@ package events
 
 import "time"
 
-// OrderCreatedEvent represents an order creation event
+// OrderCreatedEvent represents an order creation event.
+// Amounts are integer minor currency units (e.g. cents).
 type OrderCreatedEvent struct {
-	OrderID   string    `json:"order_id"`
-	ItemID    string    `json:"item_id"`
-	Quantity  int       `json:"quantity"`
-	UserEmail string    `json:"user_email"`
-	Status    string    `json:"status"`
-	CreatedAt time.Time `json:"created_at"`
+	OrderID        string    `json:"order_id"`
+	ItemID         string    `json:"item_id"`
+	Quantity       int       `json:"quantity"`
+	UserEmail      string    `json:"user_email"`
+	ShipToRegion   string    `json:"ship_to_region,omitempty"`
+	Status         string    `json:"status"`
+	UnitPriceMinor int64     `json:"unit_price_minor"`
+	Currency       string    `json:"currency"`
+	TotalMinor     int64     `json:"total_minor"`
+	CreatedAt      time.Time `json:"created_at"`
+	// Items, when present, are the lines of a multi-line order; inventory
+	// reserves all of them or none
+	Items []OrderLine `json:"items,omitempty"`
+}
+
+// OrderLine is one item of a multi-line order
+type OrderLine struct {
+	ItemID   string `json:"item_id"`
+	Quantity int    `json:"quantity"`
+}
+
+// LineItem is what one line of a multi-line order holds, and where
+type LineItem struct {
+	ItemID      string       `json:"item_id"`
+	Quantity    int          `json:"quantity"`
+	Allocations []Allocation `json:"allocations"`
+}
+
+// LineFailure says why one line of a multi-line order could not be
+// reserved. Line is the line's 1-based position in the order.
+type LineFailure struct {
+	Line     int    `json:"line"`
+	ItemID   string `json:"item_id"`
+	Quantity int    `json:"quantity"`
+	Reason   string `json:"reason"`
+}
+
+// OrderTimedOutEvent is published when the order reaper gives up on an order
+// stuck in a non-terminal status (compensation trigger)
+type OrderTimedOutEvent struct {
+	OrderID    string    `json:"order_id"`
+	ItemID     string    `json:"item_id"`
+	Quantity   int       `json:"quantity"`
+	UserEmail  string    `json:"user_email"`
+	Status     string    `json:"status"` // "TIMED_OUT"
+	Reason     string    `json:"reason"`
+	TimedOutAt time.Time `json:"timed_out_at"`
+}
+
+// OrderCancelledEvent is published when an order moves to CANCELLED so that
+// participants can compensate
+type OrderCancelledEvent struct {
+	OrderID     string    `json:"order_id"`
+	Status      string    `json:"status"`
+	Reason      string    `json:"reason"`
+	CancelledAt time.Time `json:"cancelled_at"`
 }
 
 // InventoryProcessedEvent represents an inventory processing event
@@ -23,76 +74,317 @@ type InventoryProcessedEvent struct {
 	ProcessedAt time.Time `json:"processed_at"`
 }
 
-// InventorySuccessfulEvent represents a successful inventory reservation
+// InventorySuccessfulEvent represents a successful inventory reservation.
+// WarehouseID is where the order ships from (the warehouse holding most of
+// it); Allocations lists every warehouse if the stock had to be split. For a
+// multi-line order ItemID is the first line's, Quantity the total and Items
+// has each line.
 type InventorySuccessfulEvent struct {
-	OrderID     string    `json:"order_id"`
-	ItemID      string    `json:"item_id"`
-	Quantity    int       `json:"quantity"`
-	UserEmail   string    `json:"user_email"`
-	Message     string    `json:"message"`
-	ProcessedAt time.Time `json:"processed_at"`
+	OrderID     string       `json:"order_id"`
+	ItemID      string       `json:"item_id"`
+	Quantity    int          `json:"quantity"`
+	UserEmail   string       `json:"user_email"`
+	WarehouseID string       `json:"warehouse_id"`
+	Allocations []Allocation `json:"allocations"`
+	Items       []LineItem   `json:"items,omitempty"`
+	Message     string       `json:"message"`
+	ProcessedAt time.Time    `json:"processed_at"`
+}
+
+// Allocation is the part of an order's stock taken from one warehouse
+type Allocation struct {
+	WarehouseID string `json:"warehouse_id"`
+	Quantity    int    `json:"quantity"`
+}
+
+// InventoryReservedEvent is published when stock is held for an order of an
+// inventory-first saga, before payment is taken
+type InventoryReservedEvent struct {
+	OrderID     string       `json:"order_id"`
+	ItemID      string       `json:"item_id"`
+	Quantity    int          `json:"quantity"`
+	UserEmail   string       `json:"user_email"`
+	TotalMinor  int64        `json:"total_minor"`
+	Currency    string       `json:"currency"`
+	Allocations []Allocation `json:"allocations"`
+	Items       []LineItem   `json:"items,omitempty"`
+	ReservedAt  time.Time    `json:"reserved_at"`
+}
+
+// ReleasedStock is one product given back in an InventoryReleasedEvent.
+// Restocked is true if deducted stock was added back to stock, false if a
+// reservation was released.
+type ReleasedStock struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+	Restocked bool   `json:"restocked"`
+}
+
+// InventoryReleasedEvent is published once the stock of a cancelled or timed
+// out order has been given back
+type InventoryReleasedEvent struct {
+	OrderID    string          `json:"order_id"`
+	Items      []ReleasedStock `json:"items"`
+	Reason     string          `json:"reason"`
+	ReleasedAt time.Time       `json:"released_at"`
 }
 
-// InventoryFailedEvent represents an inventory failure event (out of stock)
+// InventoryFailedEvent represents an inventory failure event (out of stock).
+// For a multi-line order Items has the order's lines and Failures the reason
+// for each line that could not be reserved; Reason sums them up.
 type InventoryFailedEvent struct {
+	OrderID   string        `json:"order_id"`
+	ItemID    string        `json:"item_id"`
+	Quantity  int           `json:"quantity"`
+	UserEmail string        `json:"user_email"`
+	Reason    string        `json:"reason"`
+	Items     []OrderLine   `json:"items,omitempty"`
+	Failures  []LineFailure `json:"failures,omitempty"`
+	FailedAt  time.Time     `json:"failed_at"`
+}
+
+// InventoryBackorderedEvent is published when an order for a product that
+// allows backorders is queued for stock instead of failing. The order waits
+// until ExpiresAt at most.
+type InventoryBackorderedEvent struct {
+	OrderID       string    `json:"order_id"`
+	ItemID        string    `json:"item_id"`
+	Quantity      int       `json:"quantity"`
+	UserEmail     string    `json:"user_email"`
+	Message       string    `json:"message"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	BackorderedAt time.Time `json:"backordered_at"`
+}
+
+// BackorderFilledEvent is published when stock for a backordered order
+// arrives. It is followed by inventory.successful (or inventory.reserved in
+// an inventory-first saga).
+type BackorderFilledEvent struct {
+	OrderID     string       `json:"order_id"`
+	ItemID      string       `json:"item_id"`
+	Quantity    int          `json:"quantity"`
+	UserEmail   string       `json:"user_email"`
+	Allocations []Allocation `json:"allocations"`
+	FilledAt    time.Time    `json:"filled_at"`
+}
+
+// BackorderExpiredEvent is published when a backordered order waited too long
+// for stock. It is followed by inventory.failed, which cancels the order.
+type BackorderExpiredEvent struct {
 	OrderID   string    `json:"order_id"`
 	ItemID    string    `json:"item_id"`
 	Quantity  int       `json:"quantity"`
 	UserEmail string    `json:"user_email"`
 	Reason    string    `json:"reason"`
-	FailedAt  time.Time `json:"failed_at"`
+	ExpiredAt time.Time `json:"expired_at"`
 }
 
-// PaymentProcessedEvent represents a successful payment event
-type PaymentProcessedEvent struct {
+// BackorderCancelledEvent is published when a backordered order is cancelled
+// while it waits for stock
+type BackorderCancelledEvent struct {
 	OrderID     string    `json:"order_id"`
 	ItemID      string    `json:"item_id"`
 	Quantity    int       `json:"quantity"`
 	UserEmail   string    `json:"user_email"`
-	Amount      float64   `json:"amount"`
-	Status      string    `json:"status"` // "SUCCESS"
-	Message     string    `json:"message"`
-	ProcessedAt time.Time `json:"processed_at"`
+	Reason      string    `json:"reason"`
+	CancelledAt time.Time `json:"cancelled_at"`
+}
+
+// PaymentProcessedEvent represents a successful payment event. The same
+// fields are published as payment.authorized (Status "AUTHORIZED") when a
+// payment-first order's total is held on the card before its stock is
+// deducted.
+type PaymentProcessedEvent struct {
+	OrderID      string    `json:"order_id"`
+	ItemID       string    `json:"item_id"`
+	Quantity     int       `json:"quantity"`
+	UserEmail    string    `json:"user_email"`
+	ShipToRegion string    `json:"ship_to_region,omitempty"`
+	AmountMinor  int64     `json:"amount_minor"`
+	Currency     string    `json:"currency"`
+	Status       string    `json:"status"` // "SUCCESS" or "AUTHORIZED"
+	Message      string    `json:"message"`
+	ProcessedAt  time.Time `json:"processed_at"`
+	// Items are copied from the order's OrderCreatedEvent
+	Items []OrderLine `json:"items,omitempty"`
 }
 
 // PaymentFailedEvent represents a failed payment event
 type PaymentFailedEvent struct {
-	OrderID   string    `json:"order_id"`
-	ItemID    string    `json:"item_id"`
-	Quantity  int       `json:"quantity"`
-	UserEmail string    `json:"user_email"`
-	Reason    string    `json:"reason"`
-	FailedAt  time.Time `json:"failed_at"`
+	OrderID   string      `json:"order_id"`
+	ItemID    string      `json:"item_id"`
+	Quantity  int         `json:"quantity"`
+	UserEmail string      `json:"user_email"`
+	Reason    string      `json:"reason"`
+	FailedAt  time.Time   `json:"failed_at"`
+	Items     []OrderLine `json:"items,omitempty"`
+}
+
+// PaymentCapturedEvent is published when a payment-first order's authorized
+// payment is captured after its stock was deducted; the order is then
+// complete
+type PaymentCapturedEvent struct {
+	OrderID     string    `json:"order_id"`
+	ItemID      string    `json:"item_id"`
+	Quantity    int       `json:"quantity"`
+	UserEmail   string    `json:"user_email"`
+	AmountMinor int64     `json:"amount_minor"`
+	Currency    string    `json:"currency"`
+	Message     string    `json:"message"`
+	CapturedAt  time.Time `json:"captured_at"`
+}
+
+// PaymentVoidedEvent is published when an authorized payment's hold is
+// released instead of captured (compensation before capture)
+type PaymentVoidedEvent struct {
+	OrderID     string    `json:"order_id"`
+	ItemID      string    `json:"item_id"`
+	Quantity    int       `json:"quantity"`
+	UserEmail   string    `json:"user_email"`
+	AmountMinor int64     `json:"amount_minor"`
+	Currency    string    `json:"currency"`
+	Reason      string    `json:"reason"`
+	VoidedAt    time.Time `json:"voided_at"`
 }
 
 // PaymentRefundedEvent represents a payment refund event (compensation transaction)
 type PaymentRefundedEvent struct {
-	OrderID    string    `json:"order_id"`
-	ItemID     string    `json:"item_id"`
-	Quantity   int       `json:"quantity"`
-	UserEmail  string    `json:"user_email"`
-	Amount     float64   `json:"amount"`
-	Reason     string    `json:"reason"`
-	RefundedAt time.Time `json:"refunded_at"`
+	OrderID     string    `json:"order_id"`
+	ItemID      string    `json:"item_id"`
+	Quantity    int       `json:"quantity"`
+	UserEmail   string    `json:"user_email"`
+	AmountMinor int64     `json:"amount_minor"`
+	Currency    string    `json:"currency"`
+	Reason      string    `json:"reason"`
+	RefundedAt  time.Time `json:"refunded_at"`
+}
+
+// PaymentRefundFailedEvent replies to a payment.refund command that could not
+// be carried out (orchestrated sagas only)
+type PaymentRefundFailedEvent struct {
+	OrderID  string    `json:"order_id"`
+	Reason   string    `json:"reason"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// PaymentVoidFailedEvent replies to a payment.void command whose hold the
+// provider refused to release (orchestrated sagas only)
+type PaymentVoidFailedEvent struct {
+	OrderID  string    `json:"order_id"`
+	Reason   string    `json:"reason"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// SagaCommand is sent by the order service's orchestrator on the saga
+// exchange (payment.authorize, inventory.reserve, payment.capture,
+// payment.void, and payment.charge and payment.refund for older sagas)
+type SagaCommand struct {
+	OrderID    string `json:"order_id"`
+	ItemID     string `json:"item_id"`
+	Quantity   int    `json:"quantity"`
+	UserEmail  string `json:"user_email"`
+	TotalMinor int64  `json:"total_minor"`
+	Currency   string `json:"currency"`
+	Reason     string `json:"reason"`
+}
+
+// ProductEvent is a snapshot of an inventory product, published on
+// product.created, product.updated and product.stock_changed. Version goes
+// up with every change to the product. Variants (SKUs) carry their ParentID
+// and the Attributes that tell them apart. AllowBackorder products accept
+// orders for more than is available.
+type ProductEvent struct {
+	ProductID      string            `json:"product_id"`
+	Name           string            `json:"name"`
+	Stock          int               `json:"stock"`
+	Reserved       int               `json:"reserved"`
+	PriceMinor     int64             `json:"price_minor"`
+	Currency       string            `json:"currency"`
+	AllowBackorder bool              `json:"allow_backorder"`
+	Version        int64             `json:"version"`
+	ParentID       string            `json:"parent_id,omitempty"`
+	Attributes     map[string]string `json:"attributes,omitempty"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	OccurredAt     time.Time         `json:"occurred_at"`
+}
+
+// StockAlertEvent is published by the inventory service when a product's
+// available stock (stock - reserved) crosses its reorder threshold:
+// inventory.low_stock at or below it, inventory.out_of_stock at zero, and
+// inventory.restocked once it is back above it. Level and PreviousLevel are
+// OK, LOW or OUT.
+type StockAlertEvent struct {
+	ProductID        string    `json:"product_id"`
+	Name             string    `json:"name"`
+	Stock            int       `json:"stock"`
+	Reserved         int       `json:"reserved"`
+	Available        int       `json:"available"`
+	ReorderThreshold int       `json:"reorder_threshold"`
+	PreviousLevel    string    `json:"previous_level"`
+	Level            string    `json:"level"`
+	OccurredAt       time.Time `json:"occurred_at"`
 }
 
 const (
 	// Event names
 	EventOrderCreated        = "order.created"
+	EventOrderTimedOut       = "order.timed_out"
+	EventOrderCancelled      = "order.cancelled"
 	EventInventoryProcessed  = "inventory.processed"
 	EventInventorySuccessful = "inventory.successful"
 	EventInventoryFailed     = "inventory.failed"
+	EventInventoryReserved   = "inventory.reserved"
+	EventInventoryReleased   = "inventory.released"
+
+	EventInventoryBackordered = "inventory.backordered"
+	EventBackorderFilled      = "inventory.backorder_filled"
+	EventBackorderExpired     = "inventory.backorder_expired"
+	EventBackorderCancelled   = "inventory.backorder_cancelled"
+
 	EventPaymentProcessed    = "payment.successful"
+	EventPaymentAuthorized   = "payment.authorized"
+	EventPaymentCaptured     = "payment.captured"
+	EventPaymentVoided       = "payment.voided"
+	EventPaymentVoidFailed   = "payment.void_failed"
 	EventPaymentFailed       = "payment.failed"
 	EventPaymentRefunded     = "payment.refunded"
+	EventPaymentRefundFailed = "payment.refund_failed"
+	EventProductCreated      = "product.created"
+	EventProductUpdated      = "product.updated"
+	EventProductStockChanged = "product.stock_changed"
+	EventInventoryLowStock   = "inventory.low_stock"
+	EventInventoryOutOfStock = "inventory.out_of_stock"
+	EventInventoryRestocked  = "inventory.restocked"
+
+	// Saga commands
+	CommandPaymentAuthorize = "payment.authorize"
+	CommandPaymentCapture   = "payment.capture"
+	CommandPaymentVoid      = "payment.void"
+	CommandPaymentCharge    = "payment.charge"
+	CommandPaymentRefund    = "payment.refund"
+	CommandInventoryReserve = "inventory.reserve"
+
+	// Messages of orchestrated sagas carry SagaModeHeader set to
+	// SagaModeOrchestration
+	SagaModeHeader        = "x-saga-mode"
+	SagaModeChoreography  = "choreography"
+	SagaModeOrchestration = "orchestration"
+
+	// Messages of inventory-first sagas carry SagaOrderHeader set to
+	// SagaOrderInventoryFirst
+	SagaOrderHeader         = "x-saga-order"
+	SagaOrderPaymentFirst   = "payment_first"
+	SagaOrderInventoryFirst = "inventory_first"
 
 	// Exchange names
 	ExchangeOrders    = "orders"
 	ExchangeInventory = "inventory"
 	ExchangePayments  = "payments"
+	ExchangeSaga      = "saga"
 
 	// Queue names
 	QueueOrderCreated             = "order.created.queue"
+	QueueOrderTimedOutPayment     = "order.timed_out.payment.queue"
 	QueueInventoryProcessed       = "inventory.processed.queue"
 	QueueInventorySuccessful      = "inventory.successful.queue"
 	QueueInventorySuccessfulOrder = "inventory.successful.order.queue"
@@ -103,9 +395,28 @@ const (
 	QueuePaymentFailed            = "payment.failed.queue"
 	QueuePaymentRefunded          = "payment.refunded.queue"
 	QueuePaymentProcessedOrder    = "payment.successful.order.queue"
+	QueueProductEventsOrder       = "product.events.order.queue"
+	QueueOrderCreatedInventory    = "order.created.inventory.queue"
+	QueueOrderCancelledInventory  = "order.cancelled.inventory.queue"
+	QueueInventoryReservedPayment = "inventory.reserved.payment.queue"
+	QueuePaymentFailedInventory   = "payment.failed.inventory.queue"
+	QueueSagaCommandsPayment      = "saga.commands.payment.queue"
+	QueueSagaCommandsInventory    = "saga.commands.inventory.queue"
+	QueueSagaRepliesOrder         = "saga.replies.order.queue"
+	QueueStockAlertNotification   = "inventory.stock_alert.notification.queue"
+
+	// Authorize-then-capture queues (payment-first sagas)
+	QueueInventorySuccessfulPayment = "inventory.successful.payment.queue"
+	QueuePaymentCapturedOrder       = "payment.captured.order.queue"
+
+	// Backorder queues
+	QueueInventoryBackorderedOrder        = "inventory.backordered.order.queue"
+	QueueInventoryBackorderedNotification = "inventory.backordered.notification.queue"
 
 	// Routing keys
 	RoutingKeyOrderCreated       = "order.created"
+	RoutingKeyOrderTimedOut      = "order.timed_out"
+	RoutingKeyOrderCancelled     = "order.cancelled"
 	RoutingKeyInventoryProcessed = "inventory.processed"
 	RoutingKeyInventoryFailed    = "inventory.failed"
 )